@@ -0,0 +1,46 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"github.com/cloudboss/keights/pkg/bootstrap"
+	"github.com/spf13/cobra"
+)
+
+var (
+	bootstrapConfig string
+	bootstrapRole   string
+	bootstrapCmd    = &cobra.Command{
+		Use:   "bootstrap",
+		Short: "Bootstrap an instance in a given role, resuming after the last completed phase",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return bootstrap.DoIt(cmd.Context(), bootstrapConfig, bootstrapRole)
+		},
+	}
+)
+
+func init() {
+	RootCmd.AddCommand(bootstrapCmd)
+	bootstrapCmd.Flags().StringVarP(&bootstrapConfig, "config", "f",
+		bootstrap.DefaultConfig, "Path to bootstrap config file")
+	bootstrapCmd.Flags().StringVarP(&bootstrapRole, "role", "r",
+		"", "Role of instance, one of etcd, controller-stacked, controller-external, node; overrides config")
+}
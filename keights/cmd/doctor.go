@@ -0,0 +1,57 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"github.com/cloudboss/keights/pkg/bootstrap"
+	"github.com/cloudboss/keights/pkg/doctor"
+	"github.com/spf13/cobra"
+)
+
+var (
+	doctorConfig      string
+	doctorRole        string
+	doctorClusterName string
+	doctorMountPoint  string
+	doctorOutput      string
+	doctorCmd         = &cobra.Command{
+		Use:   "doctor",
+		Short: "Check the state of this node and report problems",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return doctor.DoIt(cmd.Context(), cmd.OutOrStdout(), doctorConfig, doctorRole,
+				doctorClusterName, doctorMountPoint, doctorOutput)
+		},
+	}
+)
+
+func init() {
+	RootCmd.AddCommand(doctorCmd)
+	doctorCmd.Flags().StringVarP(&doctorConfig, "config", "f",
+		bootstrap.DefaultConfig, "Path to bootstrap config file, for role and cluster name if not given")
+	doctorCmd.Flags().StringVarP(&doctorRole, "role", "r",
+		"", "Role of instance, one of etcd, controller-stacked, controller-external, node")
+	doctorCmd.Flags().StringVarP(&doctorClusterName, "clusterName", "c",
+		"", "Name of Kubernetes cluster")
+	doctorCmd.Flags().StringVar(&doctorMountPoint, "mount-point",
+		"", "Mount point of etcd volume, for roles with etcd")
+	doctorCmd.Flags().StringVarP(&doctorOutput, "output", "o",
+		doctor.FormatText, "Output format, one of text or json")
+}
@@ -0,0 +1,53 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"github.com/cloudboss/keights/pkg/kubeconfig"
+	"github.com/spf13/cobra"
+)
+
+var (
+	kubeconfigCluster string
+	kubeconfigServer  string
+	kubeconfigPort    int
+	kubeconfigOutput  string
+	kubeconfigCmd     = &cobra.Command{
+		Use:   "kubeconfig",
+		Short: "Write a kubeconfig for the admin user of a cluster",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return kubeconfig.DoIt(cmd.Context(), cmd.OutOrStdout(), kubeconfigCluster,
+				kubeconfigServer, kubeconfigPort, kubeconfigOutput)
+		},
+	}
+)
+
+func init() {
+	RootCmd.AddCommand(kubeconfigCmd)
+	kubeconfigCmd.Flags().StringVarP(&kubeconfigCluster, "cluster", "c",
+		"", "Name of Kubernetes cluster")
+	kubeconfigCmd.Flags().StringVarP(&kubeconfigServer, "server", "s",
+		"", "URL of API server, instead of finding the load balancer named after the cluster")
+	kubeconfigCmd.Flags().IntVarP(&kubeconfigPort, "port", "p",
+		kubeconfig.DefaultPort, "Port of API server on the load balancer")
+	kubeconfigCmd.Flags().StringVarP(&kubeconfigOutput, "output", "o",
+		"", "Kubeconfig file to merge into, or - for stdout; defaults to KUBECONFIG or ~/.kube/config")
+}
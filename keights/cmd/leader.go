@@ -0,0 +1,64 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"time"
+
+	"github.com/cloudboss/keights/pkg/leader"
+	"github.com/spf13/cobra"
+)
+
+var (
+	leaderCluster string
+	leaderName    string
+	leaderOnce    bool
+	leaderTTL     time.Duration
+	leaderMinutes int
+	leaderCmd     = &cobra.Command{
+		Use:   "leader",
+		Short: "Coordinate work among instances of a cluster",
+	}
+	leaderRunCmd = &cobra.Command{
+		Use:   "run -- command [args...]",
+		Short: "Run command on one instance while holding a lease in DynamoDB",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return leader.DoRun(cmd.Context(), leaderCluster, leaderName, args,
+				leaderOnce, leaderTTL, leaderMinutes)
+		},
+	}
+)
+
+func init() {
+	RootCmd.AddCommand(leaderCmd)
+	leaderCmd.AddCommand(leaderRunCmd)
+	leaderRunCmd.Flags().StringVarP(&leaderCluster, "clusterName", "c",
+		"", "Name of Kubernetes cluster")
+	leaderRunCmd.Flags().StringVarP(&leaderName, "name", "n",
+		"", "Name of lease, unique to the task")
+	leaderRunCmd.Flags().BoolVar(&leaderOnce, "once",
+		true, "Mark command done so no instance runs it again, instead of releasing lease")
+	leaderRunCmd.Flags().DurationVar(&leaderTTL, "ttl",
+		time.Minute, "Time after which lease expires if not renewed")
+	leaderRunCmd.Flags().IntVarP(&leaderMinutes, "minutes", "m",
+		60, "Number of minutes to wait to acquire lease")
+}
@@ -0,0 +1,79 @@
+// Copyright © 2018 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"github.com/cloudboss/keights/pkg/lifecycle"
+	"github.com/cloudboss/keights/pkg/readiness"
+	"github.com/spf13/cobra"
+)
+
+var (
+	hookName         string
+	lifecycleToken   string
+	heartbeatMinutes int
+	lifecycleMinutes int
+	lifecycleGates   readiness.Gates
+	lifecycleCmd     = &cobra.Command{
+		Use:   "lifecycle",
+		Short: "Act on autoscaling lifecycle hooks",
+	}
+	lifecycleCompleteCmd = &cobra.Command{
+		Use:   "complete",
+		Short: "Complete lifecycle action, optionally waiting for readiness",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return lifecycle.DoIt(cmd.Context(), lifecycle.ActionComplete, hookName, lifecycleToken,
+				&lifecycleGates, heartbeatMinutes, lifecycleMinutes)
+		},
+	}
+	lifecycleHeartbeatCmd = &cobra.Command{
+		Use:   "heartbeat",
+		Short: "Record heartbeat for lifecycle action",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return lifecycle.DoIt(cmd.Context(), lifecycle.ActionHeartbeat, hookName, lifecycleToken,
+				&lifecycleGates, heartbeatMinutes, lifecycleMinutes)
+		},
+	}
+	lifecycleAbandonCmd = &cobra.Command{
+		Use:   "abandon",
+		Short: "Abandon lifecycle action",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return lifecycle.DoIt(cmd.Context(), lifecycle.ActionAbandon, hookName, lifecycleToken,
+				&lifecycleGates, heartbeatMinutes, lifecycleMinutes)
+		},
+	}
+)
+
+func init() {
+	RootCmd.AddCommand(lifecycleCmd)
+	lifecycleCmd.AddCommand(lifecycleCompleteCmd)
+	lifecycleCmd.AddCommand(lifecycleHeartbeatCmd)
+	lifecycleCmd.AddCommand(lifecycleAbandonCmd)
+	lifecycleCmd.PersistentFlags().StringVarP(&hookName, "hook-name", "k",
+		"", "Name of lifecycle hook, found on autoscaling group if not given")
+	lifecycleCmd.PersistentFlags().StringVarP(&lifecycleToken, "token", "t",
+		"", "Lifecycle action token, instance ID is used if not given")
+	lifecycleCompleteCmd.Flags().IntVarP(&heartbeatMinutes, "heartbeat-minutes", "b",
+		5, "Number of minutes between heartbeats while waiting for readiness")
+	lifecycleCompleteCmd.Flags().IntVarP(&lifecycleMinutes, "minutes", "m",
+		60, "Number of minutes to wait for readiness")
+	addGateFlags(lifecycleCompleteCmd, &lifecycleGates)
+}
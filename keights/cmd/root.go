@@ -21,28 +21,57 @@
 package cmd
 
 import (
-	"fmt"
 	"os"
 
+	"github.com/cloudboss/keights/pkg/config"
+	"github.com/cloudboss/keights/pkg/helpers"
+	"github.com/cloudboss/keights/pkg/logging"
+	"github.com/cloudboss/keights/pkg/metadata"
 	"github.com/spf13/cobra"
 )
 
 var (
-	volumeTag string
-	logLevel  string
-	RootCmd   = &cobra.Command{
-		Use:   "keights",
-		Short: "Config utilities to bootstrap Kubernetes",
+	volumeTag      string
+	logLevel       string
+	logFormat      string
+	metadataSource string
+	metadataFile   string
+	configFile     string
+	RootCmd        = &cobra.Command{
+		Use:           "keights",
+		Short:         "Config utilities to bootstrap Kubernetes",
+		SilenceErrors: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if _, err := config.Apply(cmd, os.LookupEnv); err != nil {
+				return err
+			}
+			if err := logging.Configure(logLevel, logFormat); err != nil {
+				return err
+			}
+			logging.AddFields("phase", cmd.Name())
+			return metadata.Configure(metadataSource, metadataFile)
+		},
 	}
 )
 
 func Execute() {
-	if err := RootCmd.Execute(); err != nil {
-		fmt.Println(err)
+	ctx, cancel := helpers.SignalContext()
+	defer cancel()
+	if err := RootCmd.ExecuteContext(ctx); err != nil {
+		logging.Error("Command failed", "error", err)
 		os.Exit(1)
 	}
 }
 
 func init() {
-	RootCmd.Flags().StringVarP(&logLevel, "log-level", "l", "info", "Logging level")
+	RootCmd.PersistentFlags().StringVar(&configFile, config.FileFlag,
+		config.DefaultFile, "Config file with defaults for flags, which may also be set with KEIGHTS_* environment variables")
+	RootCmd.PersistentFlags().StringVarP(&logLevel, "log-level", "l",
+		"info", "Logging level, one of debug, info, warn, error")
+	RootCmd.PersistentFlags().StringVar(&logFormat, "log-format",
+		logging.FormatText, "Logging format, text or json")
+	RootCmd.PersistentFlags().StringVar(&metadataSource, "metadata-source",
+		metadata.SourceIMDS, "Source of instance metadata, one of imds, file, env")
+	RootCmd.PersistentFlags().StringVar(&metadataFile, "metadata-file",
+		metadata.DefaultFile, "Instance metadata file for file metadata source")
 }
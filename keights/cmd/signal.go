@@ -24,15 +24,18 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/cloudboss/keights/pkg/readiness"
 	"github.com/cloudboss/keights/pkg/signal"
 	"github.com/spf13/cobra"
 )
 
 var (
-	stackName string
-	status    string
-	resource  string
-	signalCmd = &cobra.Command{
+	stackName     string
+	status        string
+	resource      string
+	signalMinutes int
+	signalGates   readiness.Gates
+	signalCmd     = &cobra.Command{
 		Use:   "signal",
 		Short: "Signal success or failure to CloudFormation stack",
 		RunE: func(cmd *cobra.Command, args []string) error {
@@ -43,7 +46,7 @@ var (
 			if status != "SUCCESS" && status != "FAILURE" {
 				return fmt.Errorf("status must be one of SUCCESS or FAILURE")
 			}
-			return signal.DoIt(stackName, status, resource)
+			return signal.DoIt(cmd.Context(), stackName, status, resource, &signalGates, signalMinutes)
 		},
 	}
 )
@@ -56,4 +59,20 @@ func init() {
 		"", `Status to send, either "SUCCESS" or "FAILURE"`)
 	signalCmd.Flags().StringVarP(&resource, "resource", "r",
 		"AutoScalingGroup", "Resource in CloudFormation stack to signal")
+	signalCmd.Flags().IntVarP(&signalMinutes, "minutes", "m",
+		60, "Number of minutes to wait for readiness")
+	addGateFlags(signalCmd, &signalGates)
+}
+
+func addGateFlags(cmd *cobra.Command, gates *readiness.Gates) {
+	cmd.Flags().StringArrayVar(&gates.Files, "wait-file",
+		[]string{}, "File that must exist before ready")
+	cmd.Flags().StringArrayVar(&gates.URLs, "wait-url",
+		[]string{}, "URL that must return 200 OK before ready")
+	cmd.Flags().StringVar(&gates.CACert, "cacert",
+		"", "CA certificate to verify wait URLs")
+	cmd.Flags().StringVar(&gates.Cert, "cert",
+		"", "Client certificate for wait URLs")
+	cmd.Flags().StringVar(&gates.Key, "key",
+		"", "Client key for wait URLs")
 }
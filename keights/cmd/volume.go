@@ -0,0 +1,65 @@
+// Copyright © 2018 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"time"
+
+	"github.com/cloudboss/keights/pkg/volumize"
+	"github.com/spf13/cobra"
+)
+
+var (
+	snapshotDevice      string
+	snapshotVolumeTag   string
+	snapshotClusterName string
+	freezeMountPoint    string
+	retention           volumize.Retention
+	volumeCmd           = &cobra.Command{
+		Use:   "volume",
+		Short: "Manage EBS volumes",
+	}
+	volumeSnapshotCmd = &cobra.Command{
+		Use:   "snapshot",
+		Short: "Snapshot attached EBS volume and prune old snapshots",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return volumize.DoSnapshot(cmd.Context(), snapshotDevice, snapshotVolumeTag,
+				snapshotClusterName, freezeMountPoint, retention)
+		},
+	}
+)
+
+func init() {
+	RootCmd.AddCommand(volumeCmd)
+	volumeCmd.AddCommand(volumeSnapshotCmd)
+	volumeSnapshotCmd.Flags().StringVarP(&snapshotDevice, "device", "d",
+		"/dev/xvdg", "Name of device for EBS volume")
+	volumeSnapshotCmd.Flags().StringVarP(&snapshotVolumeTag, "volume-tag", "v",
+		"", "Tag to search on EBS volume")
+	volumeSnapshotCmd.Flags().StringVarP(&snapshotClusterName, "clusterName", "c",
+		"", "Name of Kubernetes cluster")
+	volumeSnapshotCmd.Flags().StringVarP(&freezeMountPoint, "freeze", "f",
+		"", "Mount point of filesystem to freeze during snapshot")
+	volumeSnapshotCmd.Flags().IntVarP(&retention.Keep, "keep", "k",
+		0, "Number of snapshots to keep, 0 to keep all")
+	volumeSnapshotCmd.Flags().DurationVarP(&retention.MaxAge, "max-age", "a",
+		time.Duration(0), "Age after which snapshots are deleted, 0 to keep all")
+}
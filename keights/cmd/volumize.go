@@ -26,16 +26,54 @@ import (
 )
 
 var (
-	device      string
-	fsType      string
-	mountPoint  string
-	clusterName string
-	minutes     int
-	volumizeCmd = &cobra.Command{
+	device             string
+	fsType             string
+	mountPoint         string
+	clusterName        string
+	minutes            int
+	manifest           string
+	volumeSpec         volumize.VolumeSpec
+	reserved           int
+	encrypted          bool
+	instanceStore      bool
+	instanceStorePaths []string
+	volumizeCmd        = &cobra.Command{
 		Use:   "volumize",
 		Short: "Attach and format EBS volumes",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return volumize.DoIt(device, volumeTag, fsType, mountPoint, clusterName, minutes)
+			if manifest != "" {
+				return volumize.DoManifest(cmd.Context(), manifest, clusterName, minutes)
+			}
+			volumeSpec.Tag = volumeTag
+			volumeSpec.Device = device
+			volumeSpec.FsType = fsType
+			volumeSpec.MountPoint = mountPoint
+			if reserved >= 0 {
+				volumeSpec.ReservedBlocksPercent = &reserved
+			}
+			volumeSpec.Encrypted = &encrypted
+			if instanceStore {
+				return volumize.DoInstanceStore(cmd.Context(), &volumeSpec, instanceStorePaths)
+			}
+			return volumize.DoIt(cmd.Context(), &volumeSpec, clusterName, minutes)
+		},
+	}
+	releaseSpec     volumize.VolumeSpec
+	releaseCluster  string
+	releaseManifest string
+	releaseUnits    []string
+	releaseMinutes  int
+	releaseOnlyTerm bool
+	releaseCmd      = &cobra.Command{
+		Use:   "release",
+		Short: "Stop consumers, unmount, and detach EBS volumes",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if releaseManifest != "" {
+				return volumize.DoReleaseManifest(cmd.Context(), releaseManifest, releaseCluster,
+					releaseUnits, releaseMinutes, releaseOnlyTerm)
+			}
+			return volumize.DoRelease(cmd.Context(), &releaseSpec, releaseCluster, releaseUnits,
+				releaseMinutes, releaseOnlyTerm)
 		},
 	}
 )
@@ -54,4 +92,76 @@ func init() {
 		"", "Name of Kubernetes cluster")
 	volumizeCmd.Flags().IntVarP(&minutes, "minutes", "m",
 		60, "Number of minutes to wait")
+	volumizeCmd.Flags().StringVarP(&manifest, "manifest", "M",
+		"", "Manifest of volumes, overrides single volume flags")
+	volumizeCmd.Flags().StringArrayVar(&volumeSpec.MkfsOptions, "mkfs-option",
+		[]string{}, "Extra argument to mkfs")
+	volumizeCmd.Flags().StringVarP(&volumeSpec.Label, "label", "L",
+		"", "Label of filesystem")
+	volumizeCmd.Flags().IntVar(&reserved, "reserved-blocks-percent",
+		-1, "Percentage of ext filesystem reserved for root, mkfs default if negative")
+	volumizeCmd.Flags().StringSliceVarP(&volumeSpec.MountOptions, "mount-options", "o",
+		[]string{}, "Comma separated mount options, default depends on filesystem type")
+	volumizeCmd.Flags().BoolVar(&volumeSpec.MountUnit, "mount-unit",
+		false, "Mount with systemd mount unit instead of fstab")
+	volumizeCmd.Flags().DurationVar(&volumeSpec.DeviceTimeout, "device-timeout",
+		volumize.DefaultDeviceTimeout, "Time for mount unit to wait for device")
+	volumizeCmd.Flags().BoolVar(&volumeSpec.Grow, "grow",
+		false, "Grow filesystem if volume is larger")
+	volumizeCmd.Flags().StringVar(&volumeSpec.Member, "member",
+		"", "Value of volume tag for this instance's volume")
+	volumizeCmd.Flags().BoolVar(&volumeSpec.Create, "create",
+		false, "Create volume if none is available, from latest snapshot if any")
+	volumizeCmd.Flags().BoolVar(&volumeSpec.Migrate, "migrate",
+		false, "Migrate volume from another availability zone if none is available")
+	volumizeCmd.Flags().Int64Var(&volumeSpec.Size, "size",
+		0, "Size in GiB of created volume")
+	volumizeCmd.Flags().StringVar(&volumeSpec.VolumeType, "volume-type",
+		"", "Type of created volume")
+	volumizeCmd.Flags().Int64Var(&volumeSpec.Iops, "iops",
+		0, "IOPS of created volume")
+	volumizeCmd.Flags().Int64Var(&volumeSpec.Throughput, "throughput",
+		0, "Throughput in MiB/s of created volume")
+	volumizeCmd.Flags().BoolVar(&encrypted, "encrypted",
+		true, "Encrypt created volume, always if a KMS key is given or required")
+	volumizeCmd.Flags().StringVar(&volumeSpec.KMSKeyID, "kms-key-id",
+		"", "KMS key to encrypt created volume")
+	volumizeCmd.Flags().BoolVar(&volumeSpec.Policy.RequireEncryption, "require-encryption",
+		false, "Refuse to attach unencrypted volume")
+	volumizeCmd.Flags().StringVar(&volumeSpec.Policy.KMSKeyID, "require-kms-key-id",
+		"", "Refuse to attach volume not encrypted with this KMS key")
+	volumizeCmd.Flags().BoolVar(&volumeSpec.Policy.RequireTags, "require-tags",
+		false, "Refuse to attach volume without matching cluster and member tags")
+	volumizeCmd.Flags().Int64Var(&volumeSpec.Policy.MinSize, "require-min-size",
+		0, "Refuse to attach volume smaller than this size in GiB")
+	volumizeCmd.Flags().StringSliceVar(&volumeSpec.Policy.VolumeTypes, "require-volume-types",
+		[]string{}, "Refuse to attach volume not of one of these types")
+	volumizeCmd.Flags().BoolVar(&instanceStore, "instance-store",
+		false, "Format and mount instance store disks instead of EBS volume")
+	volumizeCmd.Flags().StringArrayVar(&instanceStorePaths, "instance-store-path",
+		[]string{"/var/lib/containerd"}, "Path to bind mount from instance store")
+}
+
+func init() {
+	volumizeCmd.AddCommand(releaseCmd)
+	releaseCmd.Flags().StringVarP(&releaseSpec.Device, "device", "d",
+		"/dev/xvdg", "Name of device for EBS volume")
+	releaseCmd.Flags().StringVarP(&releaseSpec.MountPoint, "mount-point", "p",
+		"/var/lib/etcd", "Filesystem path on which volume is mounted")
+	releaseCmd.Flags().StringVarP(&releaseSpec.Tag, "volume-tag", "v",
+		"", "Tag to search on EBS volume")
+	releaseCmd.Flags().StringVar(&releaseSpec.Member, "member",
+		"", "Value of volume tag for this instance's volume")
+	releaseCmd.Flags().BoolVar(&releaseSpec.MountUnit, "mount-unit",
+		false, "Volume is mounted with systemd mount unit")
+	releaseCmd.Flags().StringVarP(&releaseCluster, "clusterName", "c",
+		"", "Name of Kubernetes cluster")
+	releaseCmd.Flags().StringVarP(&releaseManifest, "manifest", "M",
+		"", "Manifest of volumes, overrides single volume flags")
+	releaseCmd.Flags().StringArrayVarP(&releaseUnits, "unit", "u",
+		[]string{}, "Systemd unit using the volume, stopped before release")
+	releaseCmd.Flags().IntVarP(&releaseMinutes, "minutes", "m",
+		10, "Number of minutes to wait for volume to detach")
+	releaseCmd.Flags().BoolVar(&releaseOnlyTerm, "only-terminating",
+		false, "Release only if the autoscaling group is terminating the instance")
 }
@@ -0,0 +1,155 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package bootstrap runs the steps to bring up an instance of a given role,
+// which are otherwise run by a chain of systemd units. Each phase is recorded
+// in a state directory when it completes, so bootstrap resumes where it left
+// off after a reboot, and a failure is signaled to CloudFormation with the
+// name of the phase that failed.
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cloudboss/keights/pkg/helpers"
+	"github.com/cloudboss/keights/pkg/logging"
+	"github.com/cloudboss/keights/pkg/metadata"
+	"github.com/cloudboss/keights/pkg/runner"
+	"github.com/cloudboss/keights/pkg/signal"
+)
+
+const (
+	StatusSuccess = "SUCCESS"
+	StatusFailure = "FAILURE"
+)
+
+var (
+	Runner runner.Runner = &runner.Exec{}
+	// RetryInterval is the time between attempts of a failed phase.
+	RetryInterval = 10 * time.Second
+)
+
+type Bootstrapper struct {
+	config   *Config
+	identity *metadata.Identity
+	state    *State
+	logger   *logging.Logger
+	signaler func(stackName, status, resource, uniqueID, region string) error
+}
+
+func NewBootstrapper(config *Config, identity *metadata.Identity) (*Bootstrapper, error) {
+	state, err := NewState(config.StateDir)
+	if err != nil {
+		return nil, err
+	}
+	return &Bootstrapper{
+		config:   config,
+		identity: identity,
+		state:    state,
+		logger:   logging.Default(),
+		signaler: signal.Signal,
+	}, nil
+}
+
+func (b *Bootstrapper) signal(status, uniqueID string) error {
+	if b.config.StackName == "" {
+		b.logger.Info("No stack name configured, not signaling", "status", status)
+		return nil
+	}
+	return b.signaler(b.config.StackName, status, b.config.Resource, uniqueID,
+		b.identity.Region)
+}
+
+// attempt runs the phase up to the configured number of attempts, or only
+// once if it fails with a helpers.Permanent error, as a phase does when it
+// is not safe to run again.
+func (b *Bootstrapper) attempt(ctx context.Context, phase Phase) error {
+	var err error
+	for i := 1; i <= b.config.Attempts; i++ {
+		if err = phase.Run(ctx, b); err == nil {
+			return nil
+		}
+		b.logger.Warn("Phase failed", "phase", phase.Name, "attempt", i, "error", err)
+		if i == b.config.Attempts || helpers.IsPermanent(err) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(RetryInterval):
+		}
+	}
+	return err
+}
+
+// Run runs the phases in order, skipping phases already completed unless
+// they must run on every boot. If a phase fails after all attempts, failure
+// is signaled with a unique ID of the instance ID and the phase name, so the
+// phase shows in the stack's events.
+func (b *Bootstrapper) Run(ctx context.Context, phases []Phase) error {
+	for _, phase := range phases {
+		if !phase.EveryBoot && b.state.Done(phase.Name) {
+			b.logger.Debug("Skipping completed phase", "phase", phase.Name)
+			continue
+		}
+		b.logger.Info("Running phase", "phase", phase.Name)
+		if err := b.attempt(ctx, phase); err != nil {
+			if stateErr := b.state.Fail(phase.Name, err); stateErr != nil {
+				b.logger.Warn("Unable to record failure", "phase", phase.Name,
+					"error", stateErr)
+			}
+			uniqueID := fmt.Sprintf("%s:%s", b.identity.InstanceID, phase.Name)
+			if sigErr := b.signal(StatusFailure, uniqueID); sigErr != nil {
+				b.logger.Warn("Unable to signal failure", "phase", phase.Name,
+					"error", sigErr)
+			}
+			return fmt.Errorf("Bootstrap failed in phase %s: %w", phase.Name, err)
+		}
+		if err := b.state.Complete(phase.Name); err != nil {
+			return err
+		}
+		b.logger.Info("Completed phase", "phase", phase.Name)
+	}
+	return nil
+}
+
+func DoIt(ctx context.Context, configPath, role string) error {
+	config, err := LoadConfig(configPath, role)
+	if err != nil {
+		return err
+	}
+	identity, err := metadata.Get()
+	if err != nil {
+		return err
+	}
+	logging.AddFields("cluster", config.ClusterName, "instance", identity.InstanceID,
+		"role", config.Role)
+	phases, err := Phases(config.Role)
+	if err != nil {
+		return err
+	}
+	b, err := NewBootstrapper(config, identity)
+	if err != nil {
+		return err
+	}
+	return b.Run(ctx, phases)
+}
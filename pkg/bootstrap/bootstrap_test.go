@@ -0,0 +1,409 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package bootstrap
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudboss/keights/pkg/logging"
+	"github.com/cloudboss/keights/pkg/metadata"
+	"github.com/cloudboss/keights/pkg/runner"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseConfig(t *testing.T) {
+	testCases := []struct {
+		name     string
+		contents string
+		role     string
+		config   *Config
+		err      string
+	}{
+		{
+			name:     "node with defaults",
+			contents: "role: node\nclusterName: kate\n",
+			config: &Config{
+				Role:        RoleNode,
+				ClusterName: "kate",
+				Resource:    "AutoScalingGroup",
+				StateDir:    DefaultStateDir,
+				TemplateDir: DefaultTemplateDir,
+				Minutes:     60,
+				Attempts:    3,
+				Vars:        map[string]string{},
+			},
+		},
+		{
+			name:     "role flag overrides config",
+			contents: "role: node\nclusterName: kate\nvolumeManifest: /etc/keights/volumes.yaml\n",
+			role:     RoleControllerStacked,
+			config: &Config{
+				Role:           RoleControllerStacked,
+				ClusterName:    "kate",
+				Resource:       "AutoScalingGroup",
+				StateDir:       DefaultStateDir,
+				TemplateDir:    DefaultTemplateDir,
+				Minutes:        60,
+				Attempts:       3,
+				Vars:           map[string]string{},
+				VolumeManifest: "/etc/keights/volumes.yaml",
+			},
+		},
+		{
+			name:     "unknown role",
+			contents: "role: master\nclusterName: kate\n",
+			err:      "role must be one of etcd, controller-stacked, controller-external, node",
+		},
+		{
+			name:     "missing cluster name",
+			contents: "role: node\n",
+			err:      "clusterName is required",
+		},
+		{
+			name:     "etcd without volume",
+			contents: "role: etcd\nclusterName: kate\n",
+			err:      "volume or volumeManifest is required for role etcd",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := ParseConfig([]byte(tc.contents), tc.role)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.config, config)
+		})
+	}
+}
+
+func TestParseConfigVolumeDefaults(t *testing.T) {
+	contents := "role: etcd\nclusterName: kate\nvolume:\n  device: /dev/xvdg\n  size: 10\n"
+	config, err := ParseConfig([]byte(contents), "")
+	assert.NoError(t, err)
+	assert.Equal(t, "ext4", config.Volume.FsType)
+	assert.Equal(t, "/var/lib/etcd", config.Volume.MountPoint)
+}
+
+func TestState(t *testing.T) {
+	state, err := NewState(t.TempDir())
+	assert.NoError(t, err)
+	assert.False(t, state.Done("whisper"))
+
+	assert.NoError(t, state.Fail("whisper", errors.New("access denied")))
+	failed, err := state.Failed()
+	assert.NoError(t, err)
+	assert.Equal(t, "whisper", failed)
+
+	assert.NoError(t, state.Complete("whisper"))
+	assert.True(t, state.Done("whisper"))
+	failed, err = state.Failed()
+	assert.NoError(t, err)
+	assert.Equal(t, "", failed)
+}
+
+func TestPhases(t *testing.T) {
+	testCases := []struct {
+		role  string
+		names []string
+		err   string
+	}{
+		{
+			role:  RoleEtcd,
+			names: []string{"whisper", "config", "volumize", "certs", "start", "healthy", "signal"},
+		},
+		{
+			role:  RoleControllerStacked,
+			names: []string{"whisper", "volumize", "config", "kubeadm-init", "healthy", "signal", "kubelet"},
+		},
+		{
+			role:  RoleControllerExternal,
+			names: []string{"whisper", "config", "certs", "kubeadm-init", "healthy", "signal", "kubelet"},
+		},
+		{
+			role:  RoleNode,
+			names: []string{"whisper", "config", "kubeadm-join", "signal", "kubelet"},
+		},
+		{
+			role: "master",
+			err:  "Unknown role master",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.role, func(t *testing.T) {
+			phases, err := Phases(tc.role)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			names := []string{}
+			for _, phase := range phases {
+				assert.NotEqual(t, failedFile, phase.Name)
+				names = append(names, phase.Name)
+			}
+			assert.Equal(t, tc.names, names)
+		})
+	}
+}
+
+type signalCall struct {
+	status   string
+	uniqueID string
+}
+
+func newTestBootstrapper(t *testing.T, stackName string) (*Bootstrapper, *[]signalCall) {
+	state, err := NewState(t.TempDir())
+	assert.NoError(t, err)
+	logger, err := logging.New(ioutil.Discard, logging.LevelError, "text")
+	assert.NoError(t, err)
+	calls := []signalCall{}
+	b := &Bootstrapper{
+		config: &Config{StackName: stackName, Resource: "AutoScalingGroup", Attempts: 2},
+		identity: &metadata.Identity{
+			InstanceID: "i-0123456789abcdef0",
+			Region:     "us-east-1",
+		},
+		state:  state,
+		logger: logger,
+		signaler: func(stackName, status, resource, uniqueID, region string) error {
+			calls = append(calls, signalCall{status, uniqueID})
+			return nil
+		},
+	}
+	return b, &calls
+}
+
+func countingPhase(name string, everyBoot bool, runs map[string]int, err error) Phase {
+	return Phase{
+		Name:      name,
+		EveryBoot: everyBoot,
+		Run: func(ctx context.Context, b *Bootstrapper) error {
+			runs[name]++
+			return err
+		},
+	}
+}
+
+func TestRunResumes(t *testing.T) {
+	RetryInterval = time.Millisecond
+	b, calls := newTestBootstrapper(t, "kate-nodes")
+	runs := map[string]int{}
+	failure := errors.New("kubeadm exited with status 1")
+	phases := []Phase{
+		countingPhase("whisper", true, runs, nil),
+		countingPhase("config", false, runs, nil),
+		countingPhase("kubeadm-join", false, runs, failure),
+	}
+
+	err := b.Run(context.Background(), phases)
+	assert.EqualError(t, err, "Bootstrap failed in phase kubeadm-join: kubeadm exited with status 1")
+	assert.True(t, errors.Is(err, failure))
+	assert.Equal(t, map[string]int{"whisper": 1, "config": 1, "kubeadm-join": 2}, runs)
+	assert.Equal(t, []signalCall{
+		{StatusFailure, "i-0123456789abcdef0:kubeadm-join"},
+	}, *calls)
+	failed, err := b.state.Failed()
+	assert.NoError(t, err)
+	assert.Equal(t, "kubeadm-join", failed)
+
+	phases[2] = countingPhase("kubeadm-join", false, runs, nil)
+	phases = append(phases, Phase{"signal", false, signalSuccess})
+	assert.NoError(t, b.Run(context.Background(), phases))
+	assert.Equal(t, map[string]int{"whisper": 2, "config": 1, "kubeadm-join": 3}, runs)
+	assert.Equal(t, []signalCall{
+		{StatusFailure, "i-0123456789abcdef0:kubeadm-join"},
+		{StatusSuccess, "i-0123456789abcdef0"},
+	}, *calls)
+
+	assert.NoError(t, b.Run(context.Background(), phases))
+	assert.Equal(t, map[string]int{"whisper": 3, "config": 1, "kubeadm-join": 3}, runs)
+	assert.Len(t, *calls, 2)
+}
+
+func TestRunWithoutStack(t *testing.T) {
+	RetryInterval = time.Millisecond
+	b, calls := newTestBootstrapper(t, "")
+	runs := map[string]int{}
+	phases := []Phase{
+		countingPhase("whisper", true, runs, errors.New("access denied")),
+	}
+	err := b.Run(context.Background(), phases)
+	assert.EqualError(t, err, "Bootstrap failed in phase whisper: access denied")
+	assert.Empty(t, *calls)
+}
+
+func TestKubeadmRetries(t *testing.T) {
+	RetryInterval = time.Millisecond
+	defer func(r runner.Runner) { Runner = r }(Runner)
+	join := "kubeadm join --config=" + kubeadmConfig + " --ignore-preflight-errors=all"
+	reset := "kubeadm reset --force"
+	initialize := "kubeadm init --config=" + kubeadmConfig + " --ignore-preflight-errors=all --skip-token-print"
+	testCases := []struct {
+		phase Phase
+		calls []string
+	}{
+		{
+			phase: Phase{"kubeadm-join", false, kubeadmJoin},
+			calls: []string{join, reset, join, reset},
+		},
+		{
+			phase: Phase{"kubeadm-init", false, kubeadmInit},
+			calls: []string{initialize},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.phase.Name, func(t *testing.T) {
+			fake := runner.NewFake(map[string]*runner.Result{
+				join:       {ExitStatus: 1},
+				reset:      {},
+				initialize: {ExitStatus: 1},
+			})
+			Runner = fake
+			b, _ := newTestBootstrapper(t, "")
+			err := b.Run(context.Background(), []Phase{tc.phase})
+			assert.Error(t, err)
+			assert.Equal(t, tc.calls, fake.Calls)
+		})
+	}
+}
+
+const unitDir = "../../keights/resources/usr/lib/systemd/system"
+
+// unitDirectives returns the values of each directive in a unit file.
+func unitDirectives(t *testing.T, name string) map[string][]string {
+	contents, err := ioutil.ReadFile(filepath.Join(unitDir, name))
+	assert.NoError(t, err)
+	directives := map[string][]string{}
+	for _, line := range strings.Split(string(contents), "\n") {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) == 2 && !strings.HasPrefix(line, "#") {
+			directives[parts[0]] = append(directives[parts[0]], parts[1])
+		}
+	}
+	return directives
+}
+
+func TestStartEtcdWithBootstrap(t *testing.T) {
+	defer func(r runner.Runner) { Runner = r }(Runner)
+	fake := runner.NewFake(map[string]*runner.Result{"systemctl start etcd.service": {}})
+	Runner = fake
+	b, _ := newTestBootstrapper(t, "")
+	assert.NoError(t, startEtcd(context.Background(), b))
+	assert.Equal(t, []string{"systemctl start etcd.service"}, fake.Calls)
+
+	// Every keights unit that starting etcd.service pulls in must skip
+	// itself when bootstrap is configured, so that none overwrites what
+	// bootstrap has written or waits for environment it does not set.
+	pending := []string{"etcd.service"}
+	seen := map[string]bool{}
+	for len(pending) > 0 {
+		name := pending[0]
+		pending = pending[1:]
+		directives := unitDirectives(t, name)
+		if name != "etcd.service" {
+			assert.Contains(t, directives["ConditionPathExists"], "!"+DefaultConfig, name)
+		}
+		for _, requires := range directives["Requires"] {
+			for _, required := range strings.Fields(requires) {
+				if strings.HasPrefix(required, "keights-") && !seen[required] {
+					seen[required] = true
+					pending = append(pending, required)
+				}
+			}
+		}
+	}
+	assert.Len(t, seen, 5)
+}
+
+func TestUnitsReplacedByBootstrap(t *testing.T) {
+	bootstrap := unitDirectives(t, "keights-bootstrap.service")
+	assert.Equal(t, []string{DefaultConfig}, bootstrap["ConditionPathExists"])
+	assert.Equal(t, []string{"multi-user.target"}, bootstrap["WantedBy"])
+
+	for _, name := range []string{
+		"keights-whisper-controller.service",
+		"keights-whisper-node.service",
+		"keights-templatize-kubeadm-init-config.service",
+		"keights-templatize-kubeadm-join-config.service",
+		"keights-kubeadm-init-stacked.service",
+		"keights-kubeadm-init-external.service",
+		"keights-kubeadm-join.service",
+		"keights-controller-signal.service",
+		"keights-node-signal.service",
+	} {
+		directives := unitDirectives(t, name)
+		assert.Contains(t, directives["ConditionPathExists"], "!"+DefaultConfig, name)
+	}
+}
+
+func TestStartKubelet(t *testing.T) {
+	defer func(r runner.Runner) { Runner = r }(Runner)
+	enable := "systemctl enable --now kubelet.service"
+	fake := runner.NewFake(map[string]*runner.Result{enable: {}})
+	Runner = fake
+	b, _ := newTestBootstrapper(t, "")
+	assert.NoError(t, startKubelet(context.Background(), b))
+	assert.Equal(t, []string{enable}, fake.Calls)
+}
+
+func TestCACertHash(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kubernetes"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	caCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	spki, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	sum := sha256.Sum256(spki)
+
+	hash, err := CACertHash(caCert)
+	assert.NoError(t, err)
+	assert.Equal(t, hex.EncodeToString(sum[:]), hash)
+
+	_, err = CACertHash([]byte("not a certificate"))
+	assert.EqualError(t, err, "could not decode CA certificate")
+}
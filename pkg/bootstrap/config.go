@@ -0,0 +1,137 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package bootstrap
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/cloudboss/keights/pkg/volumize"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	RoleEtcd               = "etcd"
+	RoleControllerStacked  = "controller-stacked"
+	RoleControllerExternal = "controller-external"
+	RoleNode               = "node"
+
+	DefaultConfig      = "/etc/keights/bootstrap.yaml"
+	DefaultStateDir    = "/var/lib/keights/state"
+	DefaultTemplateDir = "/usr/share/keights"
+)
+
+// Config holds everything needed to bootstrap an instance, which was
+// previously spread over the environment of several systemd units.
+type Config struct {
+	Role        string `yaml:"role"`
+	ClusterName string `yaml:"clusterName"`
+	// StackName and Resource identify the CloudFormation resource to signal.
+	// No signal is sent if StackName is empty.
+	StackName   string `yaml:"stackName"`
+	Resource    string `yaml:"resource"`
+	StateDir    string `yaml:"stateDir"`
+	TemplateDir string `yaml:"templateDir"`
+	// Minutes is how long to wait for the instance to become healthy.
+	Minutes int `yaml:"minutes"`
+	// Attempts is how many times a phase is tried before bootstrap fails.
+	Attempts int `yaml:"attempts"`
+	// Vars are passed to the templates, in addition to MyIP, MyAZ,
+	// NodeName, Token, CACertHash, and EtcdMode, which are set by keights.
+	Vars map[string]string `yaml:"vars"`
+	// Volume or VolumeManifest describe the etcd volume, for roles with etcd.
+	Volume         *volumize.VolumeSpec `yaml:"volume"`
+	VolumeManifest string               `yaml:"volumeManifest"`
+	// KubeadmInitArgs are extra arguments to kubeadm init, such as --skip-phases.
+	KubeadmInitArgs []string `yaml:"kubeadmInitArgs"`
+}
+
+var roles = map[string]bool{
+	RoleEtcd:               true,
+	RoleControllerStacked:  true,
+	RoleControllerExternal: true,
+	RoleNode:               true,
+}
+
+func hasEtcd(role string) bool {
+	return role == RoleEtcd || role == RoleControllerStacked
+}
+
+// ParseConfig parses the config, setting defaults and overriding the role
+// if one is given.
+func ParseConfig(contents []byte, role string) (*Config, error) {
+	config := &Config{}
+	if err := yaml.UnmarshalStrict(contents, config); err != nil {
+		return nil, err
+	}
+	if role != "" {
+		config.Role = role
+	}
+	if !roles[config.Role] {
+		return nil, fmt.Errorf("role must be one of %s, %s, %s, %s", RoleEtcd,
+			RoleControllerStacked, RoleControllerExternal, RoleNode)
+	}
+	if config.ClusterName == "" {
+		return nil, fmt.Errorf("clusterName is required")
+	}
+	if hasEtcd(config.Role) && config.Volume == nil && config.VolumeManifest == "" {
+		return nil, fmt.Errorf("volume or volumeManifest is required for role %s", config.Role)
+	}
+	if config.Volume != nil {
+		if config.Volume.FsType == "" {
+			config.Volume.FsType = "ext4"
+		}
+		if config.Volume.MountPoint == "" {
+			config.Volume.MountPoint = "/var/lib/etcd"
+		}
+	}
+	if config.Resource == "" {
+		config.Resource = "AutoScalingGroup"
+	}
+	if config.StateDir == "" {
+		config.StateDir = DefaultStateDir
+	}
+	if config.TemplateDir == "" {
+		config.TemplateDir = DefaultTemplateDir
+	}
+	if config.Minutes == 0 {
+		config.Minutes = 60
+	}
+	if config.Attempts == 0 {
+		config.Attempts = 3
+	}
+	if config.Vars == nil {
+		config.Vars = map[string]string{}
+	}
+	return config, nil
+}
+
+func LoadConfig(path, role string) (*Config, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config, err := ParseConfig(contents, role)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid config %s: %v", path, err)
+	}
+	return config, nil
+}
@@ -0,0 +1,356 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package bootstrap
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cloudboss/keights/pkg/helpers"
+	"github.com/cloudboss/keights/pkg/logging"
+	"github.com/cloudboss/keights/pkg/readiness"
+	"github.com/cloudboss/keights/pkg/runner"
+	"github.com/cloudboss/keights/pkg/templatize"
+	"github.com/cloudboss/keights/pkg/volumize"
+	"github.com/cloudboss/keights/pkg/whisper"
+)
+
+const (
+	Kubeadm   = "kubeadm"
+	Systemctl = "systemctl"
+
+	kubeadmConfig = "/var/lib/kubeadm/config.yaml"
+	// kubeadmInitialized is the marker written by the systemd units, which
+	// is kept so the units and bootstrap can be used together.
+	kubeadmInitialized = "/var/lib/kubeadm/initialized"
+	bootstrapToken     = "/run/kubernetes/bootstrap-token"
+	nodeCACert         = "/run/kubernetes/pki/ca.crt"
+)
+
+// Phase is a step of bootstrap. Phases are run in order, and each is run
+// once unless EveryBoot is set, in which case it is run each time bootstrap
+// runs, such as for steps whose results do not survive a reboot.
+type Phase struct {
+	Name      string
+	EveryBoot bool
+	Run       func(ctx context.Context, b *Bootstrapper) error
+}
+
+// Phases returns the phases for a role, which follow the systemd units
+// used to bootstrap each role.
+func Phases(role string) ([]Phase, error) {
+	switch role {
+	case RoleEtcd:
+		return []Phase{
+			{"whisper", true, whisperSecrets},
+			{"config", false, configEtcd},
+			{"volumize", true, volumizeEtcd},
+			{"certs", false, certsEtcd},
+			{"start", false, startEtcd},
+			{"healthy", false, waitEtcd},
+			{"signal", false, signalSuccess},
+		}, nil
+	case RoleControllerStacked:
+		return []Phase{
+			{"whisper", true, whisperSecrets},
+			{"volumize", true, volumizeEtcd},
+			{"config", false, configController},
+			{"kubeadm-init", false, kubeadmInit},
+			{"healthy", false, waitAPIServer},
+			{"signal", false, signalSuccess},
+			{"kubelet", false, startKubelet},
+		}, nil
+	case RoleControllerExternal:
+		return []Phase{
+			{"whisper", true, whisperSecrets},
+			{"config", false, configController},
+			{"certs", false, certsAPIServerEtcdClient},
+			{"kubeadm-init", false, kubeadmInit},
+			{"healthy", false, waitAPIServer},
+			{"signal", false, signalSuccess},
+			{"kubelet", false, startKubelet},
+		}, nil
+	case RoleNode:
+		return []Phase{
+			{"whisper", true, whisperSecrets},
+			{"config", false, configNode},
+			{"kubeadm-join", false, kubeadmJoin},
+			{"signal", false, signalSuccess},
+			{"kubelet", false, startKubelet},
+		}, nil
+	}
+	return nil, fmt.Errorf("Unknown role %s", role)
+}
+
+var secrets = map[string]map[string]string{
+	RoleEtcd: {
+		"controller/etcd-ca.crt": "/etc/pki/etcd/ca.crt",
+		"controller/etcd-ca.key": "/etc/pki/etcd/ca.key",
+	},
+	RoleControllerStacked: {
+		"cluster/bootstrap-token":       bootstrapToken,
+		"cluster/ca.crt":                "/etc/kubernetes/pki/ca.crt",
+		"controller/ca.key":             "/etc/kubernetes/pki/ca.key",
+		"controller/front-proxy-ca.crt": "/etc/kubernetes/pki/front-proxy-ca.crt",
+		"controller/front-proxy-ca.key": "/etc/kubernetes/pki/front-proxy-ca.key",
+		"controller/etcd-ca.crt":        "/etc/kubernetes/pki/etcd/ca.crt",
+		"controller/etcd-ca.key":        "/etc/kubernetes/pki/etcd/ca.key",
+		"controller/sa.key":             "/etc/kubernetes/pki/sa.key",
+		"controller/sa.pub":             "/etc/kubernetes/pki/sa.pub",
+	},
+	RoleNode: {
+		"cluster/ca.crt":          nodeCACert,
+		"cluster/bootstrap-token": bootstrapToken,
+	},
+}
+
+func init() {
+	secrets[RoleControllerExternal] = secrets[RoleControllerStacked]
+}
+
+// Secrets returns the SSM parameters needed by a role, relative to the
+// cluster's prefix in SSM, mapped to the files they are written to.
+func Secrets(role string) map[string]string {
+	return secrets[role]
+}
+
+func whisperSecrets(ctx context.Context, b *Bootstrapper) error {
+	parameters := Secrets(b.config.Role)
+	paths := []string{}
+	for _, name := range helpers.SortMapKeys(parameters) {
+		dest := parameters[name]
+		if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+			return err
+		}
+		paths = append(paths, fmt.Sprintf("/%s/%s:%s", b.config.ClusterName, name, dest))
+	}
+	return whisper.DoIt(paths)
+}
+
+// vars returns the template variables from the config and the instance,
+// with extra variables added. As with keights template, values containing
+// commas become lists.
+func (b *Bootstrapper) vars(extra map[string]string) (map[string]interface{}, error) {
+	vars := []string{}
+	for _, name := range helpers.SortMapKeys(b.config.Vars) {
+		vars = append(vars, fmt.Sprintf("%s=%s", name, b.config.Vars[name]))
+	}
+	vars = append(vars,
+		fmt.Sprintf("MyIP=%s", b.identity.PrivateIP),
+		fmt.Sprintf("MyAZ=%s", b.identity.AvailabilityZone),
+		fmt.Sprintf("NodeName=%s", b.identity.Hostname),
+	)
+	for _, name := range helpers.SortMapKeys(extra) {
+		vars = append(vars, fmt.Sprintf("%s=%s", name, extra[name]))
+	}
+	return templatize.VarsToMap(vars)
+}
+
+func (b *Bootstrapper) render(template, dest string, mapping map[string]interface{}) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		return err
+	}
+	rendered, err := templatize.Render(filepath.Join(b.config.TemplateDir, template), mapping)
+	if err != nil {
+		return err
+	}
+	return templatize.WriteTemplate(rendered, dest, "", "", 0600)
+}
+
+func readToken() (string, error) {
+	token, err := ioutil.ReadFile(bootstrapToken)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(token)), nil
+}
+
+func configEtcd(ctx context.Context, b *Bootstrapper) error {
+	mapping, err := b.vars(nil)
+	if err != nil {
+		return err
+	}
+	if err = b.render("etcd-env.template", "/etc/default/etcd", mapping); err != nil {
+		return err
+	}
+	return b.render("kubeadm-etcd-config.yaml.template", kubeadmConfig, mapping)
+}
+
+func configController(ctx context.Context, b *Bootstrapper) error {
+	token, err := readToken()
+	if err != nil {
+		return err
+	}
+	etcdMode := "stacked"
+	if b.config.Role == RoleControllerExternal {
+		etcdMode = "external"
+	}
+	mapping, err := b.vars(map[string]string{"Token": token, "EtcdMode": etcdMode})
+	if err != nil {
+		return err
+	}
+	return b.render("kubeadm-init-config.yaml.template", kubeadmConfig, mapping)
+}
+
+// CACertHash returns the hash of the CA certificate's public key, in the
+// form used for kubeadm join discovery without the sha256: prefix.
+func CACertHash(caCertPEM []byte) (string, error) {
+	block, _ := pem.Decode(caCertPEM)
+	if block == nil {
+		return "", fmt.Errorf("could not decode CA certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func configNode(ctx context.Context, b *Bootstrapper) error {
+	token, err := readToken()
+	if err != nil {
+		return err
+	}
+	caCert, err := ioutil.ReadFile(nodeCACert)
+	if err != nil {
+		return err
+	}
+	hash, err := CACertHash(caCert)
+	if err != nil {
+		return err
+	}
+	mapping, err := b.vars(map[string]string{"Token": token, "CACertHash": hash})
+	if err != nil {
+		return err
+	}
+	return b.render("kubeadm-join-config.yaml.template", kubeadmConfig, mapping)
+}
+
+func volumizeEtcd(ctx context.Context, b *Bootstrapper) error {
+	if b.config.VolumeManifest != "" {
+		return volumize.DoManifest(ctx, b.config.VolumeManifest, b.config.ClusterName, b.config.Minutes)
+	}
+	spec := *b.config.Volume
+	return volumize.DoIt(ctx, &spec, b.config.ClusterName, b.config.Minutes)
+}
+
+func (b *Bootstrapper) run(ctx context.Context, name string, args ...string) error {
+	logger := b.logger.With("command", name)
+	_, err := runner.Run(ctx, Runner, &runner.Command{
+		Name:   name,
+		Args:   args,
+		Output: logger.Writer(logging.LevelInfo),
+	})
+	return err
+}
+
+func markInitialized() error {
+	return helpers.WriteIfChanged(kubeadmInitialized, []byte{}, 0644)
+}
+
+func certsEtcd(ctx context.Context, b *Bootstrapper) error {
+	for _, cert := range []string{"etcd-server", "etcd-peer", "etcd-healthcheck-client"} {
+		err := b.run(ctx, Kubeadm, "init", "phase", "certs", cert, "--config="+kubeadmConfig)
+		if err != nil {
+			return err
+		}
+	}
+	return markInitialized()
+}
+
+// startEtcd starts etcd.service, whose dependencies on the units that
+// bootstrap replaces are skipped, as the units have a condition on the
+// bootstrap config not existing.
+func startEtcd(ctx context.Context, b *Bootstrapper) error {
+	return b.run(ctx, Systemctl, "start", "etcd.service")
+}
+
+func certsAPIServerEtcdClient(ctx context.Context, b *Bootstrapper) error {
+	return b.run(ctx, Kubeadm, "init", "phase", "certs", "apiserver-etcd-client",
+		"--config="+kubeadmConfig)
+}
+
+func kubeadmInit(ctx context.Context, b *Bootstrapper) error {
+	args := []string{
+		"init",
+		"--config=" + kubeadmConfig,
+		"--ignore-preflight-errors=all",
+		"--skip-token-print",
+	}
+	if err := b.run(ctx, Kubeadm, append(args, b.config.KubeadmInitArgs...)...); err != nil {
+		// Running kubeadm init again requires kubeadm reset, which would
+		// remove the CA written by whisper and the data on the etcd volume.
+		return helpers.Permanent(err)
+	}
+	return markInitialized()
+}
+
+func kubeadmJoin(ctx context.Context, b *Bootstrapper) error {
+	err := b.run(ctx, Kubeadm, "join", "--config="+kubeadmConfig, "--ignore-preflight-errors=all")
+	if err != nil {
+		// Undo a partial join so that the next attempt starts clean.
+		if resetErr := b.run(ctx, Kubeadm, "reset", "--force"); resetErr != nil {
+			b.logger.Warn("Unable to reset after failed join", "error", resetErr)
+		}
+		return err
+	}
+	return markInitialized()
+}
+
+func (b *Bootstrapper) waitHealthy(ctx context.Context, gates *readiness.Gates) error {
+	return helpers.WaitFor(ctx, time.Duration(b.config.Minutes)*time.Minute, gates.Ready)
+}
+
+func waitEtcd(ctx context.Context, b *Bootstrapper) error {
+	return b.waitHealthy(ctx, &readiness.Gates{
+		URLs:   []string{fmt.Sprintf("https://%s:2379/health", b.identity.PrivateIP)},
+		CACert: "/etc/pki/etcd/ca.crt",
+		Cert:   "/etc/pki/etcd/healthcheck-client.crt",
+		Key:    "/etc/pki/etcd/healthcheck-client.key",
+	})
+}
+
+func waitAPIServer(ctx context.Context, b *Bootstrapper) error {
+	return b.waitHealthy(ctx, &readiness.Gates{
+		URLs:   []string{fmt.Sprintf("https://%s:6443/healthz", b.identity.PrivateIP)},
+		CACert: "/etc/kubernetes/pki/ca.crt",
+	})
+}
+
+func signalSuccess(ctx context.Context, b *Bootstrapper) error {
+	return b.signal(StatusSuccess, b.identity.InstanceID)
+}
+
+// startKubelet enables kubelet.service so that it starts on later boots,
+// which kubeadm does not do, and starts it if kubeadm has not.
+func startKubelet(ctx context.Context, b *Bootstrapper) error {
+	return b.run(ctx, Systemctl, "enable", "--now", "kubelet.service")
+}
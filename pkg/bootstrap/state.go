@@ -0,0 +1,88 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package bootstrap
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cloudboss/keights/pkg/helpers"
+)
+
+const failedFile = "failed"
+
+// State records completed phases as files in a directory, so that bootstrap
+// resumes after the last completed phase when it runs again.
+type State struct {
+	Dir string
+	now func() time.Time
+}
+
+func NewState(dir string) (*State, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &State{Dir: dir, now: time.Now}, nil
+}
+
+func (s *State) path(phase string) string {
+	return filepath.Join(s.Dir, phase)
+}
+
+func (s *State) Done(phase string) bool {
+	_, err := os.Stat(s.path(phase))
+	return err == nil
+}
+
+// Complete records phase as done and clears any failure.
+func (s *State) Complete(phase string) error {
+	timestamp := s.now().UTC().Format(time.RFC3339) + "\n"
+	if err := helpers.AtomicWrite(s.path(phase), []byte(timestamp), 0600); err != nil {
+		return err
+	}
+	err := os.Remove(s.path(failedFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Fail records the phase that failed and why.
+func (s *State) Fail(phase string, cause error) error {
+	contents := fmt.Sprintf("%s\n%s\n", phase, cause)
+	return helpers.AtomicWrite(s.path(failedFile), []byte(contents), 0600)
+}
+
+// Failed returns the phase recorded by Fail, if any.
+func (s *State) Failed() (string, error) {
+	contents, err := ioutil.ReadFile(s.path(failedFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return strings.SplitN(string(contents), "\n", 2)[0], nil
+}
@@ -0,0 +1,404 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package config sets command flags from the environment and a config file,
+// so that a node's settings can be written once instead of in separate
+// environment files for each systemd unit. A flag given on the command line
+// takes precedence over the environment, which takes precedence over the
+// file.
+//
+// A flag such as --clusterName is read from KEIGHTS_VOLUMIZE_CLUSTER_NAME
+// for the volumize command. Persistent flags of the root command, such as
+// --log-level, apply to every command, and are also read from names
+// without the command, such as KEIGHTS_LOG_LEVEL. In the file, top level
+// keys are the root command's persistent flags, and keys that name a
+// command, such as "volumize" or "leader run", hold the flags for that
+// command:
+//
+//	log-level: debug
+//	volumize:
+//	  clusterName: kate
+//	  mount-point: /var/lib/etcd
+//	template:
+//	  var:
+//	    APIServer: kate.example.com
+//	    APIServerPort: 443
+//
+// A command's own flags are never read from top level keys or from names
+// without the command, so that a setting for one command, such as output
+// for config show, does not set a flag of the same name on another.
+//
+// Lists set a flag once for each item, and maps set it once for each
+// key=value pair.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"unicode"
+
+	"github.com/cloudboss/keights/pkg/logging"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	DefaultFile = "/etc/keights/config.yaml"
+	// FileFlag is the flag that names the config file. It is read from the
+	// command line or environment only.
+	FileFlag = "config-file"
+
+	SourceFlag    = "flag"
+	SourceEnv     = "env"
+	SourceFile    = "file"
+	SourceDefault = "default"
+
+	FormatText = "text"
+	FormatJSON = "json"
+
+	envPrefix = "KEIGHTS"
+	// sourceAnnotation records where a flag's value came from, so that
+	// flags shared by commands are not bound twice.
+	sourceAnnotation = "keights-config-source"
+)
+
+// Setting is the effective value of a flag and where it came from. From
+// is the environment variable or file key.
+type Setting struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+	From   string `json:"from,omitempty"`
+}
+
+type File struct {
+	Path   string
+	values map[string]interface{}
+}
+
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		normalized := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			normalized[fmt.Sprint(key)] = normalize(val)
+		}
+		return normalized
+	case []interface{}:
+		normalized := make([]interface{}, len(v))
+		for i, val := range v {
+			normalized[i] = normalize(val)
+		}
+		return normalized
+	}
+	return value
+}
+
+func ParseFile(path string, contents []byte) (*File, error) {
+	values := map[interface{}]interface{}{}
+	if err := yaml.Unmarshal(contents, &values); err != nil {
+		return nil, fmt.Errorf("Invalid config file %s: %v", path, err)
+	}
+	return &File{Path: path, values: normalize(values).(map[string]interface{})}, nil
+}
+
+// Load reads the config file at path. A missing file is treated as empty
+// unless it is required, as when it is named explicitly.
+func Load(path string, required bool) (*File, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && !required {
+			return &File{Path: path, values: map[string]interface{}{}}, nil
+		}
+		return nil, err
+	}
+	return ParseFile(path, contents)
+}
+
+// lookup returns the value for flag name, from the section for the
+// command path if present, otherwise from the top level if the flag is
+// global.
+func (f *File) lookup(path []string, name string, global bool,
+	sections map[string]bool) (interface{}, string, bool) {
+	if len(path) > 0 {
+		section := strings.Join(path, " ")
+		if values, ok := f.values[section].(map[string]interface{}); ok {
+			if value, ok := values[name]; ok {
+				return value, fmt.Sprintf("%s.%s", section, name), true
+			}
+		}
+	}
+	if !global {
+		return nil, "", false
+	}
+	if value, ok := f.values[name]; ok && !sections[name] {
+		return value, name, true
+	}
+	return nil, "", false
+}
+
+// EnvName returns the environment variable for a flag, such as
+// KEIGHTS_LEADER_RUN_CLUSTER_NAME for "leader", "run", "clusterName".
+func EnvName(parts ...string) string {
+	var b strings.Builder
+	b.WriteString(envPrefix)
+	for _, part := range parts {
+		b.WriteRune('_')
+		var previous rune
+		for _, r := range part {
+			switch {
+			case r == '-' || r == ' ':
+				b.WriteRune('_')
+			case unicode.IsUpper(r) && (unicode.IsLower(previous) || unicode.IsDigit(previous)):
+				b.WriteRune('_')
+				b.WriteRune(r)
+			default:
+				b.WriteRune(unicode.ToUpper(r))
+			}
+			previous = r
+		}
+	}
+	return b.String()
+}
+
+// flagValues returns the values to set on a flag from a value in the file.
+func flagValues(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case []interface{}:
+		values := []string{}
+		for _, item := range v {
+			itemValues, err := flagValues(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, itemValues...)
+		}
+		return values, nil
+	case map[string]interface{}:
+		keys := []string{}
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		values := []string{}
+		for _, key := range keys {
+			if _, ok := v[key].(map[string]interface{}); ok {
+				return nil, fmt.Errorf("nested map under %s is not supported", key)
+			}
+			values = append(values, fmt.Sprintf("%s=%v", key, v[key]))
+		}
+		return values, nil
+	case nil:
+		return []string{}, nil
+	}
+	return []string{fmt.Sprint(value)}, nil
+}
+
+func commandPath(cmd *cobra.Command) []string {
+	return strings.Fields(cmd.CommandPath())[1:]
+}
+
+// sections returns the paths of all commands, which are the keys of
+// sections in the file rather than flags.
+func sections(root *cobra.Command) map[string]bool {
+	paths := map[string]bool{}
+	var walk func(cmd *cobra.Command)
+	walk = func(cmd *cobra.Command) {
+		for _, sub := range cmd.Commands() {
+			paths[strings.Join(commandPath(sub), " ")] = true
+			walk(sub)
+		}
+	}
+	walk(root)
+	return paths
+}
+
+func source(flag *pflag.Flag) (Setting, bool) {
+	annotation, ok := flag.Annotations[sourceAnnotation]
+	if !ok {
+		return Setting{}, false
+	}
+	return Setting{Name: flag.Name, Source: annotation[0], From: annotation[1]}, true
+}
+
+func setSource(flag *pflag.Flag, source, from string) {
+	if flag.Annotations == nil {
+		flag.Annotations = map[string][]string{}
+	}
+	flag.Annotations[sourceAnnotation] = []string{source, from}
+}
+
+func set(flags *pflag.FlagSet, flag *pflag.Flag, values []string, source, from string) error {
+	for _, value := range values {
+		if err := flags.Set(flag.Name, value); err != nil {
+			return fmt.Errorf("Invalid value from %s %s: %v", source, from, err)
+		}
+	}
+	setSource(flag, source, from)
+	return nil
+}
+
+// envNames returns the environment variables for a flag of the command at
+// path, where only a global flag may be set without naming the command.
+func envNames(path []string, name string, global bool) []string {
+	if len(path) == 0 {
+		return []string{EnvName(name)}
+	}
+	if !global {
+		return []string{EnvName(append(path, name)...)}
+	}
+	return []string{EnvName(append(path, name)...), EnvName(name)}
+}
+
+// bind sets flag from the environment or file if it was not given on the
+// command line. A global flag is a persistent flag of the root command.
+func bind(flags *pflag.FlagSet, flag *pflag.Flag, path []string, global bool, file *File,
+	sections map[string]bool, lookupEnv func(string) (string, bool)) error {
+	if _, ok := source(flag); ok {
+		return nil
+	}
+	if flag.Changed {
+		setSource(flag, SourceFlag, "")
+		return nil
+	}
+	for _, name := range envNames(path, flag.Name, global) {
+		if value, ok := lookupEnv(name); ok {
+			return set(flags, flag, []string{value}, SourceEnv, name)
+		}
+	}
+	if file != nil {
+		if value, key, ok := file.lookup(path, flag.Name, global, sections); ok {
+			values, err := flagValues(value)
+			if err != nil {
+				return fmt.Errorf("Invalid value for %s in %s: %v", key, file.Path, err)
+			}
+			return set(flags, flag, values, SourceFile, key)
+		}
+	}
+	setSource(flag, SourceDefault, "")
+	return nil
+}
+
+// Apply sets the flags of cmd that were not given on the command line from
+// the environment or the config file, and returns the effective settings.
+func Apply(cmd *cobra.Command, lookupEnv func(string) (string, bool)) ([]Setting, error) {
+	// Getting the inherited flags merges them into the command's flags,
+	// which cobra otherwise does only when the command is run.
+	cmd.InheritedFlags()
+	flags := cmd.Flags()
+	path := commandPath(cmd)
+	global := cmd.Root().PersistentFlags()
+	var file *File
+	if fileFlag := flags.Lookup(FileFlag); fileFlag != nil {
+		if err := bind(flags, fileFlag, path, true, nil, nil, lookupEnv); err != nil {
+			return nil, err
+		}
+		setting, _ := source(fileFlag)
+		var err error
+		file, err = Load(fileFlag.Value.String(), setting.Source != SourceDefault)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sections := sections(cmd.Root())
+	settings := []Setting{}
+	var err error
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if err != nil || flag.Name == "help" {
+			return
+		}
+		isGlobal := global.Lookup(flag.Name) != nil
+		if err = bind(flags, flag, path, isGlobal, file, sections, lookupEnv); err != nil {
+			return
+		}
+		setting, _ := source(flag)
+		setting.Value = flag.Value.String()
+		settings = append(settings, setting)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// redact hides the values of sensitive flags, and of sensitive key=value
+// pairs, such as template variables.
+func redact(setting Setting) Setting {
+	if logging.Sensitive(setting.Name) {
+		setting.Value = logging.Redacted
+		return setting
+	}
+	items := strings.Split(strings.Trim(setting.Value, "[]"), ",")
+	for _, item := range items {
+		if parts := strings.SplitN(item, "=", 2); len(parts) == 2 && logging.Sensitive(parts[0]) {
+			setting.Value = logging.Redacted
+			return setting
+		}
+	}
+	return setting
+}
+
+// Write writes the settings to out as a table or JSON, with sensitive
+// values redacted.
+func Write(out io.Writer, settings []Setting, format string) error {
+	redacted := make([]Setting, len(settings))
+	for i, setting := range settings {
+		redacted[i] = redact(setting)
+	}
+	switch format {
+	case FormatJSON:
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(redacted)
+	case FormatText:
+		tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "FLAG\tVALUE\tSOURCE\tFROM")
+		for _, setting := range redacted {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", setting.Name, setting.Value,
+				setting.Source, setting.From)
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("Unknown format %s, expected one of %s, %s", format, FormatText, FormatJSON)
+}
+
+// DoShow writes the effective settings for the command at path, or for
+// the root command if path is empty.
+func DoShow(out io.Writer, root *cobra.Command, path []string, format string) error {
+	cmd, args, err := root.Find(path)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		return fmt.Errorf("Unknown command %q", strings.Join(path, " "))
+	}
+	settings, err := Apply(cmd, os.LookupEnv)
+	if err != nil {
+		return err
+	}
+	return Write(out, settings, format)
+}
@@ -0,0 +1,320 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvName(t *testing.T) {
+	testCases := []struct {
+		parts []string
+		name  string
+	}{
+		{[]string{"clusterName"}, "KEIGHTS_CLUSTER_NAME"},
+		{[]string{"log-level"}, "KEIGHTS_LOG_LEVEL"},
+		{[]string{"volumize", "mount-point"}, "KEIGHTS_VOLUMIZE_MOUNT_POINT"},
+		{[]string{"leader", "run", "clusterName"}, "KEIGHTS_LEADER_RUN_CLUSTER_NAME"},
+		{[]string{"ec2Tags"}, "KEIGHTS_EC2_TAGS"},
+		{[]string{"kms-key-id"}, "KEIGHTS_KMS_KEY_ID"},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.name, EnvName(tc.parts...))
+	}
+}
+
+func TestFlagValues(t *testing.T) {
+	testCases := []struct {
+		name   string
+		value  interface{}
+		values []string
+		err    string
+	}{
+		{"string", "kate", []string{"kate"}, ""},
+		{"int", 60, []string{"60"}, ""},
+		{"bool", true, []string{"true"}, ""},
+		{"null", nil, []string{}, ""},
+		{"list", []interface{}{"a", 1}, []string{"a", "1"}, ""},
+		{
+			"map",
+			map[string]interface{}{"Port": 443, "APIServer": "kate.example.com"},
+			[]string{"APIServer=kate.example.com", "Port=443"},
+			"",
+		},
+		{
+			"nested map",
+			map[string]interface{}{"a": map[string]interface{}{"b": "c"}},
+			nil,
+			"nested map under a is not supported",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			values, err := flagValues(tc.value)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.values, values)
+		})
+	}
+}
+
+type testCommands struct {
+	root        *cobra.Command
+	run         *cobra.Command
+	show        *cobra.Command
+	logLevel    string
+	clusterName string
+	minutes     int
+	vars        []string
+	output      string
+}
+
+func newTestCommands(configFile string) *testCommands {
+	tc := &testCommands{}
+	noop := func(cmd *cobra.Command, args []string) error { return nil }
+	tc.root = &cobra.Command{Use: "keights"}
+	leader := &cobra.Command{Use: "leader"}
+	tc.run = &cobra.Command{Use: "run", RunE: noop}
+	config := &cobra.Command{Use: "config"}
+	tc.show = &cobra.Command{Use: "show", RunE: noop}
+	tc.root.AddCommand(leader, config)
+	leader.AddCommand(tc.run)
+	config.AddCommand(tc.show)
+	tc.root.PersistentFlags().String(FileFlag, configFile, "")
+	tc.root.PersistentFlags().StringVarP(&tc.logLevel, "log-level", "l", "info", "")
+	tc.run.Flags().StringVarP(&tc.clusterName, "clusterName", "c", "", "")
+	tc.run.Flags().IntVarP(&tc.minutes, "minutes", "m", 60, "")
+	tc.run.Flags().StringArrayVarP(&tc.vars, "var", "v", nil, "")
+	tc.show.Flags().StringVarP(&tc.output, "output", "o", FormatText, "")
+	return tc
+}
+
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := vars[name]
+		return value, ok
+	}
+}
+
+func TestApply(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	contents := []byte(`
+clusterName: kate
+log-level: debug
+minutes: 10
+leader run:
+  clusterName: lena
+  minutes: 20
+  var:
+    b: 2
+    a: 1
+`)
+	assert.NoError(t, ioutil.WriteFile(configFile, contents, 0644))
+
+	testCases := []struct {
+		name        string
+		args        []string
+		env         map[string]string
+		logLevel    string
+		clusterName string
+		minutes     int
+		vars        []string
+		settings    []Setting
+		err         string
+	}{
+		{
+			name:        "file with command section",
+			logLevel:    "debug",
+			clusterName: "lena",
+			minutes:     20,
+			vars:        []string{"a=1", "b=2"},
+			settings: []Setting{
+				{"clusterName", "lena", SourceFile, "leader run.clusterName"},
+				{FileFlag, configFile, SourceDefault, ""},
+				{"log-level", "debug", SourceFile, "log-level"},
+				{"minutes", "20", SourceFile, "leader run.minutes"},
+				{"var", "[a=1,b=2]", SourceFile, "leader run.var"},
+			},
+		},
+		{
+			name: "environment over file",
+			env: map[string]string{
+				"KEIGHTS_LEADER_RUN_CLUSTER_NAME": "ruth",
+				"KEIGHTS_LEADER_RUN_MINUTES":      "30",
+				"KEIGHTS_LOG_LEVEL":               "warn",
+			},
+			logLevel:    "warn",
+			clusterName: "ruth",
+			minutes:     30,
+			vars:        []string{"a=1", "b=2"},
+			settings: []Setting{
+				{"clusterName", "ruth", SourceEnv, "KEIGHTS_LEADER_RUN_CLUSTER_NAME"},
+				{FileFlag, configFile, SourceDefault, ""},
+				{"log-level", "warn", SourceEnv, "KEIGHTS_LOG_LEVEL"},
+				{"minutes", "30", SourceEnv, "KEIGHTS_LEADER_RUN_MINUTES"},
+				{"var", "[a=1,b=2]", SourceFile, "leader run.var"},
+			},
+		},
+		{
+			name:        "command flags not set without command",
+			env:         map[string]string{"KEIGHTS_CLUSTER_NAME": "ruth", "KEIGHTS_MINUTES": "30"},
+			logLevel:    "debug",
+			clusterName: "lena",
+			minutes:     20,
+			vars:        []string{"a=1", "b=2"},
+			settings: []Setting{
+				{"clusterName", "lena", SourceFile, "leader run.clusterName"},
+				{FileFlag, configFile, SourceDefault, ""},
+				{"log-level", "debug", SourceFile, "log-level"},
+				{"minutes", "20", SourceFile, "leader run.minutes"},
+				{"var", "[a=1,b=2]", SourceFile, "leader run.var"},
+			},
+		},
+		{
+			name:        "flag over environment",
+			args:        []string{"-c", "mary", "-v", "c=3", "-l", "error"},
+			env:         map[string]string{"KEIGHTS_LEADER_RUN_CLUSTER_NAME": "ruth", "KEIGHTS_LOG_LEVEL": "warn"},
+			logLevel:    "error",
+			clusterName: "mary",
+			minutes:     20,
+			vars:        []string{"c=3"},
+			settings: []Setting{
+				{"clusterName", "mary", SourceFlag, ""},
+				{FileFlag, configFile, SourceDefault, ""},
+				{"log-level", "error", SourceFlag, ""},
+				{"minutes", "20", SourceFile, "leader run.minutes"},
+				{"var", "[c=3]", SourceFlag, ""},
+			},
+		},
+		{
+			name: "invalid value",
+			env:  map[string]string{"KEIGHTS_LEADER_RUN_MINUTES": "soon"},
+			err: `Invalid value from env KEIGHTS_LEADER_RUN_MINUTES: invalid argument "soon" for ` +
+				`"-m, --minutes" flag: strconv.ParseInt: parsing "soon": invalid syntax`,
+		},
+		{
+			name: "missing file named in environment",
+			env:  map[string]string{"KEIGHTS_CONFIG_FILE": "/nonexistent/config.yaml"},
+			err:  "open /nonexistent/config.yaml: no such file or directory",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cmds := newTestCommands(configFile)
+			var settings []Setting
+			var err error
+			cmds.root.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+				settings, err = Apply(cmd, env(tc.env))
+				return err
+			}
+			cmds.root.SetArgs(append([]string{"leader", "run"}, tc.args...))
+			cmds.root.SilenceUsage = true
+			cmds.root.SilenceErrors = true
+			cmds.root.Execute()
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.logLevel, cmds.logLevel)
+			assert.Equal(t, tc.clusterName, cmds.clusterName)
+			assert.Equal(t, tc.minutes, cmds.minutes)
+			assert.Equal(t, tc.vars, cmds.vars)
+			assert.Equal(t, tc.settings, settings)
+		})
+	}
+}
+
+func TestApplyMissingDefaultFile(t *testing.T) {
+	cmds := newTestCommands(filepath.Join(t.TempDir(), "config.yaml"))
+	settings, err := Apply(cmds.run, env(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, 60, cmds.minutes)
+	assert.Len(t, settings, 5)
+}
+
+func TestApplyTopLevelKeys(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, ioutil.WriteFile(configFile, []byte("output: json\nlog-level: debug\n"), 0644))
+
+	testCases := []struct {
+		name     string
+		env      map[string]string
+		output   string
+		logLevel string
+	}{
+		{
+			name:     "top level key sets only global flags",
+			output:   FormatText,
+			logLevel: "debug",
+		},
+		{
+			name:     "environment without command sets only global flags",
+			env:      map[string]string{"KEIGHTS_OUTPUT": FormatJSON, "KEIGHTS_LOG_LEVEL": "warn"},
+			output:   FormatText,
+			logLevel: "warn",
+		},
+		{
+			name:     "environment with command",
+			env:      map[string]string{"KEIGHTS_CONFIG_SHOW_OUTPUT": FormatJSON},
+			output:   FormatJSON,
+			logLevel: "debug",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cmds := newTestCommands(configFile)
+			_, err := Apply(cmds.show, env(tc.env))
+			assert.NoError(t, err)
+			assert.Equal(t, tc.output, cmds.output)
+			assert.Equal(t, tc.logLevel, cmds.logLevel)
+		})
+	}
+}
+
+func TestWrite(t *testing.T) {
+	settings := []Setting{
+		{"clusterName", "kate", SourceFile, "clusterName"},
+		{"token", "abc.def", SourceEnv, "KEIGHTS_TOKEN"},
+		{"var", "[APIServer=kate.example.com,Token=abc.def]", SourceFile, "template.var"},
+	}
+	var out bytes.Buffer
+	assert.NoError(t, Write(&out, settings, FormatText))
+	assert.Equal(t, ""+
+		"FLAG         VALUE       SOURCE  FROM\n"+
+		"clusterName  kate        file    clusterName\n"+
+		"token        [REDACTED]  env     KEIGHTS_TOKEN\n"+
+		"var          [REDACTED]  file    template.var\n", out.String())
+
+	out.Reset()
+	assert.NoError(t, Write(&out, settings[:1], FormatJSON))
+	assert.JSONEq(t, `[{"name": "clusterName", "value": "kate", "source": "file", "from": "clusterName"}]`,
+		out.String())
+}
@@ -0,0 +1,348 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package doctor checks the state of a node, to find why it has not come
+// up without checking everything by hand.
+package doctor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/cloudboss/keights/pkg/bootstrap"
+	"github.com/cloudboss/keights/pkg/helpers"
+	"github.com/cloudboss/keights/pkg/metadata"
+	"github.com/cloudboss/keights/pkg/readiness"
+	"github.com/cloudboss/keights/pkg/runner"
+	"github.com/cloudboss/keights/pkg/volumize"
+)
+
+const (
+	StatusPass = "pass"
+	StatusFail = "fail"
+	StatusSkip = "skip"
+
+	FormatText = "text"
+	FormatJSON = "json"
+
+	DefaultMountPoint = "/var/lib/etcd"
+)
+
+var (
+	Runner runner.Runner = &runner.Exec{}
+	// HealthTimeout limits each health endpoint check.
+	HealthTimeout = 10 * time.Second
+)
+
+type Result struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type Report struct {
+	OK      bool     `json:"ok"`
+	Results []Result `json:"results"`
+}
+
+// Failed returns the number of checks that failed.
+func (r *Report) Failed() int {
+	failed := 0
+	for _, result := range r.Results {
+		if result.Status == StatusFail {
+			failed++
+		}
+	}
+	return failed
+}
+
+func (r *Report) Write(w io.Writer, format string) error {
+	switch format {
+	case FormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(r)
+	case FormatText:
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		for _, result := range r.Results {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", strings.ToUpper(result.Status),
+				result.Name, result.Detail)
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("Unknown format %s, expected one of %s, %s", format, FormatText, FormatJSON)
+}
+
+type skipError struct {
+	reason string
+}
+
+func (e *skipError) Error() string {
+	return e.reason
+}
+
+func skip(format string, args ...interface{}) error {
+	return &skipError{fmt.Sprintf(format, args...)}
+}
+
+// Check returns a detail on success, or an error on failure. A check
+// that does not apply returns an error from skip.
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) (string, error)
+}
+
+func run(ctx context.Context, check Check) Result {
+	detail, err := check.Run(ctx)
+	var skipped *skipError
+	switch {
+	case errors.As(err, &skipped):
+		return Result{Name: check.Name, Status: StatusSkip, Detail: skipped.reason}
+	case err != nil:
+		return Result{Name: check.Name, Status: StatusFail, Detail: err.Error()}
+	}
+	return Result{Name: check.Name, Status: StatusPass, Detail: detail}
+}
+
+type Doctor struct {
+	Role        string
+	ClusterName string
+	// MountPoint is where the etcd volume is mounted, for roles with etcd.
+	MountPoint string
+
+	identity  *metadata.Identity
+	ssmClient ssmiface.SSMAPI
+	stsClient stsiface.STSAPI
+	now       func() time.Time
+}
+
+func (d *Doctor) Checks() []Check {
+	checks := []Check{
+		{"imds", d.checkIMDS},
+		{"identity", d.checkIdentity},
+		{"credentials", d.checkCredentials},
+	}
+	parameters := bootstrap.Secrets(d.Role)
+	for _, name := range helpers.SortMapKeys(parameters) {
+		path := fmt.Sprintf("/%s/%s", d.ClusterName, name)
+		checks = append(checks, Check{"ssm " + path, d.parameterCheck(path)})
+	}
+	for _, pair := range pairs[d.Role] {
+		checks = append(checks, Check{"pki " + pair.name(), d.pairCheck(pair)})
+	}
+	switch d.Role {
+	case bootstrap.RoleEtcd:
+		checks = append(checks, Check{"etcd health", d.healthCheck(etcdGates("/etc/pki/etcd"))})
+	case bootstrap.RoleControllerStacked:
+		checks = append(checks,
+			Check{"etcd health", d.healthCheck(etcdGates("/etc/kubernetes/pki/etcd"))},
+			Check{"apiserver health", d.healthCheck(apiServerGates)},
+		)
+	case bootstrap.RoleControllerExternal:
+		checks = append(checks, Check{"apiserver health", d.healthCheck(apiServerGates)})
+	}
+	if d.MountPoint != "" {
+		checks = append(checks, Check{"volume " + d.MountPoint, d.checkVolume})
+	}
+	for _, unit := range units[d.Role] {
+		checks = append(checks, Check{"unit " + unit.Name, unitCheck(unit)})
+	}
+	return checks
+}
+
+// Run runs every check in order, and never stops early, so that the report
+// shows all problems at once.
+func (d *Doctor) Run(ctx context.Context) *Report {
+	report := &Report{Results: []Result{}}
+	for _, check := range d.Checks() {
+		report.Results = append(report.Results, run(ctx, check))
+	}
+	report.OK = report.Failed() == 0
+	return report
+}
+
+func (d *Doctor) checkIMDS(ctx context.Context) (string, error) {
+	if _, ok := metadata.Current().(*metadata.IMDS); !ok {
+		return "", skip("metadata is not from the instance metadata service")
+	}
+	client := ec2metadata.New(session.New())
+	if !client.AvailableWithContext(ctx) {
+		return "", fmt.Errorf("instance metadata service is not reachable")
+	}
+	return "reachable", nil
+}
+
+func (d *Doctor) checkIdentity(ctx context.Context) (string, error) {
+	if d.identity == nil {
+		identity, err := metadata.Get()
+		if err != nil {
+			return "", err
+		}
+		d.identity = identity
+	}
+	return fmt.Sprintf("instance %s in %s, ip %s", d.identity.InstanceID,
+		d.identity.AvailabilityZone, d.identity.PrivateIP), nil
+}
+
+func (d *Doctor) session() (*session.Session, error) {
+	if d.identity == nil {
+		return nil, skip("instance identity is unknown")
+	}
+	return session.NewSession(&aws.Config{Region: aws.String(d.identity.Region)})
+}
+
+func (d *Doctor) checkCredentials(ctx context.Context) (string, error) {
+	if d.stsClient == nil {
+		sess, err := d.session()
+		if err != nil {
+			return "", err
+		}
+		d.stsClient = sts.New(sess)
+	}
+	output, err := d.stsClient.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s in %s", aws.StringValue(output.Arn), d.identity.Region), nil
+}
+
+func (d *Doctor) parameterCheck(path string) func(ctx context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		if d.ssmClient == nil {
+			sess, err := d.session()
+			if err != nil {
+				return "", err
+			}
+			d.ssmClient = ssm.New(sess)
+		}
+		// GetParameters is used as by whisper, since instance roles are not
+		// allowed GetParameter.
+		output, err := d.ssmClient.GetParametersWithContext(ctx, &ssm.GetParametersInput{
+			Names:          []*string{aws.String(path)},
+			WithDecryption: aws.Bool(true),
+		})
+		if err != nil {
+			return "", err
+		}
+		if len(output.Parameters) == 0 {
+			return "", fmt.Errorf("parameter not found")
+		}
+		parameter := output.Parameters[0]
+		return fmt.Sprintf("decrypted %s, version %d", aws.StringValue(parameter.Type),
+			aws.Int64Value(parameter.Version)), nil
+	}
+}
+
+func (d *Doctor) healthCheck(gates func(ip string) *readiness.Gates) func(ctx context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		if d.identity == nil {
+			return "", skip("instance identity is unknown")
+		}
+		g := gates(d.identity.PrivateIP)
+		ctx, cancel := context.WithTimeout(ctx, HealthTimeout)
+		defer cancel()
+		if err := helpers.WaitFor(ctx, HealthTimeout, g.Ready); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s is healthy", g.URLs[0]), nil
+	}
+}
+
+func etcdGates(pkiDir string) func(ip string) *readiness.Gates {
+	return func(ip string) *readiness.Gates {
+		return &readiness.Gates{
+			URLs:   []string{fmt.Sprintf("https://%s:2379/health", ip)},
+			CACert: pkiDir + "/ca.crt",
+			Cert:   pkiDir + "/healthcheck-client.crt",
+			Key:    pkiDir + "/healthcheck-client.key",
+		}
+	}
+}
+
+func apiServerGates(ip string) *readiness.Gates {
+	return &readiness.Gates{
+		URLs:   []string{fmt.Sprintf("https://%s:6443/healthz", ip)},
+		CACert: "/etc/kubernetes/pki/ca.crt",
+	}
+}
+
+func (d *Doctor) checkVolume(ctx context.Context) (string, error) {
+	mounted, err := volumize.IsMounted(d.MountPoint)
+	if err != nil {
+		return "", err
+	}
+	if !mounted {
+		return "", fmt.Errorf("nothing is mounted on %s", d.MountPoint)
+	}
+	return "mounted", nil
+}
+
+// DoIt writes a report of the checks for role to out, and returns an error
+// if any failed. The role, cluster name, and etcd mount point default to
+// those in the bootstrap config, if not given.
+func DoIt(ctx context.Context, out io.Writer, configPath, role, clusterName, mountPoint,
+	format string) error {
+	if role == "" || clusterName == "" {
+		config, err := bootstrap.LoadConfig(configPath, role)
+		if err != nil {
+			return fmt.Errorf("Unable to determine role and cluster name: %w", err)
+		}
+		role = config.Role
+		if clusterName == "" {
+			clusterName = config.ClusterName
+		}
+		if mountPoint == "" && config.Volume != nil {
+			mountPoint = config.Volume.MountPoint
+		}
+	}
+	if mountPoint == "" && (role == bootstrap.RoleEtcd || role == bootstrap.RoleControllerStacked) {
+		mountPoint = DefaultMountPoint
+	}
+	if _, ok := units[role]; !ok {
+		return fmt.Errorf("Unknown role %s", role)
+	}
+	doctor := &Doctor{
+		Role:        role,
+		ClusterName: clusterName,
+		MountPoint:  mountPoint,
+		now:         time.Now,
+	}
+	report := doctor.Run(ctx)
+	if err := report.Write(out, format); err != nil {
+		return err
+	}
+	if !report.OK {
+		return fmt.Errorf("%d of %d checks failed", report.Failed(), len(report.Results))
+	}
+	return nil
+}
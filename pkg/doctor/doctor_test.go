@@ -0,0 +1,322 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package doctor
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/cloudboss/keights/pkg/metadata"
+	"github.com/cloudboss/keights/pkg/runner"
+	"github.com/stretchr/testify/assert"
+)
+
+var notAfter = time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func writeKey(t *testing.T, dir, name string) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	contents := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), contents, 0600))
+	return key
+}
+
+func writePublicKey(t *testing.T, dir, name string, key *ecdsa.PrivateKey) {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	contents := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), contents, 0644))
+}
+
+func writeCert(t *testing.T, dir, name string, key *ecdsa.PrivateKey) {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	contents := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), contents, 0644))
+}
+
+func TestCheckPair(t *testing.T) {
+	dir := t.TempDir()
+	key := writeKey(t, dir, "ca.key")
+	writeCert(t, dir, "ca.crt", key)
+	writePublicKey(t, dir, "ca.pub", key)
+	other := writeKey(t, dir, "other.key")
+	writePublicKey(t, dir, "other.pub", other)
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	testCases := []struct {
+		name   string
+		pair   pair
+		now    time.Time
+		detail string
+		err    string
+	}{
+		{
+			name:   "valid certificate and key",
+			pair:   pair{Cert: path("ca.crt"), Key: path("ca.key")},
+			now:    time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			detail: "expires 2030-01-01T00:00:00Z",
+		},
+		{
+			name:   "certificate without key",
+			pair:   pair{Cert: path("ca.crt")},
+			now:    time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			detail: "expires 2030-01-01T00:00:00Z",
+		},
+		{
+			name: "expired certificate",
+			pair: pair{Cert: path("ca.crt"), Key: path("ca.key")},
+			now:  time.Date(2031, 1, 1, 0, 0, 0, 0, time.UTC),
+			err:  "expired at 2030-01-01T00:00:00Z",
+		},
+		{
+			name: "certificate not yet valid",
+			pair: pair{Cert: path("ca.crt")},
+			now:  time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC),
+			err:  "not valid until 2020-01-01T00:00:00Z",
+		},
+		{
+			name: "mismatched key",
+			pair: pair{Cert: path("ca.crt"), Key: path("other.key")},
+			now:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			err: "key " + path("other.key") +
+				" does not match: tls: private key does not match public key",
+		},
+		{
+			name: "missing certificate",
+			pair: pair{Cert: path("missing.crt")},
+			err:  "open " + path("missing.crt") + ": no such file or directory",
+		},
+		{
+			name:   "matching public key",
+			pair:   pair{Key: path("ca.key"), PublicKey: path("ca.pub")},
+			detail: "matches " + path("ca.pub"),
+		},
+		{
+			name: "mismatched public key",
+			pair: pair{Key: path("ca.key"), PublicKey: path("other.pub")},
+			err:  "public key " + path("other.pub") + " does not match",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			detail, err := checkPair(tc.pair, tc.now)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.detail, detail)
+		})
+	}
+}
+
+func TestUnitCheck(t *testing.T) {
+	showCommand := func(name string) string {
+		return "systemctl show --property=LoadState,ActiveState,SubState,Result " + name
+	}
+	Runner = runner.NewFake(map[string]*runner.Result{
+		showCommand("keights-kubeadm-join.service"): {
+			Stdout: "LoadState=loaded\nActiveState=inactive\nSubState=dead\nResult=success\n",
+		},
+		showCommand("keights-whisper-node.service"): {
+			Stdout: "LoadState=loaded\nActiveState=failed\nSubState=failed\nResult=exit-code\n",
+		},
+		showCommand("keights-bootstrap.service"): {
+			Stdout: "LoadState=not-found\nActiveState=inactive\nSubState=dead\nResult=success\n",
+		},
+		showCommand("kubelet.service"): {
+			Stdout: "LoadState=loaded\nActiveState=activating\nSubState=auto-restart\nResult=exit-code\n",
+		},
+	})
+	defer func() { Runner = &runner.Exec{} }()
+
+	testCases := []struct {
+		unit   unit
+		result Result
+	}{
+		{
+			unit: unit{"keights-kubeadm-join.service", false},
+			result: Result{
+				Name:   "keights-kubeadm-join.service",
+				Status: StatusPass,
+				Detail: "inactive (dead)",
+			},
+		},
+		{
+			unit: unit{"keights-whisper-node.service", false},
+			result: Result{
+				Name:   "keights-whisper-node.service",
+				Status: StatusFail,
+				Detail: "failed (failed), result exit-code",
+			},
+		},
+		{
+			unit: unit{"keights-bootstrap.service", false},
+			result: Result{
+				Name:   "keights-bootstrap.service",
+				Status: StatusSkip,
+				Detail: "not installed",
+			},
+		},
+		{
+			unit: unit{"kubelet.service", true},
+			result: Result{
+				Name:   "kubelet.service",
+				Status: StatusFail,
+				Detail: "activating (auto-restart), expected active",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.unit.Name, func(t *testing.T) {
+			check := Check{tc.unit.Name, unitCheck(tc.unit)}
+			assert.Equal(t, tc.result, run(context.Background(), check))
+		})
+	}
+}
+
+type fakeSSM struct {
+	ssmiface.SSMAPI
+	parameters map[string]string
+}
+
+func (f *fakeSSM) GetParametersWithContext(ctx aws.Context, input *ssm.GetParametersInput,
+	options ...request.Option) (*ssm.GetParametersOutput, error) {
+	if !aws.BoolValue(input.WithDecryption) {
+		return nil, errors.New("expected decryption")
+	}
+	output := &ssm.GetParametersOutput{}
+	for _, name := range input.Names {
+		value, ok := f.parameters[*name]
+		if !ok {
+			output.InvalidParameters = append(output.InvalidParameters, name)
+			continue
+		}
+		output.Parameters = append(output.Parameters, &ssm.Parameter{
+			Name:    name,
+			Type:    aws.String(ssm.ParameterTypeSecureString),
+			Value:   aws.String(value),
+			Version: aws.Int64(2),
+		})
+	}
+	return output, nil
+}
+
+func TestParameterCheck(t *testing.T) {
+	d := &Doctor{
+		identity: &metadata.Identity{Region: "us-east-1"},
+		ssmClient: &fakeSSM{parameters: map[string]string{
+			"/kate/cluster/ca.crt": "-----BEGIN CERTIFICATE-----",
+		}},
+	}
+	result := run(context.Background(), Check{"ca", d.parameterCheck("/kate/cluster/ca.crt")})
+	assert.Equal(t, Result{"ca", StatusPass, "decrypted SecureString, version 2"}, result)
+
+	result = run(context.Background(), Check{"token", d.parameterCheck("/kate/cluster/bootstrap-token")})
+	assert.Equal(t, Result{"token", StatusFail, "parameter not found"}, result)
+}
+
+func TestChecksWithoutIdentity(t *testing.T) {
+	d := &Doctor{Role: "node", ClusterName: "kate"}
+	result := run(context.Background(), Check{"credentials", d.checkCredentials})
+	assert.Equal(t, Result{"credentials", StatusSkip, "instance identity is unknown"}, result)
+	result = run(context.Background(), Check{"health", d.healthCheck(apiServerGates)})
+	assert.Equal(t, Result{"health", StatusSkip, "instance identity is unknown"}, result)
+}
+
+func TestReportWrite(t *testing.T) {
+	report := &Report{
+		OK: false,
+		Results: []Result{
+			{"identity", StatusPass, "instance i-0123456789abcdef0"},
+			{"volume /var/lib/etcd", StatusFail, "nothing is mounted on /var/lib/etcd"},
+			{"imds", StatusSkip, ""},
+		},
+	}
+	assert.Equal(t, 1, report.Failed())
+
+	var text bytes.Buffer
+	assert.NoError(t, report.Write(&text, FormatText))
+	assert.Equal(t, ""+
+		"PASS  identity              instance i-0123456789abcdef0\n"+
+		"FAIL  volume /var/lib/etcd  nothing is mounted on /var/lib/etcd\n"+
+		"SKIP  imds                  \n", text.String())
+
+	var js bytes.Buffer
+	assert.NoError(t, report.Write(&js, FormatJSON))
+	assert.JSONEq(t, `{
+		"ok": false,
+		"results": [
+			{"name": "identity", "status": "pass", "detail": "instance i-0123456789abcdef0"},
+			{"name": "volume /var/lib/etcd", "status": "fail", "detail": "nothing is mounted on /var/lib/etcd"},
+			{"name": "imds", "status": "skip"}
+		]
+	}`, js.String())
+
+	assert.EqualError(t, report.Write(&js, "yaml"), "Unknown format yaml, expected one of text, json")
+}
+
+func TestChecks(t *testing.T) {
+	d := &Doctor{Role: "node", ClusterName: "kate"}
+	names := []string{}
+	for _, check := range d.Checks() {
+		names = append(names, check.Name)
+	}
+	assert.Equal(t, []string{
+		"imds",
+		"identity",
+		"credentials",
+		"ssm /kate/cluster/bootstrap-token",
+		"ssm /kate/cluster/ca.crt",
+		"pki /run/kubernetes/pki/ca.crt",
+		"unit keights-bootstrap.service",
+		"unit keights-whisper-node.service",
+		"unit keights-templatize-kubeadm-join-config.service",
+		"unit keights-kubeadm-join.service",
+		"unit keights-node-signal.service",
+		"unit kubelet.service",
+	}, names)
+}
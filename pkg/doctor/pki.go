@@ -0,0 +1,171 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package doctor
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/cloudboss/keights/pkg/bootstrap"
+)
+
+// pair is a certificate and its key, or a key and its public key, as
+// for service account signing. Either may be missing a key.
+type pair struct {
+	Cert      string
+	Key       string
+	PublicKey string
+}
+
+func (p pair) name() string {
+	if p.Cert != "" {
+		return p.Cert
+	}
+	return p.Key
+}
+
+func certPairs(dir string, names ...string) []pair {
+	pairs := []pair{}
+	for _, name := range names {
+		pairs = append(pairs, pair{
+			Cert: filepath.Join(dir, name+".crt"),
+			Key:  filepath.Join(dir, name+".key"),
+		})
+	}
+	return pairs
+}
+
+var (
+	controllerPairs = append(
+		certPairs("/etc/kubernetes/pki", "ca", "front-proxy-ca", "etcd/ca", "apiserver",
+			"apiserver-kubelet-client", "front-proxy-client"),
+		pair{Key: "/etc/kubernetes/pki/sa.key", PublicKey: "/etc/kubernetes/pki/sa.pub"},
+	)
+	pairs = map[string][]pair{
+		bootstrap.RoleEtcd: certPairs("/etc/pki/etcd",
+			"ca", "server", "peer", "healthcheck-client"),
+		bootstrap.RoleControllerStacked: append(append([]pair{}, controllerPairs...),
+			certPairs("/etc/kubernetes/pki", "etcd/server", "etcd/peer",
+				"etcd/healthcheck-client", "apiserver-etcd-client")...),
+		bootstrap.RoleControllerExternal: append(append([]pair{}, controllerPairs...),
+			certPairs("/etc/kubernetes/pki", "apiserver-etcd-client")...),
+		bootstrap.RoleNode: {{Cert: "/run/kubernetes/pki/ca.crt"}},
+	}
+)
+
+func (d *Doctor) pairCheck(p pair) func(ctx context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		return checkPair(p, d.now())
+	}
+}
+
+// checkPair checks that the certificate is valid at now and that the
+// key belongs to it.
+func checkPair(p pair, now time.Time) (string, error) {
+	if p.Cert == "" {
+		return checkPublicKey(p.Key, p.PublicKey)
+	}
+	certPEM, err := ioutil.ReadFile(p.Cert)
+	if err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return "", fmt.Errorf("could not decode certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	if now.Before(cert.NotBefore) {
+		return "", fmt.Errorf("not valid until %s", cert.NotBefore.UTC().Format(time.RFC3339))
+	}
+	if now.After(cert.NotAfter) {
+		return "", fmt.Errorf("expired at %s", cert.NotAfter.UTC().Format(time.RFC3339))
+	}
+	if p.Key != "" {
+		keyPEM, err := ioutil.ReadFile(p.Key)
+		if err != nil {
+			return "", err
+		}
+		if _, err = tls.X509KeyPair(certPEM, keyPEM); err != nil {
+			return "", fmt.Errorf("key %s does not match: %w", p.Key, err)
+		}
+	}
+	return fmt.Sprintf("expires %s", cert.NotAfter.UTC().Format(time.RFC3339)), nil
+}
+
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse private key")
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+func checkPublicKey(keyPath, publicKeyPath string) (string, error) {
+	keyPEM, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return "", fmt.Errorf("could not decode private key")
+	}
+	key, err := parsePrivateKey(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	publicPEM, err := ioutil.ReadFile(publicKeyPath)
+	if err != nil {
+		return "", err
+	}
+	block, _ = pem.Decode(publicPEM)
+	if block == nil {
+		return "", fmt.Errorf("could not decode public key")
+	}
+	public, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	equaler, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !equaler.Equal(public) {
+		return "", fmt.Errorf("public key %s does not match", publicKeyPath)
+	}
+	return fmt.Sprintf("matches %s", publicKeyPath), nil
+}
@@ -0,0 +1,114 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package doctor
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/cloudboss/keights/pkg/bootstrap"
+	"github.com/cloudboss/keights/pkg/runner"
+)
+
+// unit is a systemd unit expected on a role. Units that bootstrap the
+// node only need to have not failed, since they are skipped once the node
+// is initialized, or replaced by keights-bootstrap.service. Services must
+// also be active.
+type unit struct {
+	Name    string
+	Service bool
+}
+
+var units = map[string][]unit{
+	bootstrap.RoleEtcd: {
+		{"keights-bootstrap.service", false},
+		{"keights-whisper-etcd.service", false},
+		{"keights-templatize-etcd-env.service", false},
+		{"keights-templatize-kubeadm-etcd-config.service", false},
+		{"keights-volumize.service", false},
+		{"keights-kubeadm-etcd.service", false},
+		{"keights-etcd-signal.service", false},
+		{"etcd.service", true},
+	},
+	bootstrap.RoleControllerStacked: {
+		{"keights-bootstrap.service", false},
+		{"keights-whisper-controller.service", false},
+		{"keights-volumize.service", false},
+		{"keights-templatize-kubeadm-init-config.service", false},
+		{"keights-kubeadm-init-stacked.service", false},
+		{"keights-controller-signal.service", false},
+		{"kubelet.service", true},
+	},
+	bootstrap.RoleControllerExternal: {
+		{"keights-bootstrap.service", false},
+		{"keights-whisper-controller.service", false},
+		{"keights-templatize-kubeadm-init-config.service", false},
+		{"keights-kubeadm-init-external.service", false},
+		{"keights-controller-signal.service", false},
+		{"kubelet.service", true},
+	},
+	bootstrap.RoleNode: {
+		{"keights-bootstrap.service", false},
+		{"keights-whisper-node.service", false},
+		{"keights-templatize-kubeadm-join-config.service", false},
+		{"keights-kubeadm-join.service", false},
+		{"keights-node-signal.service", false},
+		{"kubelet.service", true},
+	},
+}
+
+func parseProperties(output string) map[string]string {
+	properties := map[string]string{}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "=", 2)
+		if len(parts) == 2 {
+			properties[parts[0]] = parts[1]
+		}
+	}
+	return properties
+}
+
+func unitCheck(u unit) func(ctx context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		result, err := runner.Run(ctx, Runner, &runner.Command{
+			Name: "systemctl",
+			Args: []string{"show", "--property=LoadState,ActiveState,SubState,Result", u.Name},
+		})
+		if err != nil {
+			return "", err
+		}
+		properties := parseProperties(result.Stdout)
+		if properties["LoadState"] == "not-found" {
+			return "", skip("not installed")
+		}
+		state := fmt.Sprintf("%s (%s)", properties["ActiveState"], properties["SubState"])
+		if properties["ActiveState"] == "failed" {
+			return "", fmt.Errorf("%s, result %s", state, properties["Result"])
+		}
+		if u.Service && properties["ActiveState"] != "active" {
+			return "", fmt.Errorf("%s, expected active", state)
+		}
+		return state, nil
+	}
+}
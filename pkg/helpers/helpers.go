@@ -26,38 +26,16 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"sort"
 	"strings"
 	"syscall"
-	"time"
 
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/cloudboss/keights/pkg/metadata"
 )
 
-type CommandOutput struct {
-	ExitStatus int
-	Stdout     string
-	Stderr     string
-}
-
-func RunCommand(command string, args ...string) *CommandOutput {
-	var stdout, stderr bytes.Buffer
-	cmd := exec.Command(command, args...)
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	cmd.Run()
-	waitStatus := cmd.ProcessState.Sys().(syscall.WaitStatus)
-	return &CommandOutput{
-		ExitStatus: waitStatus.ExitStatus(),
-		Stdout:     stdout.String(),
-		Stderr:     stderr.String(),
-	}
-}
-
 func AtomicWrite(path string, contents []byte, mode os.FileMode) error {
 	dir := filepath.Dir(path)
 	tempDir, err := ioutil.TempDir(dir, ".keights")
@@ -121,8 +99,7 @@ func SortMapKeys(mapping map[string]string) []string {
 }
 
 func AsgName(sess *session.Session) (*string, error) {
-	metadata := ec2metadata.New(sess)
-	identity, err := metadata.GetInstanceIdentityDocument()
+	identity, err := metadata.Get()
 	if err != nil {
 		return nil, err
 	}
@@ -140,27 +117,6 @@ func AsgName(sess *session.Session) (*string, error) {
 	return nil, fmt.Errorf("Autoscaling group name not found")
 }
 
-func WaitFor(duration time.Duration, checker func() error) error {
-	var err error
-	c := make(chan bool)
-	go func() {
-		for {
-			err = checker()
-			if err != nil {
-				time.Sleep(5 * time.Second)
-			} else {
-				c <- true
-			}
-		}
-	}()
-	select {
-	case <-c:
-		return nil
-	case <-time.After(duration):
-		return err
-	}
-}
-
 func InputToMapping(inputFile string) (map[string]string, error) {
 	fd, err := os.Open(inputFile)
 	if err != nil {
@@ -181,18 +137,16 @@ func InputToMapping(inputFile string) (map[string]string, error) {
 	return mapping, nil
 }
 
-func MyIP(sess *session.Session) (string, error) {
-	metadata := ec2metadata.New(sess)
-	identity, err := metadata.GetInstanceIdentityDocument()
+func MyIP() (string, error) {
+	identity, err := metadata.Get()
 	if err != nil {
 		return "", err
 	}
 	return identity.PrivateIP, nil
 }
 
-func MyID(sess *session.Session) (string, error) {
-	metadata := ec2metadata.New(sess)
-	identity, err := metadata.GetInstanceIdentityDocument()
+func MyID() (string, error) {
+	identity, err := metadata.Get()
 	if err != nil {
 		return "", err
 	}
@@ -208,12 +162,12 @@ func MyIndex(mapping map[string]string, ip string) string {
 	return "-1"
 }
 
-func IsIndexOne(sess *session.Session, inputFile string) (bool, error) {
+func IsIndexOne(inputFile string) (bool, error) {
 	mapping, err := InputToMapping(inputFile)
 	if err != nil {
 		return false, err
 	}
-	myIP, err := MyIP(sess)
+	myIP, err := MyIP()
 	if err != nil {
 		return false, err
 	}
@@ -22,10 +22,13 @@ package helpers
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -152,3 +155,59 @@ func TestAppendToFile(t *testing.T) {
 		}
 	}
 }
+
+func TestPoll(t *testing.T) {
+	backoff := Backoff{Initial: time.Millisecond, Max: 4 * time.Millisecond, Factor: 2}
+	notYet := errors.New("not yet")
+
+	calls := 0
+	err := Poll(context.Background(), backoff, func() error {
+		calls++
+		if calls < 3 {
+			return notYet
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	failed := errors.New("failed")
+	err = Poll(context.Background(), backoff, func() error {
+		calls++
+		return Permanent(failed)
+	})
+	assert.Equal(t, failed, err)
+	assert.Equal(t, 1, calls)
+	assert.True(t, IsPermanent(fmt.Errorf("phase: %w", Permanent(failed))))
+	assert.False(t, IsPermanent(failed))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = Poll(ctx, backoff, func() error {
+		return notYet
+	})
+	assert.True(t, errors.Is(err, notYet))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Equal(t, "Timed out waiting: not yet", err.Error())
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	err = Poll(ctx, backoff, func() error {
+		return notYet
+	})
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Equal(t, "Canceled waiting: not yet", err.Error())
+}
+
+func TestBackoffNext(t *testing.T) {
+	backoff := Backoff{Initial: time.Second, Max: 3 * time.Second, Factor: 2, Jitter: 0.5}
+	interval := backoff.Initial
+	for _, expected := range []time.Duration{2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		var sleep time.Duration
+		previous := interval
+		sleep, interval = backoff.next(interval)
+		assert.Equal(t, expected, interval)
+		assert.True(t, sleep >= previous/2 && sleep <= previous*3/2)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Backoff controls the interval between calls to the checker in Poll. The
+// interval starts at Initial and is multiplied by Factor after each failed
+// check, up to Max. Each sleep is varied randomly by up to Jitter, a fraction
+// of the interval, so that instances starting together do not poll in step.
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+	Factor  float64
+	Jitter  float64
+}
+
+var DefaultBackoff = Backoff{
+	Initial: 2 * time.Second,
+	Max:     30 * time.Second,
+	Factor:  1.5,
+	Jitter:  0.2,
+}
+
+// next returns the interval to sleep after interval and the interval to
+// use the time after.
+func (b Backoff) next(interval time.Duration) (time.Duration, time.Duration) {
+	sleep := interval
+	if b.Jitter > 0 {
+		delta := b.Jitter * float64(interval)
+		sleep = interval + time.Duration(delta*(2*rand.Float64()-1))
+	}
+	following := time.Duration(float64(interval) * b.Factor)
+	if following < interval {
+		following = interval
+	}
+	if b.Max > 0 && following > b.Max {
+		following = b.Max
+	}
+	return sleep, following
+}
+
+// WaitError is returned by Poll when the context is done before the
+// checker succeeds. It unwraps to the last error from the checker, and
+// matches context.DeadlineExceeded or context.Canceled with errors.Is.
+type WaitError struct {
+	Cause error
+	Last  error
+}
+
+func (e *WaitError) Error() string {
+	reason := "Timed out"
+	if errors.Is(e.Cause, context.Canceled) {
+		reason = "Canceled"
+	}
+	if e.Last == nil {
+		return fmt.Sprintf("%s waiting", reason)
+	}
+	return fmt.Sprintf("%s waiting: %v", reason, e.Last)
+}
+
+func (e *WaitError) Unwrap() error {
+	return e.Last
+}
+
+func (e *WaitError) Is(target error) bool {
+	return errors.Is(e.Cause, target)
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent wraps an error returned by a checker to stop Poll from
+// retrying. Poll returns the wrapped error.
+func Permanent(err error) error {
+	return &permanentError{err}
+}
+
+// IsPermanent returns true if err was wrapped with Permanent.
+func IsPermanent(err error) bool {
+	var permanent *permanentError
+	return errors.As(err, &permanent)
+}
+
+// Poll calls checker until it returns nil or a Permanent error, or until
+// ctx is done, sleeping between calls according to backoff.
+func Poll(ctx context.Context, backoff Backoff, checker func() error) error {
+	interval := backoff.Initial
+	for {
+		err := checker()
+		if err == nil {
+			return nil
+		}
+		var permanent *permanentError
+		if errors.As(err, &permanent) {
+			return permanent.err
+		}
+		var sleep time.Duration
+		sleep, interval = backoff.next(interval)
+		timer := time.NewTimer(sleep)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return &WaitError{Cause: ctx.Err(), Last: err}
+		case <-timer.C:
+		}
+	}
+}
+
+// WaitFor polls checker with the default backoff until it succeeds or
+// duration has passed.
+func WaitFor(ctx context.Context, duration time.Duration, checker func() error) error {
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+	return Poll(ctx, DefaultBackoff, checker)
+}
+
+// SignalContext returns a context that is canceled on SIGTERM or SIGINT,
+// so that systemd stopping a unit interrupts any wait in progress.
+func SignalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+}
@@ -0,0 +1,224 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package kubeconfig writes a kubeconfig for the admin user of a cluster,
+// with credentials read from SSM, so that nothing sensitive is written to
+// temporary files.
+package kubeconfig
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/aws/aws-sdk-go/service/elb/elbiface"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/cloudboss/keights/pkg/logging"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+const (
+	DefaultPort = 443
+	// Stdout is the output that writes the kubeconfig to stdout instead of
+	// merging it into a file.
+	Stdout = "-"
+)
+
+// Credentials are the cluster CA certificate and the admin client
+// certificate and key, PEM encoded.
+type Credentials struct {
+	CACert []byte
+	Cert   []byte
+	Key    []byte
+}
+
+func parameterPaths(clusterName string) (string, string, string) {
+	return fmt.Sprintf("/%s/cluster/ca.crt", clusterName),
+		fmt.Sprintf("/%s/controller/apiserver-kubelet-client.crt", clusterName),
+		fmt.Sprintf("/%s/controller/apiserver-kubelet-client.key", clusterName)
+}
+
+func GetCredentials(ctx context.Context, ssmClient ssmiface.SSMAPI, clusterName string) (*Credentials, error) {
+	caCertPath, certPath, keyPath := parameterPaths(clusterName)
+	output, err := ssmClient.GetParametersWithContext(ctx, &ssm.GetParametersInput{
+		Names:          aws.StringSlice([]string{caCertPath, certPath, keyPath}),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(output.InvalidParameters) > 0 {
+		return nil, fmt.Errorf("Parameters not found: %s",
+			strings.Join(aws.StringValueSlice(output.InvalidParameters), ", "))
+	}
+	values := map[string][]byte{}
+	for _, parameter := range output.Parameters {
+		values[aws.StringValue(parameter.Name)] = []byte(aws.StringValue(parameter.Value))
+	}
+	return &Credentials{
+		CACert: values[caCertPath],
+		Cert:   values[certPath],
+		Key:    values[keyPath],
+	}, nil
+}
+
+func isNotFound(err error) bool {
+	// Classic and network load balancer APIs use the same error code.
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == elbv2.ErrCodeLoadBalancerNotFoundException
+}
+
+// FindEndpoint returns the DNS name of the API load balancer, which is
+// named after the cluster. A classic load balancer is tried first, then
+// a network load balancer.
+func FindEndpoint(ctx context.Context, elbClient elbiface.ELBAPI, elbv2Client elbv2iface.ELBV2API,
+	clusterName string) (string, error) {
+	classic, err := elbClient.DescribeLoadBalancersWithContext(ctx, &elb.DescribeLoadBalancersInput{
+		LoadBalancerNames: []*string{aws.String(clusterName)},
+	})
+	if err != nil && !isNotFound(err) {
+		return "", err
+	}
+	if err == nil && len(classic.LoadBalancerDescriptions) > 0 {
+		return aws.StringValue(classic.LoadBalancerDescriptions[0].DNSName), nil
+	}
+	network, err := elbv2Client.DescribeLoadBalancersWithContext(ctx, &elbv2.DescribeLoadBalancersInput{
+		Names: []*string{aws.String(clusterName)},
+	})
+	if err != nil && !isNotFound(err) {
+		return "", err
+	}
+	if err == nil && len(network.LoadBalancers) > 0 {
+		return aws.StringValue(network.LoadBalancers[0].DNSName), nil
+	}
+	return "", fmt.Errorf("No load balancer named %s found", clusterName)
+}
+
+func contextName(clusterName string) string {
+	return fmt.Sprintf("admin@%s", clusterName)
+}
+
+// Build returns a kubeconfig with the credentials embedded, and its
+// context set as current.
+func Build(clusterName, server string, credentials *Credentials) *clientcmdapi.Config {
+	name := contextName(clusterName)
+	config := clientcmdapi.NewConfig()
+	config.Clusters[clusterName] = &clientcmdapi.Cluster{
+		Server:                   server,
+		CertificateAuthorityData: credentials.CACert,
+	}
+	config.AuthInfos[name] = &clientcmdapi.AuthInfo{
+		ClientCertificateData: credentials.Cert,
+		ClientKeyData:         credentials.Key,
+	}
+	config.Contexts[name] = &clientcmdapi.Context{
+		Cluster:  clusterName,
+		AuthInfo: name,
+	}
+	config.CurrentContext = name
+	return config
+}
+
+// Merge adds the clusters, users, and contexts of config to existing,
+// replacing any of the same name, and sets the current context.
+func Merge(existing, config *clientcmdapi.Config) {
+	for name, cluster := range config.Clusters {
+		existing.Clusters[name] = cluster
+	}
+	for name, authInfo := range config.AuthInfos {
+		existing.AuthInfos[name] = authInfo
+	}
+	for name, ctxt := range config.Contexts {
+		existing.Contexts[name] = ctxt
+	}
+	existing.CurrentContext = config.CurrentContext
+}
+
+// DefaultOutput returns the file kubectl uses, from KUBECONFIG or
+// ~/.kube/config.
+func DefaultOutput() string {
+	return clientcmd.NewDefaultClientConfigLoadingRules().GetDefaultFilename()
+}
+
+// Write writes config to out if output is Stdout, otherwise merges it
+// into the kubeconfig file at output, creating it if needed.
+func Write(config *clientcmdapi.Config, output string, out io.Writer) error {
+	if output == Stdout {
+		contents, err := clientcmd.Write(*config)
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(contents)
+		return err
+	}
+	existing, err := clientcmd.LoadFromFile(output)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		existing = clientcmdapi.NewConfig()
+	}
+	Merge(existing, config)
+	return clientcmd.WriteToFile(*existing, output)
+}
+
+func DoIt(ctx context.Context, out io.Writer, clusterName, server string, port int, output string) error {
+	if clusterName == "" {
+		return fmt.Errorf("cluster name is required")
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return err
+	}
+	if server == "" {
+		endpoint, err := FindEndpoint(ctx, elb.New(sess), elbv2.New(sess), clusterName)
+		if err != nil {
+			return err
+		}
+		server = fmt.Sprintf("https://%s:%d", endpoint, port)
+	}
+	credentials, err := GetCredentials(ctx, ssm.New(sess), clusterName)
+	if err != nil {
+		return err
+	}
+	if output == "" {
+		output = DefaultOutput()
+	}
+	if err = Write(Build(clusterName, server, credentials), output, out); err != nil {
+		return err
+	}
+	if output != Stdout {
+		logging.Info("Wrote kubeconfig", "path", output, "context", contextName(clusterName),
+			"server", server)
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package kubeconfig
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/aws/aws-sdk-go/service/elb/elbiface"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+var credentials = &Credentials{
+	CACert: []byte("ca cert"),
+	Cert:   []byte("client cert"),
+	Key:    []byte("client key"),
+}
+
+type fakeELB struct {
+	elbiface.ELBAPI
+	dnsNames map[string]string
+	err      error
+}
+
+func (f *fakeELB) DescribeLoadBalancersWithContext(ctx aws.Context, input *elb.DescribeLoadBalancersInput,
+	options ...request.Option) (*elb.DescribeLoadBalancersOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	dnsName, ok := f.dnsNames[*input.LoadBalancerNames[0]]
+	if !ok {
+		return nil, awserr.New(elb.ErrCodeAccessPointNotFoundException, "not found", nil)
+	}
+	return &elb.DescribeLoadBalancersOutput{
+		LoadBalancerDescriptions: []*elb.LoadBalancerDescription{{DNSName: aws.String(dnsName)}},
+	}, nil
+}
+
+type fakeELBV2 struct {
+	elbv2iface.ELBV2API
+	dnsNames map[string]string
+}
+
+func (f *fakeELBV2) DescribeLoadBalancersWithContext(ctx aws.Context, input *elbv2.DescribeLoadBalancersInput,
+	options ...request.Option) (*elbv2.DescribeLoadBalancersOutput, error) {
+	dnsName, ok := f.dnsNames[*input.Names[0]]
+	if !ok {
+		return nil, awserr.New(elbv2.ErrCodeLoadBalancerNotFoundException, "not found", nil)
+	}
+	return &elbv2.DescribeLoadBalancersOutput{
+		LoadBalancers: []*elbv2.LoadBalancer{{DNSName: aws.String(dnsName)}},
+	}, nil
+}
+
+func TestFindEndpoint(t *testing.T) {
+	testCases := []struct {
+		name     string
+		elb      *fakeELB
+		elbv2    *fakeELBV2
+		endpoint string
+		err      string
+	}{
+		{
+			name:     "classic load balancer",
+			elb:      &fakeELB{dnsNames: map[string]string{"kate": "kate-1.elb.amazonaws.com"}},
+			elbv2:    &fakeELBV2{dnsNames: map[string]string{"kate": "kate-2.elb.amazonaws.com"}},
+			endpoint: "kate-1.elb.amazonaws.com",
+		},
+		{
+			name:     "network load balancer",
+			elb:      &fakeELB{},
+			elbv2:    &fakeELBV2{dnsNames: map[string]string{"kate": "kate-2.elb.amazonaws.com"}},
+			endpoint: "kate-2.elb.amazonaws.com",
+		},
+		{
+			name:  "no load balancer",
+			elb:   &fakeELB{},
+			elbv2: &fakeELBV2{},
+			err:   "No load balancer named kate found",
+		},
+		{
+			name:  "error from classic load balancer",
+			elb:   &fakeELB{err: errors.New("access denied")},
+			elbv2: &fakeELBV2{},
+			err:   "access denied",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			endpoint, err := FindEndpoint(context.Background(), tc.elb, tc.elbv2, "kate")
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.endpoint, endpoint)
+		})
+	}
+}
+
+type fakeSSM struct {
+	ssmiface.SSMAPI
+	parameters map[string]string
+}
+
+func (f *fakeSSM) GetParametersWithContext(ctx aws.Context, input *ssm.GetParametersInput,
+	options ...request.Option) (*ssm.GetParametersOutput, error) {
+	output := &ssm.GetParametersOutput{}
+	for _, name := range input.Names {
+		value, ok := f.parameters[*name]
+		if !ok {
+			output.InvalidParameters = append(output.InvalidParameters, name)
+			continue
+		}
+		output.Parameters = append(output.Parameters, &ssm.Parameter{
+			Name:  name,
+			Value: aws.String(value),
+		})
+	}
+	return output, nil
+}
+
+func TestGetCredentials(t *testing.T) {
+	ssmClient := &fakeSSM{parameters: map[string]string{
+		"/kate/cluster/ca.crt":                          "ca cert",
+		"/kate/controller/apiserver-kubelet-client.crt": "client cert",
+		"/kate/controller/apiserver-kubelet-client.key": "client key",
+	}}
+	creds, err := GetCredentials(context.Background(), ssmClient, "kate")
+	assert.NoError(t, err)
+	assert.Equal(t, credentials, creds)
+
+	delete(ssmClient.parameters, "/kate/controller/apiserver-kubelet-client.key")
+	_, err = GetCredentials(context.Background(), ssmClient, "kate")
+	assert.EqualError(t, err,
+		"Parameters not found: /kate/controller/apiserver-kubelet-client.key")
+}
+
+func TestWriteStdout(t *testing.T) {
+	var out bytes.Buffer
+	config := Build("kate", "https://kate.example.com:443", credentials)
+	assert.NoError(t, Write(config, Stdout, &out))
+
+	written, err := clientcmd.Load(out.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, "admin@kate", written.CurrentContext)
+	assert.Equal(t, "https://kate.example.com:443", written.Clusters["kate"].Server)
+	assert.Equal(t, []byte("ca cert"), written.Clusters["kate"].CertificateAuthorityData)
+	assert.Equal(t, []byte("client cert"), written.AuthInfos["admin@kate"].ClientCertificateData)
+	assert.Equal(t, []byte("client key"), written.AuthInfos["admin@kate"].ClientKeyData)
+	assert.Equal(t, "kate", written.Contexts["admin@kate"].Cluster)
+	assert.Equal(t, "admin@kate", written.Contexts["admin@kate"].AuthInfo)
+}
+
+func TestWriteMerges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kube", "config")
+	var out bytes.Buffer
+
+	assert.NoError(t, Write(Build("kate", "https://old.example.com:443", credentials), path, &out))
+	assert.NoError(t, Write(Build("ruth", "https://ruth.example.com:443", credentials), path, &out))
+	assert.NoError(t, Write(Build("kate", "https://kate.example.com:443", credentials), path, &out))
+	assert.Empty(t, out.String())
+
+	written, err := clientcmd.LoadFromFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "admin@kate", written.CurrentContext)
+	assert.Len(t, written.Contexts, 2)
+	assert.Equal(t, "https://kate.example.com:443", written.Clusters["kate"].Server)
+	assert.Equal(t, "https://ruth.example.com:443", written.Clusters["ruth"].Server)
+}
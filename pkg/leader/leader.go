@@ -0,0 +1,370 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package leader runs a command on exactly one instance in a cluster, by
+// holding a lease stored in a DynamoDB table while the command runs.
+//
+// Every write to the lease is conditional. A lease is acquired with a put
+// that succeeds only if there is no lease, or if it has expired and is not
+// done, and it is renewed, marked done or released only while its holder
+// and nonce are unchanged. Two instances can therefore never both believe
+// they hold the lease, even when taking over an expired one at once.
+package leader
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/cloudboss/keights/pkg/helpers"
+	"github.com/cloudboss/keights/pkg/logging"
+	"github.com/cloudboss/keights/pkg/metadata"
+	"github.com/cloudboss/keights/pkg/runner"
+)
+
+const (
+	tableTemplate = "%s-leader"
+
+	// acquireCondition allows a put when there is no lease, when the lease
+	// has expired without being marked done, or when it is already held.
+	acquireCondition = "attribute_not_exists(#holder) OR " +
+		"(#done = :false AND (#expires < :now OR (#holder = :holder AND #nonce = :nonce)))"
+	// holdCondition allows a write only by the holder of the lease.
+	holdCondition = "#holder = :holder AND #nonce = :nonce"
+)
+
+var (
+	// Runner runs the command, and can be replaced in tests.
+	Runner runner.Runner = &runner.Exec{}
+
+	// ErrLost is returned when the lease is found to be held by another
+	// instance while the command is running.
+	ErrLost = errors.New("lease was lost to another instance")
+)
+
+// Lease is the item stored in the table under the lease name.
+type Lease struct {
+	Holder  string    `dynamodbav:"holder"`
+	Nonce   string    `dynamodbav:"nonce"`
+	Expires time.Time `dynamodbav:"expires,unixtime"`
+	Done    bool      `dynamodbav:"done"`
+}
+
+type Elector struct {
+	dynamodb dynamodbiface.DynamoDBAPI
+	table    string
+	name     string
+	holder   string
+	nonce    string
+	ttl      time.Duration
+	now      func() time.Time
+}
+
+func NewElector(client dynamodbiface.DynamoDBAPI, clusterName, name, holder string,
+	ttl time.Duration) (*Elector, error) {
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &Elector{
+		dynamodb: client,
+		table:    fmt.Sprintf(tableTemplate, clusterName),
+		name:     name,
+		holder:   holder,
+		nonce:    hex.EncodeToString(nonce),
+		ttl:      ttl,
+		now:      time.Now,
+	}, nil
+}
+
+func isAWSError(err error, code string) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == code
+}
+
+func (e *Elector) key() map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{"name": {S: aws.String(e.name)}}
+}
+
+// holderValues returns the expression values for holdCondition, along with
+// those in extra.
+func (e *Elector) holderValues(extra map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	values := map[string]*dynamodb.AttributeValue{
+		":holder": {S: aws.String(e.holder)},
+		":nonce":  {S: aws.String(e.nonce)},
+	}
+	for name, value := range extra {
+		values[name] = value
+	}
+	return values
+}
+
+// read returns the current lease, or nil if there is none.
+func (e *Elector) read() (*Lease, error) {
+	output, err := e.dynamodb.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(e.table),
+		Key:            e.key(),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if output.Item == nil {
+		return nil, nil
+	}
+	lease := &Lease{}
+	if err = dynamodbattribute.UnmarshalMap(output.Item, lease); err != nil {
+		return nil, fmt.Errorf("Invalid lease %s: %v", e.name, err)
+	}
+	return lease, nil
+}
+
+func (e *Elector) expires() time.Time {
+	return e.now().Add(e.ttl).UTC()
+}
+
+// TryAcquire attempts to take the lease, returning whether it was taken and
+// the lease found, which is marked done if the command has already run.
+func (e *Elector) TryAcquire() (bool, *Lease, error) {
+	item, err := dynamodbattribute.MarshalMap(&Lease{
+		Holder:  e.holder,
+		Nonce:   e.nonce,
+		Expires: e.expires(),
+	})
+	if err != nil {
+		return false, nil, err
+	}
+	for name, value := range e.key() {
+		item[name] = value
+	}
+	_, err = e.dynamodb.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(e.table),
+		Item:                item,
+		ConditionExpression: aws.String(acquireCondition),
+		ExpressionAttributeNames: map[string]*string{
+			"#holder":  aws.String("holder"),
+			"#nonce":   aws.String("nonce"),
+			"#expires": aws.String("expires"),
+			"#done":    aws.String("done"),
+		},
+		ExpressionAttributeValues: e.holderValues(map[string]*dynamodb.AttributeValue{
+			":false": {BOOL: aws.Bool(false)},
+			":now":   {N: aws.String(strconv.FormatInt(e.now().Unix(), 10))},
+		}),
+	})
+	if err == nil {
+		return true, nil, nil
+	}
+	if !isAWSError(err, dynamodb.ErrCodeConditionalCheckFailedException) {
+		return false, nil, err
+	}
+	current, err := e.read()
+	if err != nil {
+		return false, nil, err
+	}
+	// The lease may have been released since the put, in which
+	// case it is nil and will be tried again next time.
+	return false, current, nil
+}
+
+// Renew extends the lease, returning ErrLost if it is no longer held.
+func (e *Elector) Renew() error {
+	return e.update(false)
+}
+
+// MarkDone records that the command completed, so that it is not run again.
+func (e *Elector) MarkDone() error {
+	return e.update(true)
+}
+
+func (e *Elector) update(done bool) error {
+	_, err := e.dynamodb.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(e.table),
+		Key:                 e.key(),
+		UpdateExpression:    aws.String("SET #expires = :expires, #done = :done"),
+		ConditionExpression: aws.String(holdCondition),
+		ExpressionAttributeNames: map[string]*string{
+			"#holder":  aws.String("holder"),
+			"#nonce":   aws.String("nonce"),
+			"#expires": aws.String("expires"),
+			"#done":    aws.String("done"),
+		},
+		ExpressionAttributeValues: e.holderValues(map[string]*dynamodb.AttributeValue{
+			":expires": {N: aws.String(strconv.FormatInt(e.expires().Unix(), 10))},
+			":done":    {BOOL: aws.Bool(done)},
+		}),
+	})
+	if isAWSError(err, dynamodb.ErrCodeConditionalCheckFailedException) {
+		return ErrLost
+	}
+	return err
+}
+
+// Release deletes the lease if it is still held, so another instance can
+// take it without waiting for it to expire.
+func (e *Elector) Release() error {
+	_, err := e.dynamodb.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:           aws.String(e.table),
+		Key:                 e.key(),
+		ConditionExpression: aws.String(holdCondition),
+		ExpressionAttributeNames: map[string]*string{
+			"#holder": aws.String("holder"),
+			"#nonce":  aws.String("nonce"),
+		},
+		ExpressionAttributeValues: e.holderValues(nil),
+	})
+	if err != nil && !isAWSError(err, dynamodb.ErrCodeConditionalCheckFailedException) {
+		return err
+	}
+	return nil
+}
+
+// renewUntilDone renews the lease every third of its TTL until ctx is done,
+// calling lost if the lease cannot be renewed.
+func (e *Elector) renewUntilDone(ctx context.Context, lost func(error)) {
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := e.Renew(); err != nil {
+				if errors.Is(err, ErrLost) {
+					lost(err)
+					return
+				}
+				logging.Warn("Failed to renew lease", "lease", e.name, "error", err)
+			}
+		}
+	}
+}
+
+// runCommand runs the command while renewing the lease, killing the command
+// if the lease is lost.
+func (e *Elector) runCommand(ctx context.Context, command []string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var lostErr error
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		e.renewUntilDone(ctx, func(err error) {
+			lostErr = err
+			cancel()
+		})
+	}()
+	logger := logging.With("command", command[0])
+	_, err := runner.Run(ctx, Runner, &runner.Command{
+		Name:   command[0],
+		Args:   command[1:],
+		Output: logger.Writer(logging.LevelInfo),
+	})
+	cancel()
+	<-renewed
+	if lostErr != nil {
+		return lostErr
+	}
+	return err
+}
+
+// Run waits up to wait to acquire the lease and runs command while holding
+// it. If once is true, the lease is kept and marked done when the command
+// succeeds, and instances that find it done return without running the
+// command. Otherwise the lease is released afterward, and a lease found
+// marked done by a run with once is an error, as it is never released.
+func (e *Elector) Run(ctx context.Context, command []string, once bool, wait time.Duration) error {
+	if len(command) == 0 {
+		return fmt.Errorf("No command given")
+	}
+	acquired := false
+	var done bool
+	err := helpers.WaitFor(ctx, wait, func() error {
+		var lease *Lease
+		var err error
+		acquired, lease, err = e.TryAcquire()
+		if err != nil {
+			return err
+		}
+		if acquired {
+			return nil
+		}
+		if lease != nil && lease.Done {
+			if !once {
+				return helpers.Permanent(fmt.Errorf("Lease %s is marked done by a run with --once", e.name))
+			}
+			done = true
+			return nil
+		}
+		if lease != nil {
+			return fmt.Errorf("Lease %s is held by %s", e.name, lease.Holder)
+		}
+		return fmt.Errorf("Lease %s was not acquired", e.name)
+	})
+	if err != nil {
+		return err
+	}
+	if done {
+		logging.Info("Command already run by leader", "lease", e.name)
+		return nil
+	}
+	logging.Info("Acquired lease", "lease", e.name)
+	if err = e.runCommand(ctx, command); err != nil {
+		if releaseErr := e.Release(); releaseErr != nil {
+			logging.Warn("Failed to release lease", "lease", e.name, "error", releaseErr)
+		}
+		return err
+	}
+	if once {
+		return e.MarkDone()
+	}
+	return e.Release()
+}
+
+func DoRun(ctx context.Context, clusterName, name string, command []string, once bool,
+	ttl time.Duration, minutes int) error {
+	if clusterName == "" || name == "" {
+		return fmt.Errorf("cluster name and lease name are required")
+	}
+	if ttl < 3*time.Second {
+		return fmt.Errorf("lease TTL must be at least 3 seconds")
+	}
+	identity, err := metadata.Get()
+	if err != nil {
+		return err
+	}
+	logging.AddFields("cluster", clusterName, "instance", identity.InstanceID)
+	sess := session.New(&aws.Config{Region: aws.String(identity.Region)})
+	elector, err := NewElector(dynamodb.New(sess), clusterName, name, identity.InstanceID, ttl)
+	if err != nil {
+		return err
+	}
+	return elector.Run(ctx, command, once, time.Duration(minutes)*time.Minute)
+}
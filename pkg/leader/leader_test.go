@@ -0,0 +1,241 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package leader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/cloudboss/keights/pkg/runner"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDynamoDB stores leases by name, evaluating the condition expressions
+// used by the elector as DynamoDB would.
+type fakeDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	mutex sync.Mutex
+	items map[string]map[string]*dynamodb.AttributeValue
+}
+
+func newFakeDynamoDB() *fakeDynamoDB {
+	return &fakeDynamoDB{items: map[string]map[string]*dynamodb.AttributeValue{}}
+}
+
+func (f *fakeDynamoDB) check(name string, condition *string, values map[string]*dynamodb.AttributeValue) error {
+	item, ok := f.items[name]
+	lease := &Lease{}
+	if ok {
+		if err := dynamodbattribute.UnmarshalMap(item, lease); err != nil {
+			return err
+		}
+	}
+	holds := ok && lease.Holder == *values[":holder"].S && lease.Nonce == *values[":nonce"].S
+	var passed bool
+	switch aws.StringValue(condition) {
+	case acquireCondition:
+		now, err := strconv.ParseInt(*values[":now"].N, 10, 64)
+		if err != nil {
+			return err
+		}
+		passed = !ok || (!lease.Done && (lease.Expires.Unix() < now || holds))
+	case holdCondition:
+		passed = holds
+	default:
+		return fmt.Errorf("unexpected condition %q", aws.StringValue(condition))
+	}
+	if !passed {
+		return awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "failed", nil)
+	}
+	return nil
+}
+
+func (f *fakeDynamoDB) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return &dynamodb.GetItemOutput{Item: f.items[*input.Key["name"].S]}, nil
+}
+
+func (f *fakeDynamoDB) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	name := *input.Item["name"].S
+	if err := f.check(name, input.ConditionExpression, input.ExpressionAttributeValues); err != nil {
+		return nil, err
+	}
+	f.items[name] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeDynamoDB) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	name := *input.Key["name"].S
+	if err := f.check(name, input.ConditionExpression, input.ExpressionAttributeValues); err != nil {
+		return nil, err
+	}
+	f.items[name]["expires"] = input.ExpressionAttributeValues[":expires"]
+	f.items[name]["done"] = input.ExpressionAttributeValues[":done"]
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (f *fakeDynamoDB) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	name := *input.Key["name"].S
+	if err := f.check(name, input.ConditionExpression, input.ExpressionAttributeValues); err != nil {
+		return nil, err
+	}
+	delete(f.items, name)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func newTestElector(t *testing.T, client dynamodbiface.DynamoDBAPI, holder string, now time.Time) *Elector {
+	elector, err := NewElector(client, "prod", "addons", holder, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	elector.now = func() time.Time { return now }
+	return elector
+}
+
+func TestTryAcquire(t *testing.T) {
+	client := newFakeDynamoDB()
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	first := newTestElector(t, client, "i-1", now)
+	second := newTestElector(t, client, "i-2", now)
+
+	acquired, _, err := first.TryAcquire()
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+	assert.Contains(t, client.items, "addons")
+	assert.Equal(t, "prod-leader", first.table)
+
+	acquired, lease, err := second.TryAcquire()
+	assert.NoError(t, err)
+	assert.False(t, acquired)
+	assert.Equal(t, "i-1", lease.Holder)
+
+	// The first holder is gone and its lease has expired.
+	second.now = func() time.Time { return now.Add(2 * time.Minute) }
+	acquired, _, err = second.TryAcquire()
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+
+	assert.Equal(t, ErrLost, first.Renew())
+	assert.NoError(t, second.Renew())
+
+	// Both take over the expired lease at once, and only one wins.
+	third := newTestElector(t, client, "i-3", now.Add(4*time.Minute))
+	first.now = third.now
+	acquired, _, err = third.TryAcquire()
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+	acquired, lease, err = first.TryAcquire()
+	assert.NoError(t, err)
+	assert.False(t, acquired)
+	assert.Equal(t, "i-3", lease.Holder)
+	assert.Equal(t, ErrLost, second.Renew())
+	assert.NoError(t, third.Release())
+	second.now = third.now
+	acquired, _, err = second.TryAcquire()
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+
+	assert.NoError(t, first.Release())
+	assert.Contains(t, client.items, "addons")
+	assert.NoError(t, second.MarkDone())
+
+	// A lease marked done never expires.
+	first.now = func() time.Time { return now.Add(time.Hour) }
+	assert.Equal(t, ErrLost, first.MarkDone())
+	acquired, lease, err = first.TryAcquire()
+	assert.NoError(t, err)
+	assert.False(t, acquired)
+	assert.True(t, lease.Done)
+}
+
+func TestRun(t *testing.T) {
+	client := newFakeDynamoDB()
+	now := time.Now()
+	fake := runner.NewFake(map[string]*runner.Result{
+		"kubectl apply -f addons.yaml": {},
+		"false":                        {ExitStatus: 1},
+	})
+	Runner = fake
+	defer func() { Runner = &runner.Exec{} }()
+	ctx := context.Background()
+
+	failing := newTestElector(t, client, "i-1", now)
+	err := failing.Run(ctx, []string{"false"}, true, time.Second)
+	assert.Error(t, err)
+	assert.NotContains(t, client.items, "addons")
+
+	first := newTestElector(t, client, "i-1", now)
+	err = first.Run(ctx, []string{"kubectl", "apply", "-f", "addons.yaml"}, true, time.Second)
+	assert.NoError(t, err)
+
+	second := newTestElector(t, client, "i-2", now)
+	err = second.Run(ctx, []string{"kubectl", "apply", "-f", "addons.yaml"}, true, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"false", "kubectl apply -f addons.yaml"}, fake.Calls)
+
+	repeated := newTestElector(t, client, "i-2", now)
+	repeated.name = "repeated"
+	err = repeated.Run(ctx, []string{"kubectl", "apply", "-f", "addons.yaml"}, false, time.Second)
+	assert.NoError(t, err)
+	assert.NotContains(t, client.items, "repeated")
+
+	// A lease marked done is never released, so waiting for it is pointless.
+	notOnce := newTestElector(t, client, "i-2", now)
+	started := time.Now()
+	err = notOnce.Run(ctx, []string{"kubectl", "apply", "-f", "addons.yaml"}, false, time.Minute)
+	assert.EqualError(t, err, "Lease addons is marked done by a run with --once")
+	assert.Less(t, time.Since(started), time.Second)
+	assert.Len(t, fake.Calls, 3)
+}
+
+func TestRunLosesLease(t *testing.T) {
+	client := newFakeDynamoDB()
+	elector, err := NewElector(client, "prod", "addons", "i-1", 30*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Runner = &runner.Exec{}
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		client.mutex.Lock()
+		client.items["addons"]["holder"] = &dynamodb.AttributeValue{S: aws.String("i-2")}
+		client.mutex.Unlock()
+	}()
+	err = elector.Run(context.Background(), []string{"sleep", "5"}, true, time.Second)
+	assert.True(t, errors.Is(err, ErrLost))
+}
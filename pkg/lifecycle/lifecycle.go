@@ -0,0 +1,177 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/cloudboss/keights/pkg/helpers"
+	"github.com/cloudboss/keights/pkg/logging"
+	"github.com/cloudboss/keights/pkg/readiness"
+)
+
+const (
+	ActionComplete  = "complete"
+	ActionHeartbeat = "heartbeat"
+	ActionAbandon   = "abandon"
+
+	ResultContinue = "CONTINUE"
+	ResultAbandon  = "ABANDON"
+
+	launchingTransition = "autoscaling:EC2_INSTANCE_LAUNCHING"
+)
+
+type Lifecycler struct {
+	autoscaling autoscalingiface.AutoScalingAPI
+	asgName     string
+	hookName    string
+	token       string
+	instanceID  string
+}
+
+func NewLifecycler(client autoscalingiface.AutoScalingAPI, asgName, hookName, token, instanceID string) *Lifecycler {
+	return &Lifecycler{
+		autoscaling: client,
+		asgName:     asgName,
+		hookName:    hookName,
+		token:       token,
+		instanceID:  instanceID,
+	}
+}
+
+// FindHook looks up the name of the launch lifecycle hook on the autoscaling
+// group when it was not given explicitly. It is an error if there is not
+// exactly one such hook, since there is no way to choose between them.
+func (l *Lifecycler) FindHook() error {
+	if l.hookName != "" {
+		return nil
+	}
+	output, err := l.autoscaling.DescribeLifecycleHooks(&autoscaling.DescribeLifecycleHooksInput{
+		AutoScalingGroupName: aws.String(l.asgName),
+	})
+	if err != nil {
+		return err
+	}
+	hookNames := []string{}
+	for _, hook := range output.LifecycleHooks {
+		if aws.StringValue(hook.LifecycleTransition) == launchingTransition {
+			hookNames = append(hookNames, aws.StringValue(hook.LifecycleHookName))
+		}
+	}
+	if len(hookNames) != 1 {
+		return fmt.Errorf("expected 1 launch lifecycle hook on %s, found %d", l.asgName, len(hookNames))
+	}
+	l.hookName = hookNames[0]
+	return nil
+}
+
+func (l *Lifecycler) Complete(result string) error {
+	input := &autoscaling.CompleteLifecycleActionInput{
+		AutoScalingGroupName:  aws.String(l.asgName),
+		LifecycleHookName:     aws.String(l.hookName),
+		LifecycleActionResult: aws.String(result),
+	}
+	// The token identifies the lifecycle action directly; without it,
+	// AWS finds the action by instance ID.
+	if l.token != "" {
+		input.LifecycleActionToken = aws.String(l.token)
+	} else {
+		input.InstanceId = aws.String(l.instanceID)
+	}
+	_, err := l.autoscaling.CompleteLifecycleAction(input)
+	return err
+}
+
+func (l *Lifecycler) Heartbeat() error {
+	input := &autoscaling.RecordLifecycleActionHeartbeatInput{
+		AutoScalingGroupName: aws.String(l.asgName),
+		LifecycleHookName:    aws.String(l.hookName),
+	}
+	if l.token != "" {
+		input.LifecycleActionToken = aws.String(l.token)
+	} else {
+		input.InstanceId = aws.String(l.instanceID)
+	}
+	_, err := l.autoscaling.RecordLifecycleActionHeartbeat(input)
+	return err
+}
+
+// CompleteWhenReady waits for the readiness gates to pass, recording a
+// heartbeat every interval so the lifecycle action does not time out,
+// then completes the action with a result of CONTINUE.
+func (l *Lifecycler) CompleteWhenReady(ctx context.Context, gates *readiness.Gates, interval, timeout time.Duration) error {
+	lastHeartbeat := time.Now()
+	err := helpers.WaitFor(ctx, timeout, func() error {
+		err := gates.Ready()
+		if err == nil {
+			return nil
+		}
+		if time.Since(lastHeartbeat) >= interval {
+			logging.Info("Not ready, recording heartbeat", "reason", err)
+			if hbErr := l.Heartbeat(); hbErr != nil {
+				return hbErr
+			}
+			lastHeartbeat = time.Now()
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return l.Complete(ResultContinue)
+}
+
+func DoIt(ctx context.Context, action, hookName, token string, gates *readiness.Gates, heartbeatMinutes, minutes int) error {
+	sess := session.New()
+	asgName, err := helpers.AsgName(sess)
+	if err != nil {
+		return err
+	}
+	instanceID, err := helpers.MyID()
+	if err != nil {
+		return err
+	}
+	logging.AddFields("instance", instanceID, "asg", *asgName)
+	lifecycler := NewLifecycler(autoscaling.New(sess), *asgName, hookName, token, instanceID)
+	if err = lifecycler.FindHook(); err != nil {
+		return err
+	}
+	switch action {
+	case ActionComplete:
+		if gates.Empty() {
+			return lifecycler.Complete(ResultContinue)
+		}
+		interval := time.Duration(heartbeatMinutes) * time.Minute
+		timeout := time.Duration(minutes) * time.Minute
+		return lifecycler.CompleteWhenReady(ctx, gates, interval, timeout)
+	case ActionHeartbeat:
+		return lifecycler.Heartbeat()
+	case ActionAbandon:
+		return lifecycler.Complete(ResultAbandon)
+	}
+	return fmt.Errorf("unknown lifecycle action %s", action)
+}
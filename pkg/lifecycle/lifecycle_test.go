@@ -0,0 +1,230 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/cloudboss/keights/pkg/readiness"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeAutoScaling records the lifecycle actions it receives.
+type fakeAutoScaling struct {
+	autoscalingiface.AutoScalingAPI
+	hooks      []*autoscaling.LifecycleHook
+	err        error
+	completes  []*autoscaling.CompleteLifecycleActionInput
+	heartbeats []*autoscaling.RecordLifecycleActionHeartbeatInput
+}
+
+func (f *fakeAutoScaling) DescribeLifecycleHooks(
+	input *autoscaling.DescribeLifecycleHooksInput) (*autoscaling.DescribeLifecycleHooksOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &autoscaling.DescribeLifecycleHooksOutput{LifecycleHooks: f.hooks}, nil
+}
+
+func (f *fakeAutoScaling) CompleteLifecycleAction(
+	input *autoscaling.CompleteLifecycleActionInput) (*autoscaling.CompleteLifecycleActionOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.completes = append(f.completes, input)
+	return &autoscaling.CompleteLifecycleActionOutput{}, nil
+}
+
+func (f *fakeAutoScaling) RecordLifecycleActionHeartbeat(
+	input *autoscaling.RecordLifecycleActionHeartbeatInput) (*autoscaling.RecordLifecycleActionHeartbeatOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.heartbeats = append(f.heartbeats, input)
+	return &autoscaling.RecordLifecycleActionHeartbeatOutput{}, nil
+}
+
+func hook(name, transition string) *autoscaling.LifecycleHook {
+	return &autoscaling.LifecycleHook{
+		LifecycleHookName:   aws.String(name),
+		LifecycleTransition: aws.String(transition),
+	}
+}
+
+func TestFindHook(t *testing.T) {
+	terminating := "autoscaling:EC2_INSTANCE_TERMINATING"
+	var testCases = []struct {
+		name     string
+		hookName string
+		hooks    []*autoscaling.LifecycleHook
+		err      error
+		expected string
+		errMsg   string
+	}{
+		{
+			"given",
+			"mine",
+			nil,
+			errors.New("should not be called"),
+			"mine",
+			"",
+		},
+		{
+			"one-launch-hook",
+			"",
+			[]*autoscaling.LifecycleHook{hook("launch", launchingTransition), hook("term", terminating)},
+			nil,
+			"launch",
+			"",
+		},
+		{
+			"no-launch-hook",
+			"",
+			[]*autoscaling.LifecycleHook{hook("term", terminating)},
+			nil,
+			"",
+			"expected 1 launch lifecycle hook on asg, found 0",
+		},
+		{
+			"two-launch-hooks",
+			"",
+			[]*autoscaling.LifecycleHook{hook("a", launchingTransition), hook("b", launchingTransition)},
+			nil,
+			"",
+			"expected 1 launch lifecycle hook on asg, found 2",
+		},
+		{
+			"describe-error",
+			"",
+			nil,
+			errors.New("throttled"),
+			"",
+			"throttled",
+		},
+	}
+	for _, tc := range testCases {
+		client := &fakeAutoScaling{hooks: tc.hooks, err: tc.err}
+		lifecycler := NewLifecycler(client, "asg", tc.hookName, "", "i-1")
+		err := lifecycler.FindHook()
+		if tc.errMsg == "" {
+			assert.NoError(t, err, tc.name)
+			assert.Equal(t, tc.expected, lifecycler.hookName, tc.name)
+		} else {
+			assert.EqualError(t, err, tc.errMsg, tc.name)
+		}
+	}
+}
+
+func TestCompleteAndHeartbeat(t *testing.T) {
+	var testCases = []struct {
+		name       string
+		token      string
+		err        error
+		instanceID *string
+		tokenValue *string
+		errMsg     string
+	}{
+		{
+			"by-token",
+			"tok",
+			nil,
+			nil,
+			aws.String("tok"),
+			"",
+		},
+		{
+			"by-instance",
+			"",
+			nil,
+			aws.String("i-1"),
+			nil,
+			"",
+		},
+		{
+			"error",
+			"",
+			errors.New("no active lifecycle action"),
+			nil,
+			nil,
+			"no active lifecycle action",
+		},
+	}
+	for _, tc := range testCases {
+		client := &fakeAutoScaling{err: tc.err}
+		lifecycler := NewLifecycler(client, "asg", "launch", tc.token, "i-1")
+
+		err := lifecycler.Complete(ResultAbandon)
+		if tc.errMsg != "" {
+			assert.EqualError(t, err, tc.errMsg, tc.name)
+			assert.EqualError(t, lifecycler.Heartbeat(), tc.errMsg, tc.name)
+			continue
+		}
+		assert.NoError(t, err, tc.name)
+		assert.NoError(t, lifecycler.Heartbeat(), tc.name)
+
+		assert.Len(t, client.completes, 1, tc.name)
+		complete := client.completes[0]
+		assert.Equal(t, "asg", *complete.AutoScalingGroupName, tc.name)
+		assert.Equal(t, "launch", *complete.LifecycleHookName, tc.name)
+		assert.Equal(t, ResultAbandon, *complete.LifecycleActionResult, tc.name)
+		assert.Equal(t, tc.instanceID, complete.InstanceId, tc.name)
+		assert.Equal(t, tc.tokenValue, complete.LifecycleActionToken, tc.name)
+
+		assert.Len(t, client.heartbeats, 1, tc.name)
+		heartbeat := client.heartbeats[0]
+		assert.Equal(t, "launch", *heartbeat.LifecycleHookName, tc.name)
+		assert.Equal(t, tc.instanceID, heartbeat.InstanceId, tc.name)
+		assert.Equal(t, tc.tokenValue, heartbeat.LifecycleActionToken, tc.name)
+	}
+}
+
+func TestCompleteWhenReady(t *testing.T) {
+	absent := filepath.Join(t.TempDir(), "absent")
+
+	client := &fakeAutoScaling{}
+	lifecycler := NewLifecycler(client, "asg", "launch", "", "i-1")
+	err := lifecycler.CompleteWhenReady(context.Background(), &readiness.Gates{}, 0, time.Second)
+	assert.NoError(t, err)
+	assert.Len(t, client.completes, 1)
+	assert.Equal(t, ResultContinue, *client.completes[0].LifecycleActionResult)
+	assert.Empty(t, client.heartbeats)
+
+	client = &fakeAutoScaling{}
+	lifecycler = NewLifecycler(client, "asg", "launch", "", "i-1")
+	gates := &readiness.Gates{Files: []string{absent}}
+	err = lifecycler.CompleteWhenReady(context.Background(), gates, 0, 100*time.Millisecond)
+	assert.EqualError(t, err, fmt.Sprintf("Timed out waiting: file %s not present", absent))
+	assert.Len(t, client.heartbeats, 1)
+	assert.Empty(t, client.completes)
+
+	client = &fakeAutoScaling{err: errors.New("throttled")}
+	lifecycler = NewLifecycler(client, "asg", "launch", "", "i-1")
+	err = lifecycler.CompleteWhenReady(context.Background(), gates, 0, 100*time.Millisecond)
+	assert.EqualError(t, err, "Timed out waiting: throttled")
+}
@@ -0,0 +1,374 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package logging provides leveled, structured logging shared by the
+// keights commands and the stackbot Lambda handlers. Entries are written
+// as logfmt style text or as JSON, so they can be queried in journald and
+// CloudWatch. Values of fields with sensitive names are redacted.
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+
+	// Redacted replaces the values of sensitive fields.
+	Redacted = "[REDACTED]"
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+func ParseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	if strings.EqualFold(name, "warning") {
+		return LevelWarn, nil
+	}
+	return LevelInfo, fmt.Errorf("Unknown log level %s, expected one of debug, info, warn, error", name)
+}
+
+// sensitiveKeys are substrings of field names whose values are redacted.
+var sensitiveKeys = []string{
+	"key",
+	"password",
+	"secret",
+	"token",
+	"credential",
+	"content",
+}
+
+// Sensitive returns whether a field named key holds a secret.
+func Sensitive(key string) bool {
+	lower := strings.ToLower(key)
+	// Names of things that are not themselves secret.
+	if strings.HasSuffix(lower, "path") || strings.HasSuffix(lower, "id") ||
+		strings.HasSuffix(lower, "arn") || strings.HasSuffix(lower, "name") {
+		return false
+	}
+	for _, sensitive := range sensitiveKeys {
+		if strings.Contains(lower, sensitive) {
+			return true
+		}
+	}
+	return false
+}
+
+// Secret is a string that is always logged as Redacted, whatever the name
+// of its field.
+type Secret string
+
+func (s Secret) String() string {
+	return Redacted
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(Redacted)
+}
+
+// redact returns value with sensitive fields redacted, looking inside maps
+// such as the resource properties of CloudFormation events.
+func redact(key string, value interface{}) interface{} {
+	if key != "" && Sensitive(key) {
+		return Redacted
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			redacted[k] = redact(k, val)
+		}
+		return redacted
+	case map[string]string:
+		redacted := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			redacted[k] = redact(k, val)
+		}
+		return redacted
+	case string:
+		if strings.Contains(v, "PRIVATE KEY-----") {
+			return Redacted
+		}
+	case error:
+		return v.Error()
+	}
+	return value
+}
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+type Logger struct {
+	mutex  *sync.Mutex
+	out    io.Writer
+	level  Level
+	format string
+	fields []field
+	now    func() time.Time
+}
+
+func New(out io.Writer, level Level, format string) (*Logger, error) {
+	if format != FormatText && format != FormatJSON {
+		return nil, fmt.Errorf("Unknown log format %s, expected %s or %s", format, FormatText, FormatJSON)
+	}
+	return &Logger{
+		mutex:  &sync.Mutex{},
+		out:    out,
+		level:  level,
+		format: format,
+		now:    time.Now,
+	}, nil
+}
+
+// toFields pairs up alternating keys and values. A key without a value is
+// logged with an empty one.
+func toFields(keyvals []interface{}) []field {
+	fields := make([]field, 0, (len(keyvals)+1)/2)
+	for i := 0; i < len(keyvals); i += 2 {
+		key := fmt.Sprint(keyvals[i])
+		var value interface{}
+		if i+1 < len(keyvals) {
+			value = keyvals[i+1]
+		}
+		fields = append(fields, field{key, redact(key, value)})
+	}
+	return fields
+}
+
+// With returns a logger that adds the given key value pairs to every entry,
+// replacing any fields already present with the same keys.
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	added := toFields(keyvals)
+	replaced := map[string]bool{}
+	for _, f := range added {
+		replaced[f.key] = true
+	}
+	child := *l
+	child.fields = []field{}
+	for _, f := range l.fields {
+		if !replaced[f.key] {
+			child.fields = append(child.fields, f)
+		}
+	}
+	child.fields = append(child.fields, added...)
+	return &child
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+func (l *Logger) Debug(msg string, keyvals ...interface{}) { l.log(LevelDebug, msg, keyvals) }
+func (l *Logger) Info(msg string, keyvals ...interface{})  { l.log(LevelInfo, msg, keyvals) }
+func (l *Logger) Warn(msg string, keyvals ...interface{})  { l.log(LevelWarn, msg, keyvals) }
+func (l *Logger) Error(msg string, keyvals ...interface{}) { l.log(LevelError, msg, keyvals) }
+
+func (l *Logger) log(level Level, msg string, keyvals []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	fields := []field{
+		{"time", l.now().UTC().Format(time.RFC3339)},
+		{"level", level.String()},
+		{"msg", msg},
+	}
+	fields = append(fields, l.fields...)
+	fields = append(fields, toFields(keyvals)...)
+	var line []byte
+	if l.format == FormatJSON {
+		line = encodeJSON(fields)
+	} else {
+		line = encodeText(fields)
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.out.Write(append(line, '\n'))
+}
+
+func encodeJSON(fields []field) []byte {
+	var b strings.Builder
+	b.WriteString("{")
+	for i, f := range fields {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		key, _ := json.Marshal(f.key)
+		b.Write(key)
+		b.WriteString(":")
+		value, err := json.Marshal(f.value)
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(f.value))
+		}
+		b.Write(value)
+	}
+	b.WriteString("}")
+	return []byte(b.String())
+}
+
+func encodeText(fields []field) []byte {
+	parts := make([]string, 0, len(fields))
+	for _, f := range fields {
+		parts = append(parts, fmt.Sprintf("%s=%s", f.key, textValue(f.value)))
+	}
+	return []byte(strings.Join(parts, " "))
+}
+
+func textValue(value interface{}) string {
+	var s string
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		s = v
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		pairs := make([]string, 0, len(keys))
+		for _, k := range keys {
+			pairs = append(pairs, fmt.Sprintf("%s:%v", k, v[k]))
+		}
+		s = "{" + strings.Join(pairs, " ") + "}"
+	default:
+		s = fmt.Sprint(v)
+	}
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+var std, _ = New(os.Stderr, LevelInfo, FormatText)
+
+// Configure sets the level and format of the default logger.
+func Configure(levelName, format string) error {
+	level, err := ParseLevel(levelName)
+	if err != nil {
+		return err
+	}
+	logger, err := New(os.Stderr, level, format)
+	if err != nil {
+		return err
+	}
+	logger.fields = std.fields
+	std = logger
+	return nil
+}
+
+// ConfigureFromEnv configures the default logger from KEIGHTS_LOG_LEVEL and
+// KEIGHTS_LOG_FORMAT, defaulting to info and JSON, as for Lambda handlers.
+// Invalid settings are logged and the defaults are used instead.
+func ConfigureFromEnv() {
+	level := os.Getenv("KEIGHTS_LOG_LEVEL")
+	if level == "" {
+		level = LevelInfo.String()
+	}
+	format := os.Getenv("KEIGHTS_LOG_FORMAT")
+	if format == "" {
+		format = FormatJSON
+	}
+	if err := Configure(level, format); err != nil {
+		Configure(LevelInfo.String(), FormatJSON)
+		Warn("Invalid logging configuration", "error", err)
+	}
+}
+
+// AddFields adds key value pairs to every entry of the default logger, such
+// as the cluster and instance ID once they are known.
+func AddFields(keyvals ...interface{}) {
+	std = std.With(keyvals...)
+}
+
+func Default() *Logger {
+	return std
+}
+
+func With(keyvals ...interface{}) *Logger {
+	return std.With(keyvals...)
+}
+
+func Debug(msg string, keyvals ...interface{}) { std.log(LevelDebug, msg, keyvals) }
+func Info(msg string, keyvals ...interface{})  { std.log(LevelInfo, msg, keyvals) }
+func Warn(msg string, keyvals ...interface{})  { std.log(LevelWarn, msg, keyvals) }
+func Error(msg string, keyvals ...interface{}) { std.log(LevelError, msg, keyvals) }
+
+type lineWriter struct {
+	logger  *Logger
+	level   Level
+	pending []byte
+}
+
+// Write logs each complete line written as a separate entry, holding back
+// any partial line until it is completed.
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.pending = append(w.pending, p...)
+	for {
+		i := strings.IndexByte(string(w.pending), '\n')
+		if i < 0 {
+			break
+		}
+		if line := strings.TrimRight(string(w.pending[:i]), "\r"); line != "" {
+			w.logger.log(w.level, line, nil)
+		}
+		w.pending = w.pending[i+1:]
+	}
+	return len(p), nil
+}
+
+// Writer returns a writer that logs each line written to it at level, for
+// streaming the output of external commands.
+func (l *Logger) Writer(level Level) io.Writer {
+	return &lineWriter{logger: l, level: level}
+}
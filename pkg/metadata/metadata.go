@@ -0,0 +1,243 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package metadata provides the identity of the instance keights runs on,
+// from the EC2 instance metadata service, or from a file or the environment
+// when running outside EC2, such as in a local VM or container.
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+const (
+	SourceIMDS = "imds"
+	SourceFile = "file"
+	SourceEnv  = "env"
+
+	DefaultFile = "/etc/keights/metadata.json"
+
+	EnvInstanceID       = "KEIGHTS_INSTANCE_ID"
+	EnvPrivateIP        = "KEIGHTS_PRIVATE_IP"
+	EnvAvailabilityZone = "KEIGHTS_AVAILABILITY_ZONE"
+	EnvRegion           = "KEIGHTS_REGION"
+	EnvAccountID        = "KEIGHTS_ACCOUNT_ID"
+	EnvHostname         = "KEIGHTS_HOSTNAME"
+
+	EnvTargetLifecycleState = "KEIGHTS_TARGET_LIFECYCLE_STATE"
+)
+
+type Identity struct {
+	InstanceID       string `json:"instanceId"`
+	PrivateIP        string `json:"privateIp"`
+	AvailabilityZone string `json:"availabilityZone"`
+	Region           string `json:"region"`
+	AccountID        string `json:"accountId"`
+	Hostname         string `json:"hostname"`
+}
+
+type Provider interface {
+	Identity() (*Identity, error)
+
+	// TargetLifecycleState returns the state the instance's autoscaling
+	// group is moving it to, such as InService or Terminated.
+	TargetLifecycleState(ctx context.Context) (string, error)
+}
+
+// IMDS gets the identity from the EC2 instance identity document.
+type IMDS struct{}
+
+func (i *IMDS) Identity() (*Identity, error) {
+	client := ec2metadata.New(session.New())
+	document, err := client.GetInstanceIdentityDocument()
+	if err != nil {
+		return nil, err
+	}
+	hostname, err := client.GetMetadata("local-hostname")
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{
+		InstanceID:       document.InstanceID,
+		PrivateIP:        document.PrivateIP,
+		AvailabilityZone: document.AvailabilityZone,
+		Region:           document.Region,
+		AccountID:        document.AccountID,
+		Hostname:         hostname,
+	}, nil
+}
+
+func (i *IMDS) TargetLifecycleState(ctx context.Context) (string, error) {
+	client := ec2metadata.New(session.New())
+	return client.GetMetadataWithContext(ctx, "autoscaling/target-lifecycle-state")
+}
+
+// File gets the identity from a JSON file with the fields of Identity,
+// and the target lifecycle state from its targetLifecycleState field.
+type File struct {
+	Path string
+}
+
+func (f *File) Identity() (*Identity, error) {
+	identity := &Identity{}
+	if err := f.read(identity); err != nil {
+		return nil, err
+	}
+	if err := identity.validate(); err != nil {
+		return nil, fmt.Errorf("Invalid metadata file %s: %v", f.Path, err)
+	}
+	return identity, nil
+}
+
+func (f *File) TargetLifecycleState(ctx context.Context) (string, error) {
+	var lifecycle struct {
+		TargetLifecycleState string `json:"targetLifecycleState"`
+	}
+	if err := f.read(&lifecycle); err != nil {
+		return "", err
+	}
+	if lifecycle.TargetLifecycleState == "" {
+		return "", fmt.Errorf("No targetLifecycleState in metadata file %s", f.Path)
+	}
+	return lifecycle.TargetLifecycleState, nil
+}
+
+func (f *File) read(v interface{}) error {
+	contents, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(contents, v); err != nil {
+		return fmt.Errorf("Invalid metadata file %s: %v", f.Path, err)
+	}
+	return nil
+}
+
+// Env gets the identity and target lifecycle state from KEIGHTS_*
+// environment variables.
+type Env struct{}
+
+func (e *Env) Identity() (*Identity, error) {
+	identity := &Identity{
+		InstanceID:       os.Getenv(EnvInstanceID),
+		PrivateIP:        os.Getenv(EnvPrivateIP),
+		AvailabilityZone: os.Getenv(EnvAvailabilityZone),
+		Region:           os.Getenv(EnvRegion),
+		AccountID:        os.Getenv(EnvAccountID),
+		Hostname:         os.Getenv(EnvHostname),
+	}
+	if err := identity.validate(); err != nil {
+		return nil, fmt.Errorf("Invalid metadata environment: %v", err)
+	}
+	return identity, nil
+}
+
+func (e *Env) TargetLifecycleState(ctx context.Context) (string, error) {
+	state := os.Getenv(EnvTargetLifecycleState)
+	if state == "" {
+		return "", fmt.Errorf("%s is not set", EnvTargetLifecycleState)
+	}
+	return state, nil
+}
+
+// validate checks for the fields without which the commands cannot run. The
+// region is derived from the availability zone if it is missing, and the
+// hostname is that of the system if it is missing.
+func (i *Identity) validate() error {
+	missing := []string{}
+	if i.InstanceID == "" {
+		missing = append(missing, "instanceId")
+	}
+	if i.PrivateIP == "" {
+		missing = append(missing, "privateIp")
+	}
+	if i.AvailabilityZone == "" {
+		missing = append(missing, "availabilityZone")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing %s", strings.Join(missing, ", "))
+	}
+	if i.Region == "" {
+		i.Region = strings.TrimRight(i.AvailabilityZone, "abcdefghijklmnopqrstuvwxyz")
+	}
+	if i.Hostname == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		i.Hostname = hostname
+	}
+	return nil
+}
+
+// New returns the provider for source. The path is used only by the file
+// provider, and defaults to DefaultFile.
+func New(source, path string) (Provider, error) {
+	switch source {
+	case "", SourceIMDS:
+		return &IMDS{}, nil
+	case SourceFile:
+		if path == "" {
+			path = DefaultFile
+		}
+		return &File{Path: path}, nil
+	case SourceEnv:
+		return &Env{}, nil
+	}
+	return nil, fmt.Errorf("Unknown metadata source %s, expected one of %s, %s, %s",
+		source, SourceIMDS, SourceFile, SourceEnv)
+}
+
+var current Provider = &IMDS{}
+
+// Configure sets the provider used by Get.
+func Configure(source, path string) error {
+	provider, err := New(source, path)
+	if err != nil {
+		return err
+	}
+	current = provider
+	return nil
+}
+
+// Current returns the provider used by Get.
+func Current() Provider {
+	return current
+}
+
+// Get returns the identity from the configured provider, the instance
+// metadata service unless Configure has been called.
+func Get() (*Identity, error) {
+	return current.Identity()
+}
+
+// TargetLifecycleState returns the target lifecycle state from the
+// configured provider.
+func TargetLifecycleState(ctx context.Context) (string, error) {
+	return current.TargetLifecycleState(ctx)
+}
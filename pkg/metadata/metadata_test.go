@@ -0,0 +1,162 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package metadata
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "keights")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	var testCases = []struct {
+		name     string
+		contents string
+		identity *Identity
+		hasError bool
+	}{
+		{
+			"complete",
+			`{"instanceId": "i-0123", "privateIp": "10.0.0.5",
+			  "availabilityZone": "us-east-1a", "region": "us-east-1", "accountId": "123",
+			  "hostname": "ip-10-0-0-5.ec2.internal"}`,
+			&Identity{"i-0123", "10.0.0.5", "us-east-1a", "us-east-1", "123", "ip-10-0-0-5.ec2.internal"},
+			false,
+		},
+		{
+			"region-from-zone",
+			`{"instanceId": "i-0123", "privateIp": "10.0.0.5", "availabilityZone": "eu-west-2b",
+			  "hostname": "dev"}`,
+			&Identity{"i-0123", "10.0.0.5", "eu-west-2b", "eu-west-2", "", "dev"},
+			false,
+		},
+		{
+			"missing-fields",
+			`{"instanceId": "i-0123"}`,
+			nil,
+			true,
+		},
+		{
+			"invalid-json",
+			`{`,
+			nil,
+			true,
+		},
+	}
+	for _, tc := range testCases {
+		path := filepath.Join(tempDir, tc.name)
+		if err = ioutil.WriteFile(path, []byte(tc.contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		identity, err := (&File{Path: path}).Identity()
+		assert.Equal(t, tc.identity, identity, tc.name)
+		assert.Equal(t, tc.hasError, err != nil, tc.name)
+	}
+}
+
+func TestEnv(t *testing.T) {
+	t.Setenv(EnvInstanceID, "i-0123")
+	t.Setenv(EnvPrivateIP, "10.0.0.5")
+	t.Setenv(EnvAvailabilityZone, "us-west-2c")
+	t.Setenv(EnvHostname, "")
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := (&Env{}).Identity()
+	assert.NoError(t, err)
+	assert.Equal(t, &Identity{"i-0123", "10.0.0.5", "us-west-2c", "us-west-2", "", hostname}, identity)
+
+	t.Setenv(EnvPrivateIP, "")
+	_, err = (&Env{}).Identity()
+	assert.EqualError(t, err, "Invalid metadata environment: missing privateIp")
+}
+
+func TestTargetLifecycleState(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "keights")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	var testCases = []struct {
+		name     string
+		contents string
+		state    string
+		hasError bool
+	}{
+		{
+			"terminated",
+			`{"instanceId": "i-0123", "targetLifecycleState": "Terminated"}`,
+			"Terminated",
+			false,
+		},
+		{
+			"not-in-asg",
+			`{"instanceId": "i-0123"}`,
+			"",
+			true,
+		},
+		{
+			"invalid-json",
+			`{`,
+			"",
+			true,
+		},
+	}
+	for _, tc := range testCases {
+		path := filepath.Join(tempDir, tc.name)
+		if err = ioutil.WriteFile(path, []byte(tc.contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		state, err := (&File{Path: path}).TargetLifecycleState(context.Background())
+		assert.Equal(t, tc.state, state, tc.name)
+		assert.Equal(t, tc.hasError, err != nil, tc.name)
+	}
+
+	t.Setenv(EnvTargetLifecycleState, "InService")
+	state, err := (&Env{}).TargetLifecycleState(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "InService", state)
+
+	t.Setenv(EnvTargetLifecycleState, "")
+	_, err = (&Env{}).TargetLifecycleState(context.Background())
+	assert.EqualError(t, err, "KEIGHTS_TARGET_LIFECYCLE_STATE is not set")
+}
+
+func TestNew(t *testing.T) {
+	provider, err := New(SourceFile, "")
+	assert.NoError(t, err)
+	assert.Equal(t, &File{Path: DefaultFile}, provider)
+
+	_, err = New("bogus", "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,101 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package readiness
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Gates are conditions that must hold before a node reports itself as ready,
+// such as the kubeadm initialized marker or a healthy etcd or API endpoint.
+type Gates struct {
+	Files  []string
+	URLs   []string
+	CACert string
+	Cert   string
+	Key    string
+}
+
+func (g *Gates) Empty() bool {
+	return len(g.Files) == 0 && len(g.URLs) == 0
+}
+
+// Ready returns nil if every gate passes, otherwise an error for the first
+// gate that does not.
+func (g *Gates) Ready() error {
+	for _, file := range g.Files {
+		if _, err := os.Stat(file); err != nil {
+			return fmt.Errorf("file %s not present", file)
+		}
+	}
+	if len(g.URLs) == 0 {
+		return nil
+	}
+	// Build the client on each check, since the certificates may not
+	// have been written yet when waiting begins.
+	client, err := g.client()
+	if err != nil {
+		return err
+	}
+	for _, earl := range g.URLs {
+		response, err := client.Get(earl)
+		if err != nil {
+			return err
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s returned %s", earl, response.Status)
+		}
+	}
+	return nil
+}
+
+func (g *Gates) client() (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+	if g.CACert != "" {
+		caCert, err := ioutil.ReadFile(g.CACert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in %s", g.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if g.Cert != "" || g.Key != "" {
+		cert, err := tls.LoadX509KeyPair(g.Cert, g.Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}, nil
+}
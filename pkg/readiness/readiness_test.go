@@ -0,0 +1,101 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package readiness
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReady(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "keights")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	present := filepath.Join(tempDir, "initialized")
+	if err = ioutil.WriteFile(present, []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	absent := filepath.Join(tempDir, "absent")
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer healthy.Close()
+	unhealthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unhealthy.Close()
+
+	var testCases = []struct {
+		name   string
+		gates  Gates
+		errMsg string
+	}{
+		{
+			"no-gates",
+			Gates{},
+			"",
+		},
+		{
+			"file-present",
+			Gates{Files: []string{present}},
+			"",
+		},
+		{
+			"file-absent",
+			Gates{Files: []string{present, absent}},
+			fmt.Sprintf("file %s not present", absent),
+		},
+		{
+			"url-healthy",
+			Gates{Files: []string{present}, URLs: []string{healthy.URL}},
+			"",
+		},
+		{
+			"url-unhealthy",
+			Gates{URLs: []string{healthy.URL, unhealthy.URL}},
+			fmt.Sprintf("%s returned 503 Service Unavailable", unhealthy.URL),
+		},
+		{
+			"missing-cacert",
+			Gates{URLs: []string{healthy.URL}, CACert: absent},
+			fmt.Sprintf("open %s: no such file or directory", absent),
+		},
+	}
+	for _, tc := range testCases {
+		err := tc.gates.Ready()
+		if tc.errMsg == "" {
+			assert.NoError(t, err, tc.name)
+		} else {
+			assert.EqualError(t, err, tc.errMsg, tc.name)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package runner
+
+import (
+	"context"
+	"os/exec"
+	"sync"
+)
+
+// Fake is a Runner that returns canned results for commands, matched by
+// their full command line, and records the commands it is given. A command
+// with no result fails as if it were not found.
+type Fake struct {
+	Results map[string]*Result
+	Calls   []string
+	mutex   sync.Mutex
+}
+
+func NewFake(results map[string]*Result) *Fake {
+	return &Fake{Results: results}
+}
+
+func (f *Fake) Run(ctx context.Context, command *Command) (*Result, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	line := command.String()
+	f.Calls = append(f.Calls, line)
+	if err := ctx.Err(); err != nil {
+		return &Result{}, &ExecError{Command: line, Err: err}
+	}
+	result, ok := f.Results[line]
+	if !ok {
+		return &Result{}, &ExecError{Command: line, Err: exec.ErrNotFound}
+	}
+	if command.Output != nil {
+		command.Output.Write([]byte(result.Stdout + result.Stderr))
+	}
+	return result, nil
+}
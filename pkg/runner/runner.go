@@ -0,0 +1,128 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package runner runs external commands such as blkid, mkfs and systemctl.
+// Commands are run through the Runner interface so that code calling them
+// can be tested with Fake.
+package runner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+type Command struct {
+	Name string
+	Args []string
+	// Env is added to the environment of the current process.
+	Env []string
+	// Timeout is the time after which the command is killed, if nonzero.
+	Timeout time.Duration
+	// Output receives stdout and stderr as they are written, if not nil.
+	Output io.Writer
+}
+
+func (c *Command) String() string {
+	return strings.Join(append([]string{c.Name}, c.Args...), " ")
+}
+
+// Result is the outcome of a command that ran to completion, whether or
+// not it exited successfully.
+type Result struct {
+	ExitStatus int
+	Stdout     string
+	Stderr     string
+}
+
+// ExecError is returned when a command could not be run to completion,
+// because it was not found, could not be started, or was killed by a
+// signal, a timeout or cancellation of its context.
+type ExecError struct {
+	Command string
+	Err     error
+}
+
+func (e *ExecError) Error() string {
+	return fmt.Sprintf("Failed to run %s: %v", e.Command, e.Err)
+}
+
+func (e *ExecError) Unwrap() error {
+	return e.Err
+}
+
+type Runner interface {
+	Run(ctx context.Context, command *Command) (*Result, error)
+}
+
+// Exec runs commands as child processes.
+type Exec struct{}
+
+func (e *Exec) Run(ctx context.Context, command *Command) (*Result, error) {
+	if command.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, command.Timeout)
+		defer cancel()
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command.Name, command.Args...)
+	if len(command.Env) > 0 {
+		cmd.Env = append(os.Environ(), command.Env...)
+	}
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if command.Output != nil {
+		cmd.Stdout = io.MultiWriter(&stdout, command.Output)
+		cmd.Stderr = io.MultiWriter(&stderr, command.Output)
+	}
+	err := cmd.Run()
+	result := &Result{Stdout: stdout.String(), Stderr: stderr.String()}
+	if err == nil {
+		return result, nil
+	}
+	if ctx.Err() != nil {
+		return result, &ExecError{Command: command.String(), Err: ctx.Err()}
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() >= 0 {
+		result.ExitStatus = exitErr.ExitCode()
+		return result, nil
+	}
+	return result, &ExecError{Command: command.String(), Err: err}
+}
+
+// Run runs a command with runner, returning an error if it cannot be run
+// to completion or exits unsuccessfully. The error for an unsuccessful
+// exit is the command's stderr.
+func Run(ctx context.Context, runner Runner, command *Command) (*Result, error) {
+	result, err := runner.Run(ctx, command)
+	if err != nil {
+		return result, err
+	}
+	if result.ExitStatus != 0 {
+		return result, fmt.Errorf("%s exited with status %d: %s", command.Name,
+			result.ExitStatus, strings.TrimSpace(result.Stderr))
+	}
+	return result, nil
+}
@@ -0,0 +1,81 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package runner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExec(t *testing.T) {
+	runner := &Exec{}
+	ctx := context.Background()
+
+	result, err := runner.Run(ctx, &Command{Name: "sh", Args: []string{"-c", "echo out; echo err >&2; exit 3"}})
+	assert.NoError(t, err)
+	assert.Equal(t, &Result{ExitStatus: 3, Stdout: "out\n", Stderr: "err\n"}, result)
+
+	var output bytes.Buffer
+	result, err = runner.Run(ctx, &Command{
+		Name:   "sh",
+		Args:   []string{"-c", "echo $GREETING"},
+		Env:    []string{"GREETING=hello"},
+		Output: &output,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "hello\n", result.Stdout)
+	assert.Equal(t, "hello\n", output.String())
+
+	_, err = runner.Run(ctx, &Command{Name: "keights-no-such-command"})
+	var execErr *ExecError
+	assert.True(t, errors.As(err, &execErr))
+	assert.True(t, errors.Is(err, exec.ErrNotFound))
+
+	_, err = runner.Run(ctx, &Command{Name: "sleep", Args: []string{"5"}, Timeout: 10 * time.Millisecond})
+	assert.True(t, errors.As(err, &execErr))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestRun(t *testing.T) {
+	fake := NewFake(map[string]*Result{
+		"blkid -o value /dev/xvdg": {Stdout: "ext4\n"},
+		"mkfs -t ext4 /dev/xvdg":   {ExitStatus: 1, Stderr: "mkfs failed\n"},
+	})
+	ctx := context.Background()
+
+	result, err := Run(ctx, fake, &Command{Name: "blkid", Args: []string{"-o", "value", "/dev/xvdg"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "ext4\n", result.Stdout)
+
+	_, err = Run(ctx, fake, &Command{Name: "mkfs", Args: []string{"-t", "ext4", "/dev/xvdg"}})
+	assert.EqualError(t, err, "mkfs exited with status 1: mkfs failed")
+
+	_, err = Run(ctx, fake, &Command{Name: "mount"})
+	assert.True(t, errors.Is(err, exec.ErrNotFound))
+
+	assert.Equal(t, []string{"blkid -o value /dev/xvdg", "mkfs -t ext4 /dev/xvdg", "mount"}, fake.Calls)
+}
@@ -22,15 +22,18 @@ package signal
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/cloudboss/keights/pkg/helpers"
+	"github.com/cloudboss/keights/pkg/logging"
+	"github.com/cloudboss/keights/pkg/readiness"
 )
 
 func constructURL(stackName, status, resource, myID, region string) string {
@@ -79,21 +82,36 @@ func signature() (string, error) {
 	return headerVal, nil
 }
 
-func DoIt(stackName, status, resource string) error {
-	sess := session.New()
+func DoIt(ctx context.Context, stackName, status, resource string, gates *readiness.Gates, minutes int) error {
+	if status == "SUCCESS" && !gates.Empty() {
+		err := helpers.WaitFor(ctx, time.Duration(minutes)*time.Minute, gates.Ready)
+		if err != nil {
+			return err
+		}
+	}
 	// A bit of duplication here, since we call the metadata service to get
 	// the whole document as bytes above but do not parse it for the instance ID.
-	myID, err := helpers.MyID(sess)
+	myID, err := helpers.MyID()
 	if err != nil {
 		return err
 	}
+	logging.AddFields("instance", myID, "stack", stackName)
+	return Signal(stackName, status, resource, myID, os.Getenv("AWS_REGION"))
+}
+
+// Signal sends status to resource in the stack. The uniqueID identifies the
+// signal in the stack's events, and is normally the instance ID.
+func Signal(stackName, status, resource, uniqueID, region string) error {
 	sig, err := signature()
 	if err != nil {
 		return err
 	}
-	earl := constructURL(stackName, status, resource, myID, os.Getenv("AWS_REGION"))
+	earl := constructURL(stackName, status, resource, uniqueID, region)
 	client := http.DefaultClient
 	request, err := http.NewRequest("GET", earl, nil)
+	if err != nil {
+		return err
+	}
 	request.Header.Add("Authorization", sig)
 	response, err := client.Do(request)
 	if err != nil {
@@ -104,6 +122,10 @@ func DoIt(stackName, status, resource string) error {
 	if err != nil {
 		return err
 	}
-	fmt.Println(string(body))
-	return err
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed to signal %s: %s: %s", resource, response.Status, string(body))
+	}
+	logging.Info("Signaled resource", "resource", resource, "status", status,
+		"response", string(body))
+	return nil
 }
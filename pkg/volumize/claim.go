@@ -0,0 +1,206 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package volumize
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/cloudboss/keights/pkg/helpers"
+	"github.com/cloudboss/keights/pkg/logging"
+)
+
+const (
+	// Tags recording which instance has claimed a volume and when.
+	ClaimTag     = "keights:claimed-by"
+	ClaimTimeTag = "keights:claimed-at"
+)
+
+var (
+	// ClaimSettle is how long to wait after claiming a volume before
+	// checking the claim, so that a competing claim made at about the
+	// same time is seen.
+	ClaimSettle = 5 * time.Second
+
+	// ClaimTTL is how long a claim on an unattached volume is honored
+	// when its owner is still running, in case the owner failed after
+	// claiming the volume but before attaching it.
+	ClaimTTL = 15 * time.Minute
+)
+
+func (v *Volumizer) DescribeVolume(ctx context.Context, volumeID string) (*ec2.Volume, error) {
+	output, err := v.ec2.DescribeVolumesWithContext(ctx, &ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(volumeID)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(output.Volumes) != 1 {
+		return nil, fmt.Errorf("Volume %s not found", volumeID)
+	}
+	return output.Volumes[0], nil
+}
+
+// instanceGone returns true if the instance does not exist or is no
+// longer running.
+func (v *Volumizer) instanceGone(ctx context.Context, instanceID string) (bool, error) {
+	output, err := v.ec2.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(instanceID)},
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "InvalidInstanceID.NotFound" {
+			return true, nil
+		}
+		return false, err
+	}
+	for _, reservation := range output.Reservations {
+		for _, instance := range reservation.Instances {
+			switch aws.StringValue(instance.State.Name) {
+			case ec2.InstanceStateNamePending, ec2.InstanceStateNameRunning:
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// claimIsStale returns true if the volume's claim may be taken over, because
+// its owner no longer exists or has not attached the volume within ClaimTTL.
+func (v *Volumizer) claimIsStale(ctx context.Context, volume *ec2.Volume, now time.Time) (bool, error) {
+	claimedAt, err := time.Parse(time.RFC3339, tagValue(volume.Tags, ClaimTimeTag))
+	if err != nil || now.Sub(claimedAt) > ClaimTTL {
+		return true, nil
+	}
+	return v.instanceGone(ctx, tagValue(volume.Tags, ClaimTag))
+}
+
+// ClaimedError is returned by ClaimVolume when another instance holds the
+// claim on a volume, or won it while this instance was claiming it.
+type ClaimedError struct {
+	VolumeID string
+	Owner    string
+	Lost     bool
+}
+
+func (e *ClaimedError) Error() string {
+	if e.Lost {
+		return fmt.Sprintf("Lost claim on volume %s to %s", e.VolumeID, e.Owner)
+	}
+	return fmt.Sprintf("Volume %s is claimed by %s", e.VolumeID, e.Owner)
+}
+
+// ClaimVolume tags the volume as owned by this instance, then reads the tag
+// back after ClaimSettle to confirm that no other instance claimed it in the
+// meantime. EC2 tags cannot be written conditionally, so a volume claimed by
+// another live instance is left alone, and the last claim written wins. The
+// tags are read again just before claiming, as the volume may have been
+// described some time ago.
+func (v *Volumizer) ClaimVolume(ctx context.Context, volume *ec2.Volume) error {
+	current, err := v.DescribeVolume(ctx, *volume.VolumeId)
+	if err != nil {
+		return err
+	}
+	owner := tagValue(current.Tags, ClaimTag)
+	if owner != "" && owner != v.instanceID {
+		stale, err := v.claimIsStale(ctx, current, time.Now())
+		if err != nil {
+			return err
+		}
+		if !stale {
+			return &ClaimedError{VolumeID: *volume.VolumeId, Owner: owner}
+		}
+		logging.Warn("Taking over stale claim", "volume", *volume.VolumeId, "owner", owner)
+	}
+	_, err = v.ec2.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+		Resources: []*string{volume.VolumeId},
+		Tags: []*ec2.Tag{
+			{Key: aws.String(ClaimTag), Value: aws.String(v.instanceID)},
+			{Key: aws.String(ClaimTimeTag), Value: aws.String(time.Now().UTC().Format(time.RFC3339))},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	timer := time.NewTimer(ClaimSettle)
+	select {
+	case <-ctx.Done():
+		timer.Stop()
+		return ctx.Err()
+	case <-timer.C:
+	}
+	claimed, err := v.DescribeVolume(ctx, *volume.VolumeId)
+	if err != nil {
+		return err
+	}
+	if owner = tagValue(claimed.Tags, ClaimTag); owner != v.instanceID {
+		return &ClaimedError{VolumeID: *volume.VolumeId, Owner: owner, Lost: true}
+	}
+	return nil
+}
+
+// FindAndClaimVolume finds the volume with FindVolume, checks it against
+// the policy, and claims it. If another instance holds the claim, the
+// volume is looked for again until minutes have passed, since the other
+// instance may fail to attach it, or may attach it and leave another
+// volume for this one.
+func (v *Volumizer) FindAndClaimVolume(ctx context.Context, clusterName string, spec *VolumeSpec,
+	minutes int) (*ec2.Volume, error) {
+	var volume *ec2.Volume
+	err := helpers.WaitFor(ctx, time.Duration(minutes)*time.Minute, func() error {
+		var err error
+		volume, err = v.FindVolume(ctx, clusterName, spec, minutes)
+		if err != nil {
+			return helpers.Permanent(err)
+		}
+		if err = spec.Policy.Check(volume, clusterName, spec); err != nil {
+			return helpers.Permanent(err)
+		}
+		err = v.ClaimVolume(ctx, volume)
+		var claimed *ClaimedError
+		if errors.As(err, &claimed) {
+			logging.Info("Volume claimed by another instance, retrying", "volume", claimed.VolumeID,
+				"owner", claimed.Owner)
+			return err
+		}
+		if err != nil {
+			return helpers.Permanent(err)
+		}
+		return nil
+	})
+	return volume, err
+}
+
+// UnclaimVolume removes this instance's claim from the volume.
+func (v *Volumizer) UnclaimVolume(ctx context.Context, volume *ec2.Volume) error {
+	if tagValue(volume.Tags, ClaimTag) != v.instanceID {
+		return nil
+	}
+	_, err := v.ec2.DeleteTagsWithContext(ctx, &ec2.DeleteTagsInput{
+		Resources: []*string{volume.VolumeId},
+		Tags:      []*ec2.Tag{{Key: aws.String(ClaimTag)}, {Key: aws.String(ClaimTimeTag)}},
+	})
+	return err
+}
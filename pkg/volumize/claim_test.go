@@ -0,0 +1,230 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package volumize
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/stretchr/testify/assert"
+)
+
+// claimEC2 simulates the tags of a single volume, with a competing claim
+// optionally written by another instance right after ours.
+type claimEC2 struct {
+	ec2iface.EC2API
+	tags       map[string]string
+	competitor string
+	instances  map[string]string
+}
+
+func (c *claimEC2) CreateTagsWithContext(ctx aws.Context, input *ec2.CreateTagsInput,
+	opts ...request.Option) (*ec2.CreateTagsOutput, error) {
+	for _, tag := range input.Tags {
+		c.tags[*tag.Key] = *tag.Value
+	}
+	if c.competitor != "" {
+		c.tags[ClaimTag] = c.competitor
+	}
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+func (c *claimEC2) DescribeVolumesWithContext(ctx aws.Context, input *ec2.DescribeVolumesInput,
+	opts ...request.Option) (*ec2.DescribeVolumesOutput, error) {
+	return &ec2.DescribeVolumesOutput{Volumes: []*ec2.Volume{c.volume()}}, nil
+}
+
+func (c *claimEC2) DescribeInstancesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput,
+	opts ...request.Option) (*ec2.DescribeInstancesOutput, error) {
+	state, ok := c.instances[*input.InstanceIds[0]]
+	if !ok {
+		return nil, awserr.New("InvalidInstanceID.NotFound", "not found", nil)
+	}
+	return &ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{
+			{Instances: []*ec2.Instance{{State: &ec2.InstanceState{Name: aws.String(state)}}}},
+		},
+	}, nil
+}
+
+func (c *claimEC2) volume() *ec2.Volume {
+	tags := []*ec2.Tag{}
+	for key, value := range c.tags {
+		tags = append(tags, &ec2.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+	return &ec2.Volume{VolumeId: aws.String("vol-1"), Tags: tags}
+}
+
+func TestClaimVolume(t *testing.T) {
+	settle := ClaimSettle
+	t.Cleanup(func() { ClaimSettle = settle })
+	ClaimSettle = 0
+	now := time.Now().UTC().Format(time.RFC3339)
+	old := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	var testCases = []struct {
+		name       string
+		tags       map[string]string
+		competitor string
+		stale      bool
+		errMsg     string
+	}{
+		{
+			"unclaimed",
+			map[string]string{},
+			"",
+			false,
+			"",
+		},
+		{
+			"ours",
+			map[string]string{ClaimTag: "i-me", ClaimTimeTag: now},
+			"",
+			false,
+			"",
+		},
+		{
+			"claimed-by-live",
+			map[string]string{ClaimTag: "i-running", ClaimTimeTag: now},
+			"",
+			false,
+			"Volume vol-1 is claimed by i-running",
+		},
+		{
+			"claimed-by-terminated",
+			map[string]string{ClaimTag: "i-terminated", ClaimTimeTag: now},
+			"",
+			false,
+			"",
+		},
+		{
+			"claimed-by-missing",
+			map[string]string{ClaimTag: "i-missing", ClaimTimeTag: now},
+			"",
+			false,
+			"",
+		},
+		{
+			"claim-expired",
+			map[string]string{ClaimTag: "i-running", ClaimTimeTag: old},
+			"",
+			false,
+			"",
+		},
+		{
+			"lost-race",
+			map[string]string{},
+			"i-running",
+			false,
+			"Lost claim on volume vol-1 to i-running",
+		},
+		{
+			"claimed-since-described",
+			map[string]string{ClaimTag: "i-running", ClaimTimeTag: now},
+			"",
+			true,
+			"Volume vol-1 is claimed by i-running",
+		},
+	}
+	for _, tc := range testCases {
+		client := &claimEC2{
+			tags:       tc.tags,
+			competitor: tc.competitor,
+			instances: map[string]string{
+				"i-running":    ec2.InstanceStateNameRunning,
+				"i-terminated": ec2.InstanceStateNameTerminated,
+			},
+		}
+		v := &Volumizer{ec2: client, instanceID: "i-me"}
+		volume := client.volume()
+		if tc.stale {
+			volume = &ec2.Volume{VolumeId: aws.String("vol-1")}
+		}
+		err := v.ClaimVolume(context.Background(), volume)
+		if tc.errMsg == "" {
+			assert.NoError(t, err, tc.name)
+			assert.Equal(t, "i-me", client.tags[ClaimTag], tc.name)
+		} else {
+			assert.EqualError(t, err, tc.errMsg, tc.name)
+		}
+	}
+}
+
+func TestClaimVolumeCanceled(t *testing.T) {
+	settle := ClaimSettle
+	t.Cleanup(func() { ClaimSettle = settle })
+	ClaimSettle = time.Hour
+	client := &claimEC2{tags: map[string]string{}}
+	v := &Volumizer{ec2: client, instanceID: "i-me"}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	err := v.ClaimVolume(ctx, client.volume())
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestAttachedHere(t *testing.T) {
+	var testCases = []struct {
+		attachments []*ec2.VolumeAttachment
+		errMsg      string
+	}{
+		{
+			[]*ec2.VolumeAttachment{{InstanceId: aws.String("i-me")}},
+			"",
+		},
+		{
+			[]*ec2.VolumeAttachment{{InstanceId: aws.String("i-other")}},
+			"Volume vol-1 is attached to i-other",
+		},
+		{
+			[]*ec2.VolumeAttachment{},
+			"Volume vol-1 is in use but not attached",
+		},
+	}
+	for _, tc := range testCases {
+		client := &attachEC2{volume: &ec2.Volume{VolumeId: aws.String("vol-1"), Attachments: tc.attachments}}
+		v := &Volumizer{ec2: client, instanceID: "i-me"}
+		err := v.attachedHere(context.Background(), "vol-1")
+		if tc.errMsg == "" {
+			assert.NoError(t, err)
+		} else {
+			assert.EqualError(t, err, tc.errMsg)
+		}
+	}
+}
+
+type attachEC2 struct {
+	ec2iface.EC2API
+	volume *ec2.Volume
+}
+
+func (a *attachEC2) DescribeVolumesWithContext(ctx aws.Context, input *ec2.DescribeVolumesInput,
+	opts ...request.Option) (*ec2.DescribeVolumesOutput, error) {
+	if *input.VolumeIds[0] != *a.volume.VolumeId {
+		return nil, fmt.Errorf("unexpected volume %s", *input.VolumeIds[0])
+	}
+	return &ec2.DescribeVolumesOutput{Volumes: []*ec2.Volume{a.volume}}, nil
+}
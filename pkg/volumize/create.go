@@ -0,0 +1,261 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package volumize
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/cloudboss/keights/pkg/helpers"
+	"github.com/cloudboss/keights/pkg/logging"
+)
+
+// LatestSnapshot returns the most recent completed snapshot of the member's
+// volume, or nil if there are none.
+func (v *Volumizer) LatestSnapshot(ctx context.Context, clusterName, volumeTag, member string) (*ec2.Snapshot, error) {
+	filters := append(tagFilters(clusterName, volumeTag, member),
+		&ec2.Filter{
+			Name:   aws.String("status"),
+			Values: []*string{aws.String("completed")},
+		},
+	)
+	input := &ec2.DescribeSnapshotsInput{
+		Filters:  filters,
+		OwnerIds: []*string{aws.String("self")},
+	}
+	snapshots := []*ec2.Snapshot{}
+	err := v.ec2.DescribeSnapshotsPagesWithContext(ctx, input, func(out *ec2.DescribeSnapshotsOutput, lastPage bool) bool {
+		snapshots = append(snapshots, out.Snapshots...)
+		return !lastPage
+	})
+	if err != nil {
+		return nil, err
+	}
+	return latestSnapshot(snapshots), nil
+}
+
+func latestSnapshot(snapshots []*ec2.Snapshot) *ec2.Snapshot {
+	var latest *ec2.Snapshot
+	for _, snapshot := range snapshots {
+		if latest == nil || aws.TimeValue(snapshot.StartTime).After(aws.TimeValue(latest.StartTime)) {
+			latest = snapshot
+		}
+	}
+	return latest
+}
+
+// encrypted returns true if a created volume is to be encrypted, so that it
+// satisfies the policy it will be checked against.
+func (spec *VolumeSpec) encrypted() bool {
+	if spec.kmsKeyID() != "" || spec.Policy.RequireEncryption {
+		return true
+	}
+	return spec.Encrypted == nil || *spec.Encrypted
+}
+
+// kmsKeyID returns the KMS key with which to encrypt a created volume,
+// falling back to the key required by the policy.
+func (spec *VolumeSpec) kmsKeyID() string {
+	if spec.KMSKeyID != "" {
+		return spec.KMSKeyID
+	}
+	return spec.Policy.KMSKeyID
+}
+
+func (v *Volumizer) createVolumeInput(clusterName string, spec *VolumeSpec, snapshot *ec2.Snapshot) *ec2.CreateVolumeInput {
+	input := &ec2.CreateVolumeInput{
+		AvailabilityZone: aws.String(v.availabilityZone),
+		TagSpecifications: []*ec2.TagSpecification{
+			{
+				ResourceType: aws.String(ec2.ResourceTypeVolume),
+				Tags: []*ec2.Tag{
+					{Key: aws.String("Name"), Value: aws.String(clusterName)},
+					{Key: aws.String(spec.Tag), Value: aws.String(spec.Member)},
+				},
+			},
+		},
+	}
+	size := spec.Size
+	if snapshot != nil {
+		input.SnapshotId = snapshot.SnapshotId
+		// A volume cannot be smaller than the snapshot it is created from.
+		if snapshotSize := aws.Int64Value(snapshot.VolumeSize); snapshotSize > size {
+			size = snapshotSize
+		}
+	}
+	if size > 0 {
+		input.Size = aws.Int64(size)
+	}
+	if spec.VolumeType != "" {
+		input.VolumeType = aws.String(spec.VolumeType)
+	}
+	if spec.Iops > 0 {
+		input.Iops = aws.Int64(spec.Iops)
+	}
+	if spec.Throughput > 0 {
+		input.Throughput = aws.Int64(spec.Throughput)
+	}
+	if spec.encrypted() {
+		input.Encrypted = aws.Bool(true)
+	}
+	if keyID := spec.kmsKeyID(); keyID != "" {
+		input.KmsKeyId = aws.String(keyID)
+	}
+	return input
+}
+
+func (v *Volumizer) WaitForVolumeState(ctx context.Context, volumeID, state string, duration time.Duration) (*ec2.Volume, error) {
+	var volume *ec2.Volume
+	input := &ec2.DescribeVolumesInput{VolumeIds: []*string{aws.String(volumeID)}}
+	err := helpers.WaitFor(ctx, duration, func() error {
+		output, err := v.ec2.DescribeVolumesWithContext(ctx, input)
+		if err != nil {
+			return err
+		}
+		if len(output.Volumes) != 1 {
+			return fmt.Errorf("Volume %s not found", volumeID)
+		}
+		volume = output.Volumes[0]
+		if actual := aws.StringValue(volume.State); actual != state {
+			return fmt.Errorf("Volume %s is %s, not %s", volumeID, actual, state)
+		}
+		return nil
+	})
+	return volume, err
+}
+
+// memberVolumeStates are the states of volumes that may still become available
+// to the member, so that another volume must not be created for it.
+var memberVolumeStates = []*string{
+	aws.String(ec2.VolumeStateCreating),
+	aws.String(ec2.VolumeStateAvailable),
+	aws.String(ec2.VolumeStateInUse),
+}
+
+// MemberVolumes returns the member's volumes in any availability zone that
+// are being created, are available, or are in use, for example by an
+// instance that is terminating.
+func (v *Volumizer) MemberVolumes(ctx context.Context, clusterName, volumeTag, member string) ([]*ec2.Volume, error) {
+	filters := append(tagFilters(clusterName, volumeTag, member),
+		&ec2.Filter{
+			Name:   aws.String("status"),
+			Values: memberVolumeStates,
+		},
+	)
+	output, err := v.ec2.DescribeVolumesWithContext(ctx, &ec2.DescribeVolumesInput{Filters: filters})
+	if err != nil {
+		return nil, err
+	}
+	return output.Volumes, nil
+}
+
+// CreateVolume creates the member's volume in this instance's availability
+// zone, restoring it from the member's latest snapshot if there is one.
+func (v *Volumizer) CreateVolume(ctx context.Context, clusterName string, spec *VolumeSpec) (*ec2.Volume, error) {
+	snapshot, err := v.LatestSnapshot(ctx, clusterName, spec.Tag, spec.Member)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot == nil && spec.Size == 0 {
+		return nil, fmt.Errorf("Size is required to create a volume without a snapshot")
+	}
+	input := v.createVolumeInput(clusterName, spec, snapshot)
+	if snapshot != nil {
+		logging.Info("Creating volume from snapshot", "snapshot", *snapshot.SnapshotId)
+	} else {
+		logging.Info("Creating empty volume")
+	}
+	volume, err := v.ec2.CreateVolumeWithContext(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	return v.WaitForVolumeState(ctx, *volume.VolumeId, ec2.VolumeStateAvailable, 10*time.Minute)
+}
+
+// FindVolume returns the available volume in this instance's availability
+// zone. If the member's volume exists but is not available, as when the
+// instance it was attached to is terminating, it waits for the volume
+// rather than creating another, and it finishes the migration of the volume
+// if that was interrupted. If there is none, it migrates the member's
+// volume from another availability zone if spec.Migrate is set, then
+// creates one if spec.Create is set, and finally waits for one to become
+// available.
+func (v *Volumizer) FindVolume(ctx context.Context, clusterName string, spec *VolumeSpec, minutes int) (*ec2.Volume, error) {
+	duration := time.Duration(minutes) * time.Minute
+	if spec.Create || spec.Migrate {
+		volumes, err := v.MemberVolumes(ctx, clusterName, spec.Tag, spec.Member)
+		if err != nil {
+			return nil, err
+		}
+		local := []*ec2.Volume{}
+		remote := []*ec2.Volume{}
+		for _, volume := range volumes {
+			if aws.StringValue(volume.AvailabilityZone) == v.availabilityZone {
+				local = append(local, volume)
+			} else {
+				remote = append(remote, volume)
+			}
+		}
+		switch len(local) {
+		case 0:
+		case 1:
+			volume := local[0]
+			if aws.StringValue(volume.State) != ec2.VolumeStateAvailable {
+				logging.Info("Waiting for volume", "volume", *volume.VolumeId,
+					"state", aws.StringValue(volume.State))
+				volume, err = v.WaitForVolumeState(ctx, *volume.VolumeId, ec2.VolumeStateAvailable, duration)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if err = v.ResumeMigration(ctx, volume, spec.Tag); err != nil {
+				return nil, err
+			}
+			return volume, nil
+		default:
+			return nil, fmt.Errorf("Expected at most 1 volume, found %d", len(local))
+		}
+		if spec.Migrate {
+			for _, volume := range remote {
+				if aws.StringValue(volume.State) == ec2.VolumeStateAvailable {
+					continue
+				}
+				logging.Info("Waiting for volume to migrate", "volume", *volume.VolumeId,
+					"state", aws.StringValue(volume.State))
+				_, err = v.WaitForVolumeState(ctx, *volume.VolumeId, ec2.VolumeStateAvailable, duration)
+				if err != nil {
+					return nil, err
+				}
+			}
+			volume, err := v.MigrateVolume(ctx, clusterName, spec, minutes)
+			if err != nil || volume != nil {
+				return volume, err
+			}
+		}
+	}
+	if spec.Create {
+		return v.CreateVolume(ctx, clusterName, spec)
+	}
+	return v.WaitForVolume(ctx, clusterName, spec.Tag, spec.Member, time.Duration(minutes))
+}
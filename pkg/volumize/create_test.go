@@ -0,0 +1,433 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package volumize
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/cloudboss/keights/pkg/helpers"
+	"github.com/stretchr/testify/assert"
+)
+
+// memEC2 keeps volumes and snapshots in memory and filters them as EC2
+// does. A volume listed in pending becomes available, and is detached,
+// after it has been described that many more times. An instance listed
+// in running is running until it has been described that many more times.
+type memEC2 struct {
+	ec2iface.EC2API
+	volumes   []*ec2.Volume
+	snapshots []*ec2.Snapshot
+	pending   map[string]int
+	running   map[string]int
+	created   []*ec2.CreateVolumeInput
+}
+
+func hasTag(tags []*ec2.Tag, key string) bool {
+	for _, tag := range tags {
+		if aws.StringValue(tag.Key) == key {
+			return true
+		}
+	}
+	return false
+}
+
+func matches(filters []*ec2.Filter, tags []*ec2.Tag, fields map[string]string) bool {
+	for _, filter := range filters {
+		name := aws.StringValue(filter.Name)
+		if name == "tag-key" {
+			found := false
+			for _, value := range filter.Values {
+				found = found || hasTag(tags, *value)
+			}
+			if !found {
+				return false
+			}
+			continue
+		}
+		var actual string
+		var present bool
+		if len(name) > 4 && name[:4] == "tag:" {
+			actual, present = tagValue(tags, name[4:]), hasTag(tags, name[4:])
+		} else {
+			actual, present = fields[name]
+		}
+		found := false
+		for _, value := range filter.Values {
+			found = found || (present && actual == *value)
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *memEC2) volume(volumeID string) *ec2.Volume {
+	for _, volume := range m.volumes {
+		if *volume.VolumeId == volumeID {
+			return volume
+		}
+	}
+	return nil
+}
+
+func (m *memEC2) DescribeVolumesWithContext(ctx aws.Context, input *ec2.DescribeVolumesInput,
+	opts ...request.Option) (*ec2.DescribeVolumesOutput, error) {
+	for volumeID, count := range m.pending {
+		if count > 0 {
+			m.pending[volumeID]--
+			continue
+		}
+		volume := m.volume(volumeID)
+		volume.State = aws.String(ec2.VolumeStateAvailable)
+		volume.Attachments = nil
+		delete(m.pending, volumeID)
+	}
+	output := &ec2.DescribeVolumesOutput{}
+	for _, volume := range m.volumes {
+		if len(input.VolumeIds) > 0 && *input.VolumeIds[0] != *volume.VolumeId {
+			continue
+		}
+		fields := map[string]string{
+			"availability-zone": aws.StringValue(volume.AvailabilityZone),
+			"status":            aws.StringValue(volume.State),
+		}
+		for _, attachment := range volume.Attachments {
+			fields["attachment.instance-id"] = aws.StringValue(attachment.InstanceId)
+			fields["attachment.device"] = aws.StringValue(attachment.Device)
+		}
+		if matches(input.Filters, volume.Tags, fields) {
+			copied := *volume
+			output.Volumes = append(output.Volumes, &copied)
+		}
+	}
+	return output, nil
+}
+
+func (m *memEC2) DescribeInstancesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput,
+	opts ...request.Option) (*ec2.DescribeInstancesOutput, error) {
+	state := ec2.InstanceStateNameTerminated
+	if m.running[*input.InstanceIds[0]] > 0 {
+		m.running[*input.InstanceIds[0]]--
+		state = ec2.InstanceStateNameRunning
+	}
+	return &ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{
+			{Instances: []*ec2.Instance{{State: &ec2.InstanceState{Name: aws.String(state)}}}},
+		},
+	}, nil
+}
+
+func (m *memEC2) CreateVolumeWithContext(ctx aws.Context, input *ec2.CreateVolumeInput,
+	opts ...request.Option) (*ec2.Volume, error) {
+	m.created = append(m.created, input)
+	volume := &ec2.Volume{
+		VolumeId:         aws.String(fmt.Sprintf("vol-new%d", len(m.created))),
+		AvailabilityZone: input.AvailabilityZone,
+		Size:             input.Size,
+		SnapshotId:       input.SnapshotId,
+		State:            aws.String(ec2.VolumeStateAvailable),
+		Tags:             input.TagSpecifications[0].Tags,
+	}
+	m.volumes = append(m.volumes, volume)
+	copied := *volume
+	return &copied, nil
+}
+
+func (m *memEC2) CreateTagsWithContext(ctx aws.Context, input *ec2.CreateTagsInput,
+	opts ...request.Option) (*ec2.CreateTagsOutput, error) {
+	volume := m.volume(*input.Resources[0])
+	for _, tag := range input.Tags {
+		tags := []*ec2.Tag{}
+		for _, existing := range volume.Tags {
+			if *existing.Key != *tag.Key {
+				tags = append(tags, existing)
+			}
+		}
+		volume.Tags = append(tags, tag)
+	}
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+func (m *memEC2) DeleteTagsWithContext(ctx aws.Context, input *ec2.DeleteTagsInput,
+	opts ...request.Option) (*ec2.DeleteTagsOutput, error) {
+	volume := m.volume(*input.Resources[0])
+	for _, tag := range input.Tags {
+		tags := []*ec2.Tag{}
+		for _, existing := range volume.Tags {
+			if *existing.Key != *tag.Key {
+				tags = append(tags, existing)
+			}
+		}
+		volume.Tags = tags
+	}
+	return &ec2.DeleteTagsOutput{}, nil
+}
+
+// DetachVolumeWithContext leaves the volume in use until it has been
+// described once more, as detaching takes time.
+func (m *memEC2) DetachVolumeWithContext(ctx aws.Context, input *ec2.DetachVolumeInput,
+	opts ...request.Option) (*ec2.VolumeAttachment, error) {
+	if m.pending == nil {
+		m.pending = map[string]int{}
+	}
+	m.pending[*input.VolumeId] = 1
+	return &ec2.VolumeAttachment{VolumeId: input.VolumeId}, nil
+}
+
+func (m *memEC2) CreateSnapshotWithContext(ctx aws.Context, input *ec2.CreateSnapshotInput,
+	opts ...request.Option) (*ec2.Snapshot, error) {
+	snapshot := &ec2.Snapshot{
+		SnapshotId: aws.String(fmt.Sprintf("snap-new%d", len(m.snapshots)+1)),
+		VolumeId:   input.VolumeId,
+		VolumeSize: m.volume(*input.VolumeId).Size,
+		State:      aws.String(ec2.SnapshotStateCompleted),
+		StartTime:  aws.Time(time.Now()),
+		Tags:       input.TagSpecifications[0].Tags,
+	}
+	m.snapshots = append(m.snapshots, snapshot)
+	return snapshot, nil
+}
+
+func (m *memEC2) DescribeSnapshotsWithContext(ctx aws.Context, input *ec2.DescribeSnapshotsInput,
+	opts ...request.Option) (*ec2.DescribeSnapshotsOutput, error) {
+	output := &ec2.DescribeSnapshotsOutput{}
+	for _, snapshot := range m.snapshots {
+		if len(input.SnapshotIds) > 0 && *input.SnapshotIds[0] != *snapshot.SnapshotId {
+			continue
+		}
+		fields := map[string]string{"status": aws.StringValue(snapshot.State)}
+		if matches(input.Filters, snapshot.Tags, fields) {
+			output.Snapshots = append(output.Snapshots, snapshot)
+		}
+	}
+	return output, nil
+}
+
+func (m *memEC2) DescribeSnapshotsPagesWithContext(ctx aws.Context, input *ec2.DescribeSnapshotsInput,
+	fn func(*ec2.DescribeSnapshotsOutput, bool) bool, opts ...request.Option) error {
+	output, err := m.DescribeSnapshotsWithContext(ctx, input)
+	if err != nil {
+		return err
+	}
+	fn(output, true)
+	return nil
+}
+
+func memberVolume(volumeID, az, state string) *ec2.Volume {
+	return &ec2.Volume{
+		VolumeId:         aws.String(volumeID),
+		AvailabilityZone: aws.String(az),
+		Size:             aws.Int64(10),
+		State:            aws.String(state),
+		Tags: []*ec2.Tag{
+			{Key: aws.String("Name"), Value: aws.String("cb")},
+			{Key: aws.String("etcd:instance"), Value: aws.String("1")},
+		},
+	}
+}
+
+func fastBackoff(t *testing.T) {
+	backoff := helpers.DefaultBackoff
+	t.Cleanup(func() { helpers.DefaultBackoff = backoff })
+	helpers.DefaultBackoff = helpers.Backoff{Initial: time.Millisecond, Max: time.Millisecond}
+}
+
+func TestFindVolume(t *testing.T) {
+	fastBackoff(t)
+	var testCases = []struct {
+		name     string
+		volumes  []*ec2.Volume
+		pending  map[string]int
+		size     int64
+		expected string
+		created  int
+		errMsg   string
+	}{
+		{
+			"available",
+			[]*ec2.Volume{memberVolume("vol-1", "az-a", ec2.VolumeStateAvailable)},
+			nil,
+			10,
+			"vol-1",
+			0,
+			"",
+		},
+		{
+			"in-use-until-old-instance-terminates",
+			[]*ec2.Volume{memberVolume("vol-1", "az-a", ec2.VolumeStateInUse)},
+			map[string]int{"vol-1": 2},
+			10,
+			"vol-1",
+			0,
+			"",
+		},
+		{
+			"creating",
+			[]*ec2.Volume{memberVolume("vol-1", "az-a", ec2.VolumeStateCreating)},
+			map[string]int{"vol-1": 1},
+			10,
+			"vol-1",
+			0,
+			"",
+		},
+		{
+			"none",
+			nil,
+			nil,
+			10,
+			"vol-new1",
+			1,
+			"",
+		},
+		{
+			"other-az-without-migrate",
+			[]*ec2.Volume{memberVolume("vol-1", "az-b", ec2.VolumeStateAvailable)},
+			nil,
+			10,
+			"vol-new1",
+			1,
+			"",
+		},
+		{
+			"deleted",
+			[]*ec2.Volume{memberVolume("vol-1", "az-a", ec2.VolumeStateDeleting)},
+			nil,
+			10,
+			"vol-new1",
+			1,
+			"",
+		},
+		{
+			"no-size-or-snapshot",
+			nil,
+			nil,
+			0,
+			"",
+			0,
+			"Size is required to create a volume without a snapshot",
+		},
+		{
+			"two",
+			[]*ec2.Volume{
+				memberVolume("vol-1", "az-a", ec2.VolumeStateAvailable),
+				memberVolume("vol-2", "az-a", ec2.VolumeStateInUse),
+			},
+			nil,
+			10,
+			"",
+			0,
+			"Expected at most 1 volume, found 2",
+		},
+	}
+	for _, tc := range testCases {
+		client := &memEC2{volumes: tc.volumes, pending: tc.pending}
+		v := &Volumizer{ec2: client, availabilityZone: "az-a", instanceID: "i-me"}
+		spec := &VolumeSpec{Tag: "etcd:instance", Member: "1", Create: true, Size: tc.size}
+		volume, err := v.FindVolume(context.Background(), "cb", spec, 1)
+		if tc.errMsg == "" {
+			assert.NoError(t, err, tc.name)
+			assert.Equal(t, tc.expected, aws.StringValue(volume.VolumeId), tc.name)
+			assert.Equal(t, ec2.VolumeStateAvailable, aws.StringValue(volume.State), tc.name)
+		} else {
+			assert.EqualError(t, err, tc.errMsg, tc.name)
+		}
+		assert.Len(t, client.created, tc.created, tc.name)
+	}
+}
+
+func TestFindAndClaimVolume(t *testing.T) {
+	fastBackoff(t)
+	settle := ClaimSettle
+	t.Cleanup(func() { ClaimSettle = settle })
+	ClaimSettle = 0
+	now := time.Now().UTC().Format(time.RFC3339)
+	claimed := func(volumeID, owner string) *ec2.Volume {
+		volume := memberVolume(volumeID, "az-a", ec2.VolumeStateAvailable)
+		volume.Tags = append(volume.Tags,
+			&ec2.Tag{Key: aws.String(ClaimTag), Value: aws.String(owner)},
+			&ec2.Tag{Key: aws.String(ClaimTimeTag), Value: aws.String(now)})
+		return volume
+	}
+	var testCases = []struct {
+		name     string
+		volumes  []*ec2.Volume
+		running  map[string]int
+		policy   Policy
+		expected string
+		errMsg   string
+	}{
+		{
+			"unclaimed",
+			[]*ec2.Volume{memberVolume("vol-1", "az-a", ec2.VolumeStateAvailable)},
+			nil,
+			Policy{},
+			"vol-1",
+			"",
+		},
+		{
+			"claimed-until-owner-terminates",
+			[]*ec2.Volume{claimed("vol-1", "i-other")},
+			map[string]int{"i-other": 2},
+			Policy{},
+			"vol-1",
+			"",
+		},
+		{
+			"claimed-by-live",
+			[]*ec2.Volume{claimed("vol-1", "i-other")},
+			map[string]int{"i-other": 1000000},
+			Policy{},
+			"",
+			"Timed out waiting: Volume vol-1 is claimed by i-other",
+		},
+		{
+			"policy-violation",
+			[]*ec2.Volume{memberVolume("vol-1", "az-a", ec2.VolumeStateAvailable)},
+			nil,
+			Policy{RequireEncryption: true},
+			"",
+			"Volume vol-1 violates policy: encryption is required but volume is not encrypted",
+		},
+	}
+	for _, tc := range testCases {
+		client := &memEC2{volumes: tc.volumes, running: tc.running}
+		v := &Volumizer{ec2: client, availabilityZone: "az-a", instanceID: "i-me"}
+		spec := &VolumeSpec{Tag: "etcd:instance", Member: "1", Size: 10, Policy: tc.policy}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		volume, err := v.FindAndClaimVolume(ctx, "cb", spec, 1)
+		cancel()
+		if tc.errMsg == "" {
+			assert.NoError(t, err, tc.name)
+			assert.Equal(t, tc.expected, aws.StringValue(volume.VolumeId), tc.name)
+			assert.Equal(t, "i-me", tagValue(client.volume(tc.expected).Tags, ClaimTag), tc.name)
+		} else {
+			assert.EqualError(t, err, tc.errMsg, tc.name)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package volumize
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/deniswernert/go-fstab"
+)
+
+var (
+	// Maximum filesystem label lengths.
+	labelLimits = map[string]int{
+		"ext2": 16,
+		"ext3": 16,
+		"ext4": 16,
+		"xfs":  12,
+	}
+
+	// Mount options which mean nothing to the kernel.
+	ignoredMountOptions = map[string]bool{
+		"defaults": true,
+		"rw":       true,
+		"nofail":   true,
+		"auto":     true,
+		"noauto":   true,
+		"_netdev":  true,
+	}
+)
+
+func isExt(fsType string) bool {
+	return fsType == "ext2" || fsType == "ext3" || fsType == "ext4"
+}
+
+// DefaultMountOptions returns the mount options used when none are given.
+// The errors option is specific to ext filesystems.
+func DefaultMountOptions(fsType string) []string {
+	if isExt(fsType) {
+		return []string{"noatime", "errors=remount-ro"}
+	}
+	return []string{"noatime"}
+}
+
+func (spec *VolumeSpec) mountOptions() []string {
+	if len(spec.MountOptions) == 0 {
+		return DefaultMountOptions(spec.FsType)
+	}
+	return spec.MountOptions
+}
+
+func (spec *VolumeSpec) validateFilesystem() error {
+	if limit, ok := labelLimits[spec.FsType]; ok && len(spec.Label) > limit {
+		return fmt.Errorf("label %s is longer than %d characters allowed for %s",
+			spec.Label, limit, spec.FsType)
+	}
+	if spec.ReservedBlocksPercent != nil {
+		if !isExt(spec.FsType) {
+			return fmt.Errorf("reserved blocks percentage is not supported for %s", spec.FsType)
+		}
+		if percent := *spec.ReservedBlocksPercent; percent < 0 || percent > 50 {
+			return fmt.Errorf("reserved blocks percentage must be between 0 and 50")
+		}
+	}
+	return nil
+}
+
+// mkfsOptions returns the options to pass to mkfs for the label and reserved
+// blocks, followed by any given explicitly.
+func (spec *VolumeSpec) mkfsOptions() []string {
+	options := []string{}
+	if spec.Label != "" {
+		options = append(options, "-L", spec.Label)
+	}
+	if spec.ReservedBlocksPercent != nil {
+		options = append(options, "-m", fmt.Sprintf("%d", *spec.ReservedBlocksPercent))
+	}
+	return append(options, spec.MkfsOptions...)
+}
+
+// mountFlags separates mount options into the flags and data arguments of
+// mount(2), leaving out options that are only meaningful in fstab or to
+// systemd.
+func mountFlags(options []string) (uintptr, string) {
+	var flags uintptr
+	data := []string{}
+	for _, option := range options {
+		if flag, ok := mountFlagOptions[option]; ok {
+			flags |= flag
+			continue
+		}
+		if ignoredMountOptions[option] || strings.HasPrefix(option, "x-") {
+			continue
+		}
+		data = append(data, option)
+	}
+	return flags, strings.Join(data, ",")
+}
+
+// IsMounted returns whether a filesystem is mounted on mountPoint.
+func IsMounted(mountPoint string) (bool, error) {
+	mounts, err := fstab.ParseProc()
+	if err != nil {
+		return false, err
+	}
+	for _, mount := range mounts {
+		if filepath.Clean(mount.File) == filepath.Clean(mountPoint) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// MountFilesystem mounts device on mountPoint if nothing is mounted there
+// already. Only this mount point is affected, unlike `mount -a`, which
+// fails if any entry in fstab cannot be mounted.
+func MountFilesystem(device, fsType, mountPoint string, options []string) error {
+	mounted, err := IsMounted(mountPoint)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		return nil
+	}
+	flags, data := mountFlags(options)
+	if err = mount(device, mountPoint, fsType, flags, data); err != nil {
+		return fmt.Errorf("Failed to mount %s on %s: %v", device, mountPoint, err)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package volumize
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/cloudboss/keights/pkg/logging"
+)
+
+const (
+	Dumpe2fs  = "dumpe2fs"
+	Resize2fs = "resize2fs"
+	XfsInfo   = "xfs_info"
+	XfsGrowfs = "xfs_growfs"
+)
+
+var (
+	// GrowThreshold is how much larger than the filesystem a device must
+	// be before the filesystem is grown. Filesystems do not always fill a
+	// device exactly, so without this they might be grown on every boot.
+	GrowThreshold int64 = 32 << 20
+
+	xfsDataRegexp = regexp.MustCompile(`^data\s+=.*bsize=(\d+)\s+blocks=(\d+)`)
+)
+
+// DeviceSize returns the size in bytes of a block device.
+func DeviceSize(device string) (int64, error) {
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return 0, err
+	}
+	sizeFile := filepath.Join(SysBlock, filepath.Base(resolved), "size")
+	contents, err := ioutil.ReadFile(sizeFile)
+	if err != nil {
+		return 0, err
+	}
+	sectors, err := strconv.ParseInt(strings.TrimSpace(string(contents)), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	// The kernel reports sizes in 512 byte sectors regardless of the
+	// device's actual sector size.
+	return sectors * 512, nil
+}
+
+func parseDumpe2fs(output string) (int64, error) {
+	var blockCount, blockSize int64
+	var err error
+	for _, line := range strings.Split(output, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+		switch parts[0] {
+		case "Block count":
+			blockCount, err = strconv.ParseInt(value, 10, 64)
+		case "Block size":
+			blockSize, err = strconv.ParseInt(value, 10, 64)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if blockCount == 0 || blockSize == 0 {
+		return 0, fmt.Errorf("Block count and size not found in %s output", Dumpe2fs)
+	}
+	return blockCount * blockSize, nil
+}
+
+func parseXfsInfo(output string) (int64, error) {
+	for _, line := range strings.Split(output, "\n") {
+		match := xfsDataRegexp.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		blockSize, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		blockCount, err := strconv.ParseInt(match[2], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return blockCount * blockSize, nil
+	}
+	return 0, fmt.Errorf("Data section not found in %s output", XfsInfo)
+}
+
+// FilesystemSize returns the size in bytes of the filesystem on device,
+// which for xfs must be mounted on mountPoint.
+func FilesystemSize(ctx context.Context, device, fsType, mountPoint string) (int64, error) {
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		out, err := run(ctx, Dumpe2fs, "-h", device)
+		if err != nil {
+			return 0, err
+		}
+		return parseDumpe2fs(out.Stdout)
+	case "xfs":
+		out, err := run(ctx, XfsInfo, mountPoint)
+		if err != nil {
+			return 0, err
+		}
+		return parseXfsInfo(out.Stdout)
+	}
+	return 0, fmt.Errorf("Growing %s filesystems is not supported", fsType)
+}
+
+// GrowFilesystem grows the mounted filesystem on device to fill it, if the
+// device has been enlarged.
+func GrowFilesystem(ctx context.Context, device, fsType, mountPoint string) error {
+	deviceSize, err := DeviceSize(device)
+	if err != nil {
+		return err
+	}
+	fsSize, err := FilesystemSize(ctx, device, fsType, mountPoint)
+	if err != nil {
+		return err
+	}
+	if deviceSize-fsSize < GrowThreshold {
+		return nil
+	}
+	logging.Info("Growing filesystem", "fstype", fsType, "device", device,
+		"from", fsSize, "to", deviceSize)
+	if fsType == "xfs" {
+		_, err = run(ctx, XfsGrowfs, mountPoint)
+	} else {
+		_, err = run(ctx, Resize2fs, device)
+	}
+	return err
+}
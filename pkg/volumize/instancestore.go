@@ -0,0 +1,200 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package volumize
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cloudboss/keights/pkg/logging"
+)
+
+const (
+	Mdadm              = "mdadm"
+	InstanceStoreModel = "Amazon EC2 NVMe Instance Storage"
+)
+
+var (
+	// InstanceStoreArray is the md device assembled from multiple instance store disks.
+	InstanceStoreArray = "/dev/md/keights"
+	// InstanceStoreMount is where the instance store filesystem is mounted. Each
+	// requested path is bind mounted from a directory beneath it.
+	InstanceStoreMount = "/mnt/keights-instance-store"
+)
+
+// InstanceStoreDevices returns the NVMe instance store disks, identified by
+// their model in sysfs, in sorted order.
+func InstanceStoreDevices() ([]string, error) {
+	nvmeDevices, err := filepath.Glob(filepath.Join(SysBlock, "nvme*n*"))
+	if err != nil {
+		return nil, err
+	}
+	devices := []string{}
+	for _, nvmeDevice := range nvmeDevices {
+		model, err := ioutil.ReadFile(filepath.Join(nvmeDevice, "device", "model"))
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(string(model)) == InstanceStoreModel {
+			devices = append(devices, filepath.Join("/dev", filepath.Base(nvmeDevice)))
+		}
+	}
+	sort.Strings(devices)
+	return devices, nil
+}
+
+// parseMdadmScan returns the device of the array with the given name from
+// the output of mdadm --detail --scan, or an empty string if there is none.
+// The name in the superblock is prefixed with the hostname of the instance
+// that created the array, which may differ from the current one.
+func parseMdadmScan(output, name string) string {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "ARRAY" {
+			continue
+		}
+		for _, field := range fields[2:] {
+			if !strings.HasPrefix(field, "name=") {
+				continue
+			}
+			value := strings.TrimPrefix(field, "name=")
+			if value == name || strings.HasSuffix(value, ":"+name) {
+				return fields[1]
+			}
+		}
+	}
+	return ""
+}
+
+// EnsureArray returns the device to format for the instance store disks. A
+// single disk is used directly. Multiple disks are assembled into a RAID0
+// array, which is created again if assembly fails, as it does after a stop
+// and start when the disks come back blank. After a reboot, udev may have
+// already assembled the array under another device such as /dev/md127, so
+// it is looked up by name before assembling it.
+func EnsureArray(ctx context.Context, devices []string) (string, error) {
+	if len(devices) == 0 {
+		return "", fmt.Errorf("No instance store devices found")
+	}
+	if len(devices) == 1 {
+		return devices[0], nil
+	}
+	if _, err := os.Stat(InstanceStoreArray); err == nil {
+		return InstanceStoreArray, nil
+	}
+	scan, err := run(ctx, Mdadm, "--detail", "--scan")
+	if err != nil {
+		return "", err
+	}
+	if array := parseMdadmScan(scan.Stdout, filepath.Base(InstanceStoreArray)); array != "" {
+		logging.Info("Found assembled array", "array", array)
+		return array, nil
+	}
+	args := append([]string{"--assemble", InstanceStoreArray}, devices...)
+	assemble, err := command(ctx, Mdadm, args...)
+	if err != nil {
+		return "", err
+	}
+	if assemble.ExitStatus == 0 {
+		return InstanceStoreArray, nil
+	}
+	logging.Info("Creating RAID0 array", "array", InstanceStoreArray,
+		"devices", strings.Join(devices, ","))
+	args = []string{
+		"--create", InstanceStoreArray,
+		"--run",
+		"--level=0",
+		fmt.Sprintf("--raid-devices=%d", len(devices)),
+		fmt.Sprintf("--name=%s", filepath.Base(InstanceStoreArray)),
+	}
+	if _, err = run(ctx, Mdadm, append(args, devices...)...); err != nil {
+		return "", fmt.Errorf("Failed to create array %s: %v", InstanceStoreArray, err)
+	}
+	return InstanceStoreArray, nil
+}
+
+// bindSource returns the directory on the instance store from which path is
+// bind mounted, e.g. /var/lib/containerd is bound from var-lib-containerd.
+func bindSource(path string) string {
+	name := strings.Replace(strings.Trim(filepath.Clean(path), "/"), "/", "-", -1)
+	return filepath.Join(InstanceStoreMount, name)
+}
+
+// DoInstanceStore formats and mounts the instance store disks, then bind
+// mounts a directory from them on each path. No fstab entry is written, as
+// the disks may be blank on the next boot.
+func DoInstanceStore(ctx context.Context, spec *VolumeSpec, paths []string) error {
+	if len(paths) == 0 {
+		return fmt.Errorf("At least one instance store path is required")
+	}
+	if err := spec.validateFilesystem(); err != nil {
+		return err
+	}
+	devices, err := InstanceStoreDevices()
+	if err != nil {
+		return err
+	}
+	device, err := EnsureArray(ctx, devices)
+	if err != nil {
+		return err
+	}
+	hasFs, err := HasFilesystem(ctx, device, spec.FsType)
+	if err != nil {
+		return err
+	}
+	if !hasFs {
+		logging.Info("Creating filesystem", "fstype", spec.FsType, "device", device)
+		if err = MakeFilesystem(ctx, device, spec.FsType, spec.mkfsOptions()...); err != nil {
+			return err
+		}
+	}
+	if err = os.MkdirAll(InstanceStoreMount, 0755); err != nil {
+		return err
+	}
+	if err = MountFilesystem(device, spec.FsType, InstanceStoreMount, spec.mountOptions()); err != nil {
+		return err
+	}
+	for _, path := range paths {
+		source := bindSource(path)
+		if err = os.MkdirAll(source, 0755); err != nil {
+			return err
+		}
+		if err = os.MkdirAll(path, 0755); err != nil {
+			return err
+		}
+		mounted, err := IsMounted(path)
+		if err != nil {
+			return err
+		}
+		if mounted {
+			continue
+		}
+		if err = bindMount(source, path); err != nil {
+			return fmt.Errorf("Failed to bind mount %s on %s: %v", source, path, err)
+		}
+	}
+	return nil
+}
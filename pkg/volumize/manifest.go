@@ -0,0 +1,141 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package volumize
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// VolumeSpec describes one EBS volume to attach, format, and mount.
+type VolumeSpec struct {
+	Tag          string   `yaml:"tag"`
+	Device       string   `yaml:"device"`
+	FsType       string   `yaml:"fstype"`
+	MountPoint   string   `yaml:"mountPoint"`
+	MkfsOptions  []string `yaml:"mkfsOptions"`
+	MountOptions []string `yaml:"mountOptions"`
+
+	// Label and ReservedBlocksPercent are passed to mkfs when the volume is
+	// formatted. Reserved blocks only apply to ext filesystems.
+	Label                 string `yaml:"label"`
+	ReservedBlocksPercent *int   `yaml:"reservedBlocksPercent"`
+
+	// If MountUnit is set, the filesystem is mounted by a systemd mount
+	// unit rather than fstab, with nofail and the given device timeout.
+	MountUnit     bool          `yaml:"mountUnit"`
+	DeviceTimeout time.Duration `yaml:"deviceTimeout"`
+
+	// If Grow is set, the filesystem is grown to fill the volume after it
+	// is mounted, in case the volume has been modified to be larger.
+	Grow bool `yaml:"grow"`
+
+	// Member is the value of Tag for this instance's volume, such as "1"
+	// for the volume tagged etcd:instance=1. It is required if Create or
+	// Migrate is set.
+	Member string `yaml:"member"`
+
+	// If Migrate is set and no volume is available, the member's volume
+	// in another availability zone is copied into this one.
+	Migrate bool `yaml:"migrate"`
+
+	// Policy is checked before a volume is attached.
+	Policy Policy `yaml:"policy"`
+
+	// If Create is set and no volume is available, a volume is created
+	// with the following properties, from the member's latest snapshot
+	// if there is one.
+	Create     bool   `yaml:"create"`
+	Size       int64  `yaml:"size"`
+	VolumeType string `yaml:"volumeType"`
+	Iops       int64  `yaml:"iops"`
+	Throughput int64  `yaml:"throughput"`
+	KMSKeyID   string `yaml:"kmsKeyId"`
+
+	// Created volumes are encrypted unless Encrypted is false, and always
+	// if KMSKeyID is set or the policy requires encryption.
+	Encrypted *bool `yaml:"encrypted"`
+}
+
+// Manifest lists volumes to be volumized in order, for example:
+//
+//	clusterName: legbegbe
+//	volumes:
+//	  - tag: etcd:instance
+//	    device: /dev/xvdg
+//	    mountPoint: /var/lib/etcd
+//	  - tag: containerd
+//	    device: /dev/xvdh
+//	    fstype: xfs
+//	    mountPoint: /var/lib/containerd
+//	    mountOptions: [noatime]
+type Manifest struct {
+	ClusterName string       `yaml:"clusterName"`
+	Volumes     []VolumeSpec `yaml:"volumes"`
+}
+
+func ParseManifest(contents []byte) (*Manifest, error) {
+	var manifest Manifest
+	if err := yaml.UnmarshalStrict(contents, &manifest); err != nil {
+		return nil, err
+	}
+	if len(manifest.Volumes) == 0 {
+		return nil, fmt.Errorf("manifest has no volumes")
+	}
+	devices := make(map[string]bool)
+	mountPoints := make(map[string]bool)
+	for i := range manifest.Volumes {
+		spec := &manifest.Volumes[i]
+		if spec.Tag == "" || spec.Device == "" || spec.MountPoint == "" {
+			return nil, fmt.Errorf("volume %d must have tag, device, and mountPoint", i+1)
+		}
+		if mountPoints[spec.MountPoint] {
+			return nil, fmt.Errorf("mount point %s is used more than once", spec.MountPoint)
+		}
+		mountPoints[spec.MountPoint] = true
+		device := NormalizeDevice(spec.Device)
+		if devices[device] {
+			return nil, fmt.Errorf("device %s is used more than once", device)
+		}
+		devices[device] = true
+		if (spec.Create || spec.Migrate) && spec.Member == "" {
+			return nil, fmt.Errorf("volume %d must have member to be created or migrated", i+1)
+		}
+		if spec.FsType == "" {
+			spec.FsType = "ext4"
+		}
+		if err := spec.validateFilesystem(); err != nil {
+			return nil, fmt.Errorf("volume %d: %v", i+1, err)
+		}
+	}
+	return &manifest, nil
+}
+
+func LoadManifest(path string) (*Manifest, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseManifest(contents)
+}
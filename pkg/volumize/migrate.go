@@ -0,0 +1,209 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package volumize
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/cloudboss/keights/pkg/helpers"
+	"github.com/cloudboss/keights/pkg/logging"
+)
+
+const (
+	// Tags put on a volume when it is retired after migration, replacing
+	// the volume tag so that it is no longer found for the member.
+	RetiredTag       = "keights:retired"
+	RetiredMemberTag = "keights:retired-member"
+	// MigratedFromTag is put on a volume created by migration, with the ID
+	// of the volume it was copied from, so that a migration interrupted
+	// before the original was retired can be finished.
+	MigratedFromTag = "keights:migrated-from"
+)
+
+// StrandedVolumes returns the member's unattached volumes in availability
+// zones other than this instance's.
+func (v *Volumizer) StrandedVolumes(ctx context.Context, clusterName, volumeTag, member string) ([]*ec2.Volume, error) {
+	filters := append(tagFilters(clusterName, volumeTag, member),
+		&ec2.Filter{
+			Name:   aws.String("status"),
+			Values: []*string{aws.String("available")},
+		},
+	)
+	output, err := v.ec2.DescribeVolumesWithContext(ctx, &ec2.DescribeVolumesInput{Filters: filters})
+	if err != nil {
+		return nil, err
+	}
+	stranded := []*ec2.Volume{}
+	for _, volume := range output.Volumes {
+		if aws.StringValue(volume.AvailabilityZone) != v.availabilityZone {
+			stranded = append(stranded, volume)
+		}
+	}
+	return stranded, nil
+}
+
+func (v *Volumizer) WaitForSnapshot(ctx context.Context, snapshotID string, duration time.Duration) (*ec2.Snapshot, error) {
+	var snapshot *ec2.Snapshot
+	input := &ec2.DescribeSnapshotsInput{SnapshotIds: []*string{aws.String(snapshotID)}}
+	err := helpers.WaitFor(ctx, duration, func() error {
+		output, err := v.ec2.DescribeSnapshotsWithContext(ctx, input)
+		if err != nil {
+			return err
+		}
+		if len(output.Snapshots) != 1 {
+			return fmt.Errorf("Snapshot %s not found", snapshotID)
+		}
+		snapshot = output.Snapshots[0]
+		switch state := aws.StringValue(snapshot.State); state {
+		case ec2.SnapshotStateCompleted:
+			return nil
+		case ec2.SnapshotStateError:
+			return helpers.Permanent(fmt.Errorf("Snapshot %s failed: %s",
+				snapshotID, aws.StringValue(snapshot.StateMessage)))
+		default:
+			return fmt.Errorf("Snapshot %s is %s", snapshotID, state)
+		}
+	})
+	return snapshot, err
+}
+
+// migrationSpec fills in the properties of the new volume from the old one
+// where they are not given explicitly.
+func migrationSpec(spec *VolumeSpec, old *ec2.Volume) *VolumeSpec {
+	migrated := *spec
+	if migrated.Size == 0 {
+		migrated.Size = aws.Int64Value(old.Size)
+	}
+	if migrated.VolumeType == "" {
+		migrated.VolumeType = aws.StringValue(old.VolumeType)
+		if migrated.Iops == 0 && (migrated.VolumeType == ec2.VolumeTypeIo1 ||
+			migrated.VolumeType == ec2.VolumeTypeIo2 || migrated.VolumeType == ec2.VolumeTypeGp3) {
+			migrated.Iops = aws.Int64Value(old.Iops)
+		}
+		if migrated.Throughput == 0 && migrated.VolumeType == ec2.VolumeTypeGp3 {
+			migrated.Throughput = aws.Int64Value(old.Throughput)
+		}
+	}
+	if migrated.KMSKeyID == "" {
+		migrated.KMSKeyID = aws.StringValue(old.KmsKeyId)
+	}
+	return &migrated
+}
+
+func (v *Volumizer) RetireVolume(ctx context.Context, volume *ec2.Volume, volumeTag string) error {
+	member := tagValue(volume.Tags, volumeTag)
+	_, err := v.ec2.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+		Resources: []*string{volume.VolumeId},
+		Tags: []*ec2.Tag{
+			{Key: aws.String(RetiredTag), Value: aws.String(time.Now().UTC().Format(time.RFC3339))},
+			{Key: aws.String(RetiredMemberTag), Value: aws.String(member)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = v.ec2.DeleteTagsWithContext(ctx, &ec2.DeleteTagsInput{
+		Resources: []*string{volume.VolumeId},
+		Tags:      []*ec2.Tag{{Key: aws.String(volumeTag)}},
+	})
+	return err
+}
+
+// ResumeMigration retires the volume that volume was migrated from, if it
+// has not been retired already because volumize was interrupted after the
+// new volume was created.
+func (v *Volumizer) ResumeMigration(ctx context.Context, volume *ec2.Volume, volumeTag string) error {
+	sourceID := tagValue(volume.Tags, MigratedFromTag)
+	if sourceID == "" {
+		return nil
+	}
+	output, err := v.ec2.DescribeVolumesWithContext(ctx, &ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(sourceID)},
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "InvalidVolume.NotFound" {
+			return nil
+		}
+		return err
+	}
+	member := tagValue(volume.Tags, volumeTag)
+	for _, source := range output.Volumes {
+		if tagValue(source.Tags, volumeTag) != member {
+			continue
+		}
+		logging.Info("Resuming migration, retiring volume", "volume", sourceID)
+		return v.RetireVolume(ctx, source, volumeTag)
+	}
+	return nil
+}
+
+// MigrateVolume copies the member's volume from another availability zone
+// into this one, by way of a snapshot, and retires the original. The new
+// volume is tagged with the ID of the original before the original is
+// retired, so an interrupted migration is finished by ResumeMigration
+// rather than started again. It returns nil if there is no volume to
+// migrate.
+func (v *Volumizer) MigrateVolume(ctx context.Context, clusterName string, spec *VolumeSpec, minutes int) (*ec2.Volume, error) {
+	stranded, err := v.StrandedVolumes(ctx, clusterName, spec.Tag, spec.Member)
+	if err != nil {
+		return nil, err
+	}
+	switch len(stranded) {
+	case 0:
+		return nil, nil
+	case 1:
+	default:
+		return nil, fmt.Errorf("Expected at most 1 volume in other availability zones, found %d", len(stranded))
+	}
+	old := stranded[0]
+	logging.Info("Migrating volume", "volume", *old.VolumeId,
+		"from", *old.AvailabilityZone, "to", v.availabilityZone)
+
+	snapshot, err := v.Snapshot(ctx, clusterName, spec.Tag, old, "")
+	if err != nil {
+		return nil, err
+	}
+	snapshot, err = v.WaitForSnapshot(ctx, *snapshot.SnapshotId, time.Duration(minutes)*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	input := v.createVolumeInput(clusterName, migrationSpec(spec, old), snapshot)
+	input.TagSpecifications[0].Tags = append(input.TagSpecifications[0].Tags,
+		&ec2.Tag{Key: aws.String(MigratedFromTag), Value: old.VolumeId})
+	volume, err := v.ec2.CreateVolumeWithContext(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	volume, err = v.WaitForVolumeState(ctx, *volume.VolumeId, ec2.VolumeStateAvailable, 10*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	logging.Info("Retiring volume", "volume", *old.VolumeId)
+	if err = v.RetireVolume(ctx, old, spec.Tag); err != nil {
+		return nil, err
+	}
+	return volume, nil
+}
@@ -0,0 +1,88 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package volumize
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrateVolume(t *testing.T) {
+	fastBackoff(t)
+	interrupted := memberVolume("vol-2", "az-a", ec2.VolumeStateAvailable)
+	interrupted.Tags = append(interrupted.Tags,
+		&ec2.Tag{Key: aws.String(MigratedFromTag), Value: aws.String("vol-1")})
+	var testCases = []struct {
+		name     string
+		volumes  []*ec2.Volume
+		pending  map[string]int
+		expected string
+		created  int
+	}{
+		{
+			"stranded",
+			[]*ec2.Volume{memberVolume("vol-1", "az-b", ec2.VolumeStateAvailable)},
+			nil,
+			"vol-new1",
+			1,
+		},
+		{
+			"stranded-while-old-instance-terminates",
+			[]*ec2.Volume{memberVolume("vol-1", "az-b", ec2.VolumeStateInUse)},
+			map[string]int{"vol-1": 2},
+			"vol-new1",
+			1,
+		},
+		{
+			"interrupted-before-retiring",
+			[]*ec2.Volume{memberVolume("vol-1", "az-b", ec2.VolumeStateAvailable), interrupted},
+			nil,
+			"vol-2",
+			0,
+		},
+	}
+	for _, tc := range testCases {
+		client := &memEC2{volumes: tc.volumes, pending: tc.pending}
+		v := &Volumizer{ec2: client, availabilityZone: "az-a", instanceID: "i-me"}
+		spec := &VolumeSpec{Tag: "etcd:instance", Member: "1", Migrate: true}
+		volume, err := v.FindVolume(context.Background(), "cb", spec, 1)
+		assert.NoError(t, err, tc.name)
+		assert.Equal(t, tc.expected, aws.StringValue(volume.VolumeId), tc.name)
+		assert.Len(t, client.created, tc.created, tc.name)
+
+		migrated := client.volume(tc.expected)
+		assert.Equal(t, "vol-1", tagValue(migrated.Tags, MigratedFromTag), tc.name)
+		assert.Equal(t, "1", tagValue(migrated.Tags, "etcd:instance"), tc.name)
+		retired := client.volume("vol-1")
+		assert.False(t, hasTag(retired.Tags, "etcd:instance"), tc.name)
+		assert.Equal(t, "1", tagValue(retired.Tags, RetiredMemberTag), tc.name)
+
+		// Running again finds the migrated volume and changes nothing.
+		volume, err = v.FindVolume(context.Background(), "cb", spec, 1)
+		assert.NoError(t, err, tc.name)
+		assert.Equal(t, tc.expected, aws.StringValue(volume.VolumeId), tc.name)
+		assert.Len(t, client.created, tc.created, tc.name)
+	}
+}
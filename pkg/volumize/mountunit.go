@@ -0,0 +1,117 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package volumize
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cloudboss/keights/pkg/helpers"
+)
+
+const Systemctl = "systemctl"
+
+var (
+	// SystemdUnitDir is where mount units are written. It is a variable
+	// so tests can point it elsewhere.
+	SystemdUnitDir = "/etc/systemd/system"
+
+	DefaultDeviceTimeout = 90 * time.Second
+)
+
+// MountUnitName returns the name of the systemd mount unit for a mount
+// point, escaped as by `systemd-escape --path --suffix=mount`.
+func MountUnitName(mountPoint string) string {
+	path := strings.Trim(filepath.Clean(mountPoint), "/")
+	if path == "" {
+		return "-.mount"
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case c == '/':
+			b.WriteByte('-')
+		case c == '.' && i == 0:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9',
+			c == ':', c == '_', c == '.':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		}
+	}
+	return b.String() + ".mount"
+}
+
+func mountUnit(uuid, fsType, mountPoint string, mountOptions []string, deviceTimeout time.Duration) []byte {
+	options := append([]string{}, mountOptions...)
+	options = append(options, "nofail",
+		fmt.Sprintf("x-systemd.device-timeout=%ds", int(deviceTimeout.Seconds())))
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "[Unit]\n")
+	fmt.Fprintf(&b, "Description=keights volume mounted on %s\n", mountPoint)
+	fmt.Fprintf(&b, "\n[Mount]\n")
+	fmt.Fprintf(&b, "What=/dev/disk/by-uuid/%s\n", uuid)
+	fmt.Fprintf(&b, "Where=%s\n", mountPoint)
+	fmt.Fprintf(&b, "Type=%s\n", fsType)
+	fmt.Fprintf(&b, "Options=%s\n", strings.Join(options, ","))
+	fmt.Fprintf(&b, "\n[Install]\n")
+	fmt.Fprintf(&b, "WantedBy=local-fs.target\n")
+	return b.Bytes()
+}
+
+// PersistMountUnit writes a systemd mount unit for the filesystem instead of
+// an fstab entry, so that other units can depend on the mount directly. Any
+// fstab entry for the mount point is removed so the two do not conflict.
+func PersistMountUnit(uuid, fsType, mountPoint string, mountOptions []string,
+	deviceTimeout time.Duration, fstabPath string) error {
+	if len(mountOptions) == 0 {
+		mountOptions = DefaultMountOptions(fsType)
+	}
+	if deviceTimeout == 0 {
+		deviceTimeout = DefaultDeviceTimeout
+	}
+	if err := updateFstab(fstabPath, mountPoint, ""); err != nil {
+		return err
+	}
+	unitPath := filepath.Join(SystemdUnitDir, MountUnitName(mountPoint))
+	unit := mountUnit(uuid, fsType, mountPoint, mountOptions, deviceTimeout)
+	return helpers.WriteIfChanged(unitPath, unit, 0644)
+}
+
+func EnsureMountUnitStarted(ctx context.Context, mountPoint string) error {
+	unitName := MountUnitName(mountPoint)
+	for _, args := range [][]string{
+		{"daemon-reload"},
+		{"enable", unitName},
+		{"start", unitName},
+	} {
+		if _, err := run(ctx, Systemctl, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package volumize
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+)
+
+// Policy is a set of rules a volume must satisfy before it is attached.
+// The zero value allows any volume.
+type Policy struct {
+	RequireEncryption bool     `yaml:"requireEncryption"`
+	KMSKeyID          string   `yaml:"kmsKeyId"`
+	RequireTags       bool     `yaml:"requireTags"`
+	MinSize           int64    `yaml:"minSize"`
+	VolumeTypes       []string `yaml:"volumeTypes"`
+}
+
+// ResolveKMSKey replaces a KMS key alias in the policy with the ARN of the
+// key it refers to, since volumes only record the key ARN.
+func (p *Policy) ResolveKMSKey(ctx context.Context, client kmsiface.KMSAPI) error {
+	if !strings.HasPrefix(p.KMSKeyID, "alias/") && !strings.Contains(p.KMSKeyID, ":alias/") {
+		return nil
+	}
+	output, err := client.DescribeKeyWithContext(ctx, &kms.DescribeKeyInput{KeyId: aws.String(p.KMSKeyID)})
+	if err != nil {
+		return err
+	}
+	p.KMSKeyID = aws.StringValue(output.KeyMetadata.Arn)
+	return nil
+}
+
+func kmsKeyMatches(keyARN, keyID string) bool {
+	return keyARN == keyID || strings.HasSuffix(keyARN, fmt.Sprintf(":key/%s", keyID))
+}
+
+// Check returns an error naming every rule of the policy that the volume
+// violates, or nil if there are none.
+func (p *Policy) Check(volume *ec2.Volume, clusterName string, spec *VolumeSpec) error {
+	violations := []string{}
+	encrypted := aws.BoolValue(volume.Encrypted)
+	if (p.RequireEncryption || p.KMSKeyID != "") && !encrypted {
+		violations = append(violations, "encryption is required but volume is not encrypted")
+	}
+	if p.KMSKeyID != "" && encrypted {
+		if keyARN := aws.StringValue(volume.KmsKeyId); !kmsKeyMatches(keyARN, p.KMSKeyID) {
+			violations = append(violations,
+				fmt.Sprintf("KMS key %s is required but volume is encrypted with %s", p.KMSKeyID, keyARN))
+		}
+	}
+	if p.RequireTags {
+		if name := tagValue(volume.Tags, "Name"); name != clusterName {
+			violations = append(violations,
+				fmt.Sprintf("tag Name must be %s but is %q", clusterName, name))
+		}
+		if spec.Member == "" {
+			violations = append(violations, "member tag is required but no member was given")
+		} else if member := tagValue(volume.Tags, spec.Tag); member != spec.Member {
+			violations = append(violations,
+				fmt.Sprintf("tag %s must be %s but is %q", spec.Tag, spec.Member, member))
+		}
+	}
+	if size := aws.Int64Value(volume.Size); p.MinSize > 0 && size < p.MinSize {
+		violations = append(violations,
+			fmt.Sprintf("size must be at least %d GiB but is %d GiB", p.MinSize, size))
+	}
+	if len(p.VolumeTypes) > 0 {
+		volumeType := aws.StringValue(volume.VolumeType)
+		allowed := false
+		for _, t := range p.VolumeTypes {
+			if t == volumeType {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			violations = append(violations,
+				fmt.Sprintf("type must be one of %s but is %s", strings.Join(p.VolumeTypes, ", "), volumeType))
+		}
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("Volume %s violates policy: %s",
+			aws.StringValue(volume.VolumeId), strings.Join(violations, "; "))
+	}
+	return nil
+}
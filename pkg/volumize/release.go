@@ -0,0 +1,191 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package volumize
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/cloudboss/keights/pkg/logging"
+	"github.com/cloudboss/keights/pkg/metadata"
+)
+
+const (
+	// ReleasedTag is put on a volume with the time it was released.
+	ReleasedTag = "keights:released"
+
+	// TerminatedState is the target lifecycle state of an instance that its
+	// autoscaling group is terminating.
+	TerminatedState = "Terminated"
+)
+
+// TargetLifecycleState returns the state the instance's autoscaling group is
+// moving it to. It is a variable so tests can replace it.
+var TargetLifecycleState = metadata.TargetLifecycleState
+
+// releaseWanted returns whether volumes should be released. Unless
+// onlyTerminating is false, that is only when the instance is being
+// terminated, so a reboot keeps its volumes attached rather than handing
+// them to another instance. If the state cannot be found, as when the
+// instance is not in an autoscaling group, nothing is released.
+func releaseWanted(ctx context.Context, onlyTerminating bool) bool {
+	if !onlyTerminating {
+		return true
+	}
+	state, err := TargetLifecycleState(ctx)
+	if err != nil {
+		logging.Warn("Unable to get target lifecycle state, not releasing", "error", err)
+		return false
+	}
+	if state != TerminatedState {
+		logging.Info("Instance is not terminating, not releasing", "state", state)
+		return false
+	}
+	return true
+}
+
+func StopUnits(ctx context.Context, units []string) error {
+	if len(units) == 0 {
+		return nil
+	}
+	args := append([]string{"stop"}, units...)
+	_, err := run(ctx, Systemctl, args...)
+	return err
+}
+
+func UnmountFilesystem(mountPoint string) error {
+	mounted, err := IsMounted(mountPoint)
+	if err != nil {
+		return err
+	}
+	if !mounted {
+		return nil
+	}
+	if err = unmount(mountPoint); err != nil {
+		return fmt.Errorf("Failed to unmount %s: %v", mountPoint, err)
+	}
+	return nil
+}
+
+func (v *Volumizer) DetachVolume(ctx context.Context, volume *ec2.Volume, device string) error {
+	_, err := v.ec2.DetachVolumeWithContext(ctx, &ec2.DetachVolumeInput{
+		Device:     aws.String(device),
+		InstanceId: aws.String(v.instanceID),
+		VolumeId:   volume.VolumeId,
+	})
+	return err
+}
+
+func (v *Volumizer) TagReleased(ctx context.Context, volume *ec2.Volume) error {
+	_, err := v.ec2.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+		Resources: []*string{volume.VolumeId},
+		Tags: []*ec2.Tag{
+			{Key: aws.String(ReleasedTag), Value: aws.String(time.Now().UTC().Format(time.RFC3339))},
+		},
+	})
+	return err
+}
+
+// Release hands the volume off so that a replacement instance can attach it
+// without waiting for this instance to terminate. It stops the units using
+// the volume, unmounts it, detaches it, and waits for it to be available.
+// It does nothing if the volume is not attached.
+func (v *Volumizer) Release(ctx context.Context, clusterName string, spec *VolumeSpec, units []string, minutes int) error {
+	device := NormalizeDevice(spec.Device)
+	volume, err := v.AttachedVolume(ctx, clusterName, spec.Tag, spec.Member, device)
+	if err != nil {
+		return err
+	}
+	if volume == nil {
+		logging.Info("No volume attached", "tag", spec.Tag, "device", device)
+		return nil
+	}
+	if err = StopUnits(ctx, units); err != nil {
+		return err
+	}
+	if spec.MountUnit {
+		err = StopUnits(ctx, []string{MountUnitName(spec.MountPoint)})
+	} else {
+		err = UnmountFilesystem(spec.MountPoint)
+	}
+	if err != nil {
+		return err
+	}
+	logging.Info("Detaching volume", "volume", *volume.VolumeId)
+	if err = v.DetachVolume(ctx, volume, device); err != nil {
+		return err
+	}
+	duration := time.Duration(minutes) * time.Minute
+	if _, err = v.WaitForVolumeState(ctx, *volume.VolumeId, ec2.VolumeStateAvailable, duration); err != nil {
+		return err
+	}
+	if err = v.UnclaimVolume(ctx, volume); err != nil {
+		return err
+	}
+	return v.TagReleased(ctx, volume)
+}
+
+func DoRelease(ctx context.Context, spec *VolumeSpec, clusterName string, units []string,
+	minutes int, onlyTerminating bool) error {
+	logging.AddFields("cluster", clusterName)
+	if !releaseWanted(ctx, onlyTerminating) {
+		return nil
+	}
+	volumizer, err := newVolumizer()
+	if err != nil {
+		return err
+	}
+	return volumizer.Release(ctx, clusterName, spec, units, minutes)
+}
+
+// DoReleaseManifest releases the volumes of a manifest in reverse order,
+// since later volumes may be mounted beneath earlier ones.
+func DoReleaseManifest(ctx context.Context, manifestPath, clusterName string, units []string,
+	minutes int, onlyTerminating bool) error {
+	manifest, err := LoadManifest(manifestPath)
+	if err != nil {
+		return err
+	}
+	if manifest.ClusterName != "" {
+		clusterName = manifest.ClusterName
+	}
+	logging.AddFields("cluster", clusterName)
+	if !releaseWanted(ctx, onlyTerminating) {
+		return nil
+	}
+	volumizer, err := newVolumizer()
+	if err != nil {
+		return err
+	}
+	if err = StopUnits(ctx, units); err != nil {
+		return err
+	}
+	for i := len(manifest.Volumes) - 1; i >= 0; i-- {
+		spec := &manifest.Volumes[i]
+		if err = volumizer.Release(ctx, clusterName, spec, nil, minutes); err != nil {
+			return fmt.Errorf("volume %s: %v", spec.Tag, err)
+		}
+	}
+	return nil
+}
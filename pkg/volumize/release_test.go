@@ -0,0 +1,121 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package volumize
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/cloudboss/keights/pkg/runner"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReleaseWanted(t *testing.T) {
+	defer func(f func(context.Context) (string, error)) { TargetLifecycleState = f }(TargetLifecycleState)
+	var testCases = []struct {
+		name            string
+		onlyTerminating bool
+		state           string
+		err             error
+		expected        bool
+	}{
+		{"always", false, "InService", nil, true},
+		{"terminating", true, "Terminated", nil, true},
+		{"reboot", true, "InService", nil, false},
+		{"standby", true, "Standby", nil, false},
+		{"not-in-asg", true, "", errors.New("EC2MetadataError: 404"), false},
+	}
+	for _, tc := range testCases {
+		TargetLifecycleState = func(ctx context.Context) (string, error) {
+			return tc.state, tc.err
+		}
+		assert.Equal(t, tc.expected, releaseWanted(context.Background(), tc.onlyTerminating), tc.name)
+	}
+}
+
+func attachedVolume() *ec2.Volume {
+	volume := memberVolume("vol-1", "az-a", ec2.VolumeStateInUse)
+	volume.Attachments = []*ec2.VolumeAttachment{
+		{InstanceId: aws.String("i-me"), Device: aws.String("/dev/xvdg")},
+	}
+	volume.Tags = append(volume.Tags, &ec2.Tag{Key: aws.String(ClaimTag), Value: aws.String("i-me")})
+	return volume
+}
+
+func TestRelease(t *testing.T) {
+	fastBackoff(t)
+	defer func(r runner.Runner) { Runner = r }(Runner)
+	mountPoint := t.TempDir()
+	var testCases = []struct {
+		name      string
+		volumes   []*ec2.Volume
+		mountUnit bool
+		calls     []string
+	}{
+		{
+			"attached",
+			[]*ec2.Volume{attachedVolume()},
+			false,
+			[]string{"systemctl stop etcd.service"},
+		},
+		{
+			"attached-with-mount-unit",
+			[]*ec2.Volume{attachedVolume()},
+			true,
+			[]string{"systemctl stop etcd.service", "systemctl stop " + MountUnitName(mountPoint)},
+		},
+		{
+			"not-attached",
+			[]*ec2.Volume{memberVolume("vol-1", "az-a", ec2.VolumeStateAvailable)},
+			false,
+			nil,
+		},
+	}
+	for _, tc := range testCases {
+		fake := runner.NewFake(map[string]*runner.Result{
+			"systemctl stop etcd.service":                 {},
+			"systemctl stop " + MountUnitName(mountPoint): {},
+		})
+		Runner = fake
+		client := &memEC2{volumes: tc.volumes}
+		v := &Volumizer{ec2: client, availabilityZone: "az-a", instanceID: "i-me"}
+		spec := &VolumeSpec{
+			Tag:        "etcd:instance",
+			Member:     "1",
+			Device:     "xvdg",
+			MountPoint: mountPoint,
+			MountUnit:  tc.mountUnit,
+		}
+		err := v.Release(context.Background(), "cb", spec, []string{"etcd.service"}, 1)
+		assert.NoError(t, err, tc.name)
+		assert.Equal(t, tc.calls, fake.Calls, tc.name)
+
+		volume := client.volume("vol-1")
+		assert.Equal(t, ec2.VolumeStateAvailable, aws.StringValue(volume.State), tc.name)
+		assert.Empty(t, volume.Attachments, tc.name)
+		assert.False(t, hasTag(volume.Tags, ClaimTag), tc.name)
+		assert.Equal(t, tc.calls != nil, hasTag(volume.Tags, ReleasedTag), tc.name)
+		assert.Equal(t, "1", tagValue(volume.Tags, "etcd:instance"), tc.name)
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package volumize
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/cloudboss/keights/pkg/logging"
+)
+
+const (
+	Fsfreeze = "fsfreeze"
+
+	// SnapshotTimestampTag marks snapshots taken by keights, so that only
+	// those are considered for pruning.
+	SnapshotTimestampTag = "keights:timestamp"
+)
+
+// Retention determines which snapshots are pruned. A snapshot is pruned if
+// it is not among the Keep most recent, or if it is older than MaxAge. A
+// zero value for either disables that rule.
+type Retention struct {
+	Keep   int
+	MaxAge time.Duration
+}
+
+func tagValue(tags []*ec2.Tag, key string) string {
+	for _, tag := range tags {
+		if aws.StringValue(tag.Key) == key {
+			return aws.StringValue(tag.Value)
+		}
+	}
+	return ""
+}
+
+func FreezeFilesystem(ctx context.Context, mountPoint string) error {
+	_, err := run(ctx, Fsfreeze, "--freeze", mountPoint)
+	return err
+}
+
+func UnfreezeFilesystem(ctx context.Context, mountPoint string) error {
+	_, err := run(ctx, Fsfreeze, "--unfreeze", mountPoint)
+	return err
+}
+
+// Snapshot creates a snapshot of the volume, tagged with the cluster, the
+// member, and the time. If freezeMountPoint is not empty, the filesystem
+// mounted there is frozen until the snapshot has been started, which is
+// the point in time the snapshot captures.
+func (v *Volumizer) Snapshot(ctx context.Context, clusterName, volumeTag string, volume *ec2.Volume, freezeMountPoint string) (*ec2.Snapshot, error) {
+	now := time.Now().UTC()
+	member := tagValue(volume.Tags, volumeTag)
+	input := &ec2.CreateSnapshotInput{
+		VolumeId:    volume.VolumeId,
+		Description: aws.String(fmt.Sprintf("%s %s=%s", clusterName, volumeTag, member)),
+		TagSpecifications: []*ec2.TagSpecification{
+			{
+				ResourceType: aws.String(ec2.ResourceTypeSnapshot),
+				Tags: []*ec2.Tag{
+					{Key: aws.String("Name"), Value: aws.String(clusterName)},
+					{Key: aws.String(volumeTag), Value: aws.String(member)},
+					{Key: aws.String(SnapshotTimestampTag), Value: aws.String(now.Format(time.RFC3339))},
+				},
+			},
+		},
+	}
+	if freezeMountPoint != "" {
+		if err := FreezeFilesystem(ctx, freezeMountPoint); err != nil {
+			return nil, err
+		}
+	}
+	snapshot, err := v.ec2.CreateSnapshotWithContext(ctx, input)
+	if freezeMountPoint != "" {
+		// The filesystem is thawed even if ctx was canceled while it was
+		// frozen, or writes to it would block until the next boot.
+		unfreezeErr := UnfreezeFilesystem(context.Background(), freezeMountPoint)
+		if unfreezeErr != nil && err == nil {
+			err = unfreezeErr
+		}
+	}
+	return snapshot, err
+}
+
+// Snapshots returns the snapshots keights has taken of the member's volume.
+func (v *Volumizer) Snapshots(ctx context.Context, clusterName, volumeTag, member string) ([]*ec2.Snapshot, error) {
+	filters := append(tagFilters(clusterName, volumeTag, member),
+		&ec2.Filter{
+			Name:   aws.String("tag-key"),
+			Values: []*string{aws.String(SnapshotTimestampTag)},
+		},
+	)
+	input := &ec2.DescribeSnapshotsInput{
+		Filters:  filters,
+		OwnerIds: []*string{aws.String("self")},
+	}
+	snapshots := []*ec2.Snapshot{}
+	err := v.ec2.DescribeSnapshotsPagesWithContext(ctx, input, func(out *ec2.DescribeSnapshotsOutput, lastPage bool) bool {
+		snapshots = append(snapshots, out.Snapshots...)
+		return !lastPage
+	})
+	return snapshots, err
+}
+
+func snapshotsToPrune(snapshots []*ec2.Snapshot, retention Retention, now time.Time) []*ec2.Snapshot {
+	sorted := make([]*ec2.Snapshot, len(snapshots))
+	copy(sorted, snapshots)
+	sort.Slice(sorted, func(i, j int) bool {
+		return aws.TimeValue(sorted[i].StartTime).After(aws.TimeValue(sorted[j].StartTime))
+	})
+	prune := []*ec2.Snapshot{}
+	for i, snapshot := range sorted {
+		tooMany := retention.Keep > 0 && i >= retention.Keep
+		tooOld := retention.MaxAge > 0 && now.Sub(aws.TimeValue(snapshot.StartTime)) > retention.MaxAge
+		if tooMany || tooOld {
+			prune = append(prune, snapshot)
+		}
+	}
+	return prune
+}
+
+func (v *Volumizer) PruneSnapshots(ctx context.Context, clusterName, volumeTag, member string, retention Retention) error {
+	snapshots, err := v.Snapshots(ctx, clusterName, volumeTag, member)
+	if err != nil {
+		return err
+	}
+	for _, snapshot := range snapshotsToPrune(snapshots, retention, time.Now()) {
+		logging.Info("Deleting snapshot", "snapshot", *snapshot.SnapshotId)
+		_, err = v.ec2.DeleteSnapshotWithContext(ctx, &ec2.DeleteSnapshotInput{SnapshotId: snapshot.SnapshotId})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func DoSnapshot(ctx context.Context, device, volumeTag, clusterName, freezeMountPoint string, retention Retention) error {
+	device = NormalizeDevice(device)
+	logging.AddFields("cluster", clusterName)
+	volumizer, err := newVolumizer()
+	if err != nil {
+		return err
+	}
+	volume, err := volumizer.AttachedVolume(ctx, clusterName, volumeTag, "", device)
+	if err != nil {
+		return err
+	}
+	if volume == nil {
+		return fmt.Errorf("No volume with tag %s attached at %s", volumeTag, device)
+	}
+	// Without a member, pruning would apply to the snapshots of all members.
+	member := tagValue(volume.Tags, volumeTag)
+	if member == "" {
+		return fmt.Errorf("Volume %s has no value for tag %s", *volume.VolumeId, volumeTag)
+	}
+	snapshot, err := volumizer.Snapshot(ctx, clusterName, volumeTag, volume, freezeMountPoint)
+	if err != nil {
+		return err
+	}
+	logging.Info("Created snapshot", "snapshot", *snapshot.SnapshotId, "volume", *volume.VolumeId)
+	return volumizer.PruneSnapshots(ctx, clusterName, volumeTag, member, retention)
+}
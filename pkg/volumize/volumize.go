@@ -21,18 +21,26 @@
 package volumize
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
 	"github.com/cloudboss/keights/pkg/helpers"
+	"github.com/cloudboss/keights/pkg/logging"
+	"github.com/cloudboss/keights/pkg/metadata"
+	"github.com/cloudboss/keights/pkg/runner"
 	"github.com/deniswernert/go-fstab"
 )
 
@@ -42,9 +50,22 @@ const (
 	Fstab = "/etc/fstab"
 )
 
+var (
+	// Locations where NVMe block devices are identified by EBS volume ID.
+	// These are variables so tests can point them elsewhere.
+	DiskByID = "/dev/disk/by-id"
+	SysBlock = "/sys/block"
+
+	// Runner runs external commands, and can be replaced in tests.
+	Runner runner.Runner = &runner.Exec{}
+	// CommandTimeout is the time after which an external command is killed.
+	CommandTimeout = 30 * time.Minute
+)
+
 type Volumizer struct {
 	autoscaling      *autoscaling.AutoScaling
-	ec2              *ec2.EC2
+	ec2              ec2iface.EC2API
+	kms              kmsiface.KMSAPI
 	availabilityZone string
 	instanceID       string
 }
@@ -53,32 +74,48 @@ func NewVolumizer(sess *session.Session, availabilityZone, instanceID string) *V
 	return &Volumizer{
 		autoscaling:      autoscaling.New(sess),
 		ec2:              ec2.New(sess),
+		kms:              kms.New(sess),
 		availabilityZone: availabilityZone,
 		instanceID:       instanceID,
 	}
 }
 
-func (v *Volumizer) AttachedVolume(clusterName, volumeTag, device *string) (*ec2.Volume, error) {
+// tagFilters select volumes or snapshots of the cluster with the volume tag,
+// and with the tag's value equal to member if it is given.
+func tagFilters(clusterName, volumeTag, member string) []*ec2.Filter {
 	filters := []*ec2.Filter{
 		{
 			Name:   aws.String("tag:Name"),
-			Values: []*string{clusterName},
+			Values: []*string{aws.String(clusterName)},
 		},
-		{
+	}
+	if member != "" {
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String(fmt.Sprintf("tag:%s", volumeTag)),
+			Values: []*string{aws.String(member)},
+		})
+	} else {
+		filters = append(filters, &ec2.Filter{
 			Name:   aws.String("tag-key"),
-			Values: []*string{volumeTag},
-		},
-		{
+			Values: []*string{aws.String(volumeTag)},
+		})
+	}
+	return filters
+}
+
+func (v *Volumizer) AttachedVolume(ctx context.Context, clusterName, volumeTag, member, device string) (*ec2.Volume, error) {
+	filters := append(tagFilters(clusterName, volumeTag, member),
+		&ec2.Filter{
 			Name:   aws.String("attachment.instance-id"),
 			Values: []*string{aws.String(v.instanceID)},
 		},
-		{
+		&ec2.Filter{
 			Name:   aws.String("attachment.device"),
-			Values: []*string{device},
+			Values: []*string{aws.String(device)},
 		},
-	}
+	)
 	input := &ec2.DescribeVolumesInput{Filters: filters}
-	output, err := v.ec2.DescribeVolumes(input)
+	output, err := v.ec2.DescribeVolumesWithContext(ctx, input)
 	if err != nil {
 		return nil, err
 	}
@@ -89,34 +126,35 @@ func (v *Volumizer) AttachedVolume(clusterName, volumeTag, device *string) (*ec2
 	return output.Volumes[0], nil
 }
 
-func (v *Volumizer) WaitForVolume(clusterName, volumeTag *string, minutes time.Duration) (*ec2.Volume, error) {
-	var output *ec2.DescribeVolumesOutput
-	filters := []*ec2.Filter{
-		{
-			Name:   aws.String("tag:Name"),
-			Values: []*string{clusterName},
-		},
-		{
-			Name:   aws.String("tag-key"),
-			Values: []*string{volumeTag},
-		},
-		{
+// AvailableVolumes returns the unattached volumes in this instance's
+// availability zone that match the cluster and volume tag.
+func (v *Volumizer) AvailableVolumes(ctx context.Context, clusterName, volumeTag, member string) ([]*ec2.Volume, error) {
+	filters := append(tagFilters(clusterName, volumeTag, member),
+		&ec2.Filter{
 			Name:   aws.String("availability-zone"),
 			Values: []*string{aws.String(v.availabilityZone)},
 		},
-		{
+		&ec2.Filter{
 			Name:   aws.String("status"),
 			Values: []*string{aws.String("available")},
 		},
+	)
+	output, err := v.ec2.DescribeVolumesWithContext(ctx, &ec2.DescribeVolumesInput{Filters: filters})
+	if err != nil {
+		return nil, err
 	}
-	input := &ec2.DescribeVolumesInput{Filters: filters}
-	err := helpers.WaitFor(minutes*time.Minute, func() error {
+	return output.Volumes, nil
+}
+
+func (v *Volumizer) WaitForVolume(ctx context.Context, clusterName, volumeTag, member string, minutes time.Duration) (*ec2.Volume, error) {
+	var volumes []*ec2.Volume
+	err := helpers.WaitFor(ctx, minutes*time.Minute, func() error {
 		var err error
-		output, err = v.ec2.DescribeVolumes(input)
+		volumes, err = v.AvailableVolumes(ctx, clusterName, volumeTag, member)
 		if err != nil {
 			return err
 		}
-		numVol := len(output.Volumes)
+		numVol := len(volumes)
 		if numVol != 1 {
 			return fmt.Errorf("Expected 1 volume, found %d", numVol)
 		}
@@ -125,21 +163,21 @@ func (v *Volumizer) WaitForVolume(clusterName, volumeTag *string, minutes time.D
 	if err != nil {
 		return nil, err
 	}
-	return output.Volumes[0], nil
+	return volumes[0], nil
 }
 
-func (v *Volumizer) AttachVolume(volume *ec2.Volume, device string) error {
+func (v *Volumizer) AttachVolume(ctx context.Context, volume *ec2.Volume, device string) error {
 	input := &ec2.AttachVolumeInput{
 		Device:     aws.String(device),
 		InstanceId: &v.instanceID,
 		VolumeId:   volume.VolumeId,
 	}
-	return helpers.WaitFor(10*time.Minute, func() error {
-		_, err := v.ec2.AttachVolume(input)
+	return helpers.WaitFor(ctx, 10*time.Minute, func() error {
+		_, err := v.ec2.AttachVolumeWithContext(ctx, input)
 		if err != nil {
 			if awsErr, ok := err.(awserr.Error); ok {
 				if awsErr.Code() == "VolumeInUse" {
-					return nil
+					return v.attachedHere(ctx, *volume.VolumeId)
 				}
 			}
 		}
@@ -147,18 +185,101 @@ func (v *Volumizer) AttachVolume(volume *ec2.Volume, device string) error {
 	})
 }
 
-func (v *Volumizer) WaitForDevice(device string) error {
-	return helpers.WaitFor(10*time.Minute, func() error {
-		_, err := os.Stat(device)
-		if err != nil {
-			return fmt.Errorf("No device %s found", device)
+// attachedHere returns an error unless the volume is attached to this
+// instance, since VolumeInUse may mean another instance attached it first.
+func (v *Volumizer) attachedHere(ctx context.Context, volumeID string) error {
+	volume, err := v.DescribeVolume(ctx, volumeID)
+	if err != nil {
+		return err
+	}
+	for _, attachment := range volume.Attachments {
+		if aws.StringValue(attachment.InstanceId) == v.instanceID {
+			return nil
 		}
-		return nil
+	}
+	if len(volume.Attachments) > 0 {
+		return fmt.Errorf("Volume %s is attached to %s", volumeID,
+			aws.StringValue(volume.Attachments[0].InstanceId))
+	}
+	return fmt.Errorf("Volume %s is in use but not attached", volumeID)
+}
+
+// WaitForDevice waits for the block device of an attached volume to appear
+// and returns its path. On Nitro instances, EBS volumes are NVMe devices
+// whose names are unrelated to the device given to AttachVolume, so the
+// device is found by its volume ID. On Xen instances, the device has the
+// name given to AttachVolume.
+func (v *Volumizer) WaitForDevice(ctx context.Context, volumeID, device string) (string, error) {
+	var resolved string
+	err := helpers.WaitFor(ctx, 10*time.Minute, func() error {
+		var err error
+		resolved, err = ResolveDevice(volumeID, device)
+		return err
 	})
+	return resolved, err
+}
+
+// ResolveDevice finds the block device for an EBS volume, first by the
+// udev symlink in /dev/disk/by-id, then by the serial number of each NVMe
+// device in sysfs, which is the volume ID without a hyphen, and finally by
+// the device name given to AttachVolume.
+func ResolveDevice(volumeID, device string) (string, error) {
+	serial := strings.Replace(volumeID, "-", "", 1)
+	byID := filepath.Join(DiskByID, fmt.Sprintf("nvme-Amazon_Elastic_Block_Store_%s", serial))
+	if resolved, err := filepath.EvalSymlinks(byID); err == nil {
+		return resolved, nil
+	}
+	nvmeDevices, err := filepath.Glob(filepath.Join(SysBlock, "nvme*n*"))
+	if err != nil {
+		return "", err
+	}
+	for _, nvmeDevice := range nvmeDevices {
+		deviceSerial, err := ioutil.ReadFile(filepath.Join(nvmeDevice, "device", "serial"))
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(string(deviceSerial)) == serial {
+			return filepath.Join("/dev", filepath.Base(nvmeDevice)), nil
+		}
+	}
+	if _, err := os.Stat(device); err == nil {
+		return device, nil
+	}
+	return "", fmt.Errorf("No device found for volume %s", volumeID)
+}
+
+// command runs an external command with Runner, returning its result
+// whatever the exit status.
+func command(ctx context.Context, name string, args ...string) (*runner.Result, error) {
+	return Runner.Run(ctx, newCommand(name, args))
+}
+
+// run runs an external command with Runner, returning an error if it exits
+// unsuccessfully.
+func run(ctx context.Context, name string, args ...string) (*runner.Result, error) {
+	return runner.Run(ctx, Runner, newCommand(name, args))
 }
 
-func (v *Volumizer) HasFilesystem(device, fstype string) (bool, error) {
-	blkid := helpers.RunCommand(Blkid, "-s", "TYPE", "-o", "value", device)
+// newCommand returns a command whose output is logged when debug logging
+// is enabled.
+func newCommand(name string, args []string) *runner.Command {
+	cmd := &runner.Command{
+		Name:    name,
+		Args:    args,
+		Timeout: CommandTimeout,
+	}
+	logger := logging.With("command", name)
+	if logger.Enabled(logging.LevelDebug) {
+		cmd.Output = logger.Writer(logging.LevelDebug)
+	}
+	return cmd
+}
+
+func HasFilesystem(ctx context.Context, device, fstype string) (bool, error) {
+	blkid, err := command(ctx, Blkid, "-s", "TYPE", "-o", "value", device)
+	if err != nil {
+		return false, err
+	}
 	if blkid.ExitStatus == 0 {
 		stdout := strings.TrimSpace(blkid.Stdout)
 		if stdout != fstype {
@@ -175,12 +296,11 @@ func (v *Volumizer) HasFilesystem(device, fstype string) (bool, error) {
 	return false, fmt.Errorf(blkid.Stderr)
 }
 
-func (v *Volumizer) MakeFilesystem(device, fstype string) error {
-	mkfs := helpers.RunCommand(Mkfs, "-t", fstype, device)
-	if mkfs.ExitStatus != 0 {
-		return fmt.Errorf(mkfs.Stderr)
-	}
-	return nil
+func MakeFilesystem(ctx context.Context, device, fstype string, options ...string) error {
+	args := append([]string{"-t", fstype}, options...)
+	args = append(args, device)
+	_, err := run(ctx, Mkfs, args...)
+	return err
 }
 
 func NormalizeDevice(device string) string {
@@ -190,90 +310,191 @@ func NormalizeDevice(device string) string {
 	return device
 }
 
-func GetUUID(device string) (string, error) {
-	blkid := helpers.RunCommand(Blkid, "-s", "UUID", "-o", "value", device)
-	if blkid.ExitStatus == 0 {
-		return strings.TrimSpace(blkid.Stdout), nil
+func GetUUID(ctx context.Context, device string) (string, error) {
+	blkid, err := run(ctx, Blkid, "-s", "UUID", "-o", "value", device)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get UUID of device %s: %v", device, err)
 	}
-	return "", fmt.Errorf("Failed to get UUID of device %s: %s", device, blkid.Stderr)
+	return strings.TrimSpace(blkid.Stdout), nil
 }
 
-func PersistFilesystem(uuid, fsType, mountPoint, fstabPath string) error {
-	spec := fmt.Sprintf("UUID=%s", uuid)
-	ourMount := &fstab.Mount{
-		Spec:    spec,
-		File:    mountPoint,
-		VfsType: fsType,
-		MntOps: map[string]string{
-			"noatime": "",
-			"errors":  "remount-ro",
-		},
+func fstabEntry(uuid, fsType, mountPoint string, mountOptions []string) string {
+	return fmt.Sprintf("UUID=%s %s %s %s 0 0", uuid, mountPoint, fsType, strings.Join(mountOptions, ","))
+}
+
+// reconcileFstab makes entry the only line in the fstab contents for its
+// mount point. It replaces the first line for the mount point, removes any
+// others, and appends entry if there were none. If entry is empty, it only
+// removes lines. Comments and other lines are left as they are.
+func reconcileFstab(contents, mountPoint, entry string) (string, error) {
+	original := []string{}
+	if trimmed := strings.TrimSuffix(contents, "\n"); trimmed != "" {
+		original = strings.Split(trimmed, "\n")
 	}
-	mounts, err := fstab.ParseFile(fstabPath)
+	lines := []string{}
+	replaced := false
+	for _, line := range original {
+		mount, err := fstab.ParseLine(line)
+		if err != nil {
+			return "", err
+		}
+		if mount == nil || filepath.Clean(mount.File) != filepath.Clean(mountPoint) {
+			lines = append(lines, line)
+			continue
+		}
+		if !replaced && entry != "" {
+			lines = append(lines, entry)
+			replaced = true
+		}
+	}
+	if !replaced && entry != "" {
+		lines = append(lines, entry)
+	}
+	if len(lines) == 0 {
+		return "", nil
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+func updateFstab(fstabPath, mountPoint, entry string) error {
+	contents, err := ioutil.ReadFile(fstabPath)
 	if err != nil {
 		return err
 	}
-	for _, mount := range mounts {
-		if mount.Spec == spec {
-			return nil
-		}
+	reconciled, err := reconcileFstab(string(contents), mountPoint, entry)
+	if err != nil {
+		return err
 	}
-	ourMountLine := []byte(ourMount.String() + "\n")
-	return helpers.AppendToFile(fstabPath, ourMountLine, 0644)
+	return helpers.WriteIfChanged(fstabPath, []byte(reconciled), 0644)
 }
 
-func EnsureFilesystemsMounted() error {
-	out := helpers.RunCommand("mount", "-a")
-	if out.ExitStatus != 0 {
-		return fmt.Errorf(out.Stderr)
+// PersistFilesystem ensures that fstab has exactly one entry for the mount
+// point, so that entries for volumes which have been replaced or reformatted
+// do not accumulate.
+func PersistFilesystem(uuid, fsType, mountPoint string, mountOptions []string, fstabPath string) error {
+	if len(mountOptions) == 0 {
+		mountOptions = DefaultMountOptions(fsType)
 	}
-	return nil
+	return updateFstab(fstabPath, mountPoint, fstabEntry(uuid, fsType, mountPoint, mountOptions))
 }
 
-func DoIt(device, volumeTag, fsType, mountPoint, clusterName string, minutes int) error {
-	device = NormalizeDevice(device)
-	sess := session.New()
-	metadata := ec2metadata.New(sess)
-	identity, err := metadata.GetInstanceIdentityDocument()
-	if err != nil {
+// Volumize attaches the volume, formats it if it has no filesystem, and
+// mounts it. Each step is skipped if it has already been done, so it is
+// safe to run again on every boot.
+func (v *Volumizer) Volumize(ctx context.Context, clusterName string, spec *VolumeSpec, minutes int) error {
+	if err := spec.validateFilesystem(); err != nil {
 		return err
 	}
-	var volume *ec2.Volume
-	volumizer := NewVolumizer(sess, identity.AvailabilityZone, identity.InstanceID)
-	volume, err = volumizer.AttachedVolume(&clusterName, &volumeTag, &device)
+	device := NormalizeDevice(spec.Device)
+	volume, err := v.AttachedVolume(ctx, clusterName, spec.Tag, spec.Member, device)
 	if err != nil {
 		return err
 	}
 	if volume == nil {
-		volume, err = volumizer.WaitForVolume(&clusterName, &volumeTag, time.Duration(minutes))
+		volume, err = v.FindAndClaimVolume(ctx, clusterName, spec, minutes)
 		if err != nil {
 			return err
 		}
-		if err = volumizer.AttachVolume(volume, device); err != nil {
+		if err = v.AttachVolume(ctx, volume, device); err != nil {
 			return err
 		}
 	}
-	if err = volumizer.WaitForDevice(device); err != nil {
+	// From here on, device is the block device on this instance, which
+	// may differ from the name used to attach the volume.
+	device, err = v.WaitForDevice(ctx, *volume.VolumeId, device)
+	if err != nil {
 		return err
 	}
-	hasFs, err := volumizer.HasFilesystem(device, fsType)
+	hasFs, err := HasFilesystem(ctx, device, spec.FsType)
 	if err != nil {
 		return err
 	}
 	if !hasFs {
-		if err = volumizer.MakeFilesystem(device, fsType); err != nil {
+		if err = MakeFilesystem(ctx, device, spec.FsType, spec.mkfsOptions()...); err != nil {
+			return err
+		}
+	}
+	uuid, err := GetUUID(ctx, device)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(spec.MountPoint, 0755); err != nil {
+		return err
+	}
+	if spec.MountUnit {
+		err = PersistMountUnit(uuid, spec.FsType, spec.MountPoint, spec.mountOptions(),
+			spec.DeviceTimeout, Fstab)
+		if err != nil {
 			return err
 		}
+		err = EnsureMountUnitStarted(ctx, spec.MountPoint)
+	} else {
+		err = PersistFilesystem(uuid, spec.FsType, spec.MountPoint, spec.mountOptions(), Fstab)
+		if err != nil {
+			return err
+		}
+		err = MountFilesystem(device, spec.FsType, spec.MountPoint, spec.mountOptions())
+	}
+	if err != nil {
+		return err
+	}
+	if spec.Grow {
+		return GrowFilesystem(ctx, device, spec.FsType, spec.MountPoint)
+	}
+	return nil
+}
+
+func newVolumizer() (*Volumizer, error) {
+	identity, err := metadata.Get()
+	if err != nil {
+		return nil, err
+	}
+	logging.AddFields("instance", identity.InstanceID)
+	sess := session.New(&aws.Config{Region: aws.String(identity.Region)})
+	return NewVolumizer(sess, identity.AvailabilityZone, identity.InstanceID), nil
+}
+
+func (v *Volumizer) resolvePolicy(ctx context.Context, spec *VolumeSpec) error {
+	return spec.Policy.ResolveKMSKey(ctx, v.kms)
+}
+
+func DoIt(ctx context.Context, spec *VolumeSpec, clusterName string, minutes int) error {
+	if (spec.Create || spec.Migrate) && spec.Member == "" {
+		return fmt.Errorf("member is required to create or migrate volumes")
 	}
-	uuid, err := GetUUID(device)
+	logging.AddFields("cluster", clusterName)
+	volumizer, err := newVolumizer()
 	if err != nil {
 		return err
 	}
-	if err = PersistFilesystem(uuid, fsType, mountPoint, Fstab); err != nil {
+	if err = volumizer.resolvePolicy(ctx, spec); err != nil {
 		return err
 	}
-	if err = os.MkdirAll(mountPoint, 0755); err != nil {
+	return volumizer.Volumize(ctx, clusterName, spec, minutes)
+}
+
+func DoManifest(ctx context.Context, manifestPath, clusterName string, minutes int) error {
+	manifest, err := LoadManifest(manifestPath)
+	if err != nil {
 		return err
 	}
-	return EnsureFilesystemsMounted()
+	if manifest.ClusterName != "" {
+		clusterName = manifest.ClusterName
+	}
+	logging.AddFields("cluster", clusterName)
+	volumizer, err := newVolumizer()
+	if err != nil {
+		return err
+	}
+	for i := range manifest.Volumes {
+		spec := &manifest.Volumes[i]
+		logging.Info("Volumizing", "tag", spec.Tag, "mountPoint", spec.MountPoint)
+		if err = volumizer.resolvePolicy(ctx, spec); err != nil {
+			return err
+		}
+		if err = volumizer.Volumize(ctx, clusterName, spec, minutes); err != nil {
+			return fmt.Errorf("volume %s: %v", spec.Tag, err)
+		}
+	}
+	return nil
 }
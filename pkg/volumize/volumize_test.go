@@ -0,0 +1,774 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package volumize
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/cloudboss/keights/pkg/runner"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveDevice(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "keights")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	byID, block := DiskByID, SysBlock
+	t.Cleanup(func() { DiskByID, SysBlock = byID, block })
+	DiskByID = filepath.Join(tempDir, "by-id")
+	SysBlock = filepath.Join(tempDir, "block")
+
+	for name, serial := range map[string]string{
+		"nvme0n1": "vol0aaaaaaaaaaaaaaaa",
+		"nvme1n1": "vol0bbbbbbbbbbbbbbbb  \n",
+	} {
+		deviceDir := filepath.Join(SysBlock, name, "device")
+		if err = os.MkdirAll(deviceDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(filepath.Join(deviceDir, "serial"), []byte(serial), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	target := filepath.Join(tempDir, "nvme2n1")
+	if err = ioutil.WriteFile(target, []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(DiskByID, 0755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(DiskByID, "nvme-Amazon_Elastic_Block_Store_vol0cccccccccccccccc")
+	if err = os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+
+	xenDevice := filepath.Join(tempDir, "xvdg")
+	if err = ioutil.WriteFile(xenDevice, []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var testCases = []struct {
+		volumeID string
+		device   string
+		resolved string
+		errMsg   string
+	}{
+		{"vol-0aaaaaaaaaaaaaaaa", "/dev/xvdg", "/dev/nvme0n1", ""},
+		{"vol-0bbbbbbbbbbbbbbbb", "/dev/xvdg", "/dev/nvme1n1", ""},
+		{"vol-0cccccccccccccccc", "/dev/xvdg", target, ""},
+		{"vol-0dddddddddddddddd", xenDevice, xenDevice, ""},
+		{"vol-0dddddddddddddddd", "/dev/xvdg", "", "No device found for volume vol-0dddddddddddddddd"},
+	}
+	for _, tc := range testCases {
+		resolved, err := ResolveDevice(tc.volumeID, tc.device)
+		if tc.errMsg == "" {
+			assert.NoError(t, err)
+			assert.Equal(t, tc.resolved, resolved)
+		} else {
+			assert.EqualError(t, err, tc.errMsg)
+		}
+	}
+}
+
+func TestParseManifest(t *testing.T) {
+	var testCases = []struct {
+		name     string
+		contents string
+		volumes  []VolumeSpec
+		errMsg   string
+	}{
+		{
+			"valid",
+			`
+clusterName: legbegbe
+volumes:
+  - tag: etcd:instance
+    device: xvdg
+    mountPoint: /var/lib/etcd
+  - tag: containerd
+    device: /dev/xvdh
+    fstype: xfs
+    mountPoint: /var/lib/containerd
+    mkfsOptions: [-L, containerd]
+    mountOptions: [noatime]
+`,
+			[]VolumeSpec{
+				{
+					Tag:        "etcd:instance",
+					Device:     "xvdg",
+					FsType:     "ext4",
+					MountPoint: "/var/lib/etcd",
+				},
+				{
+					Tag:          "containerd",
+					Device:       "/dev/xvdh",
+					FsType:       "xfs",
+					MountPoint:   "/var/lib/containerd",
+					MkfsOptions:  []string{"-L", "containerd"},
+					MountOptions: []string{"noatime"},
+				},
+			},
+			"",
+		},
+		{
+			"empty",
+			"clusterName: legbegbe\n",
+			nil,
+			"manifest has no volumes",
+		},
+		{
+			"missing-device",
+			"volumes:\n  - tag: etcd:instance\n    mountPoint: /var/lib/etcd\n",
+			nil,
+			"volume 1 must have tag, device, and mountPoint",
+		},
+		{
+			"duplicate-device",
+			`
+volumes:
+  - {tag: a, device: xvdg, mountPoint: /a}
+  - {tag: b, device: /dev/xvdg, mountPoint: /b}
+`,
+			nil,
+			"device /dev/xvdg is used more than once",
+		},
+		{
+			"duplicate-mount-point",
+			`
+volumes:
+  - {tag: a, device: xvdg, mountPoint: /a}
+  - {tag: b, device: xvdh, mountPoint: /a}
+`,
+			nil,
+			"mount point /a is used more than once",
+		},
+	}
+	for _, tc := range testCases {
+		manifest, err := ParseManifest([]byte(tc.contents))
+		if tc.errMsg == "" {
+			assert.NoError(t, err, tc.name)
+			assert.Equal(t, tc.volumes, manifest.Volumes, tc.name)
+		} else {
+			assert.EqualError(t, err, tc.errMsg, tc.name)
+		}
+	}
+}
+
+func TestLatestSnapshot(t *testing.T) {
+	now := time.Now()
+	snapshots := []*ec2.Snapshot{
+		{SnapshotId: aws.String("snap-1"), StartTime: aws.Time(now.Add(-2 * time.Hour))},
+		{SnapshotId: aws.String("snap-2"), StartTime: aws.Time(now)},
+		{SnapshotId: aws.String("snap-3"), StartTime: aws.Time(now.Add(-time.Hour))},
+	}
+	assert.Nil(t, latestSnapshot([]*ec2.Snapshot{}))
+	assert.Equal(t, "snap-2", *latestSnapshot(snapshots).SnapshotId)
+}
+
+func TestCreateVolumeInput(t *testing.T) {
+	v := &Volumizer{availabilityZone: "us-east-1a"}
+	spec := VolumeSpec{
+		Tag:        "etcd:instance",
+		Member:     "2",
+		Size:       10,
+		VolumeType: "gp3",
+		Throughput: 250,
+		KMSKeyID:   "alias/keights",
+	}
+	tags := []*ec2.TagSpecification{
+		{
+			ResourceType: aws.String("volume"),
+			Tags: []*ec2.Tag{
+				{Key: aws.String("Name"), Value: aws.String("legbegbe")},
+				{Key: aws.String("etcd:instance"), Value: aws.String("2")},
+			},
+		},
+	}
+	unencrypted := spec
+	unencrypted.KMSKeyID = ""
+	unencrypted.Encrypted = aws.Bool(false)
+	policyKey := unencrypted
+	policyKey.Policy = Policy{KMSKeyID: "arn:aws:kms:us-east-1:123456789012:key/abcd"}
+	var testCases = []struct {
+		name     string
+		spec     VolumeSpec
+		snapshot *ec2.Snapshot
+		expected *ec2.CreateVolumeInput
+	}{
+		{
+			"empty",
+			spec,
+			nil,
+			&ec2.CreateVolumeInput{
+				AvailabilityZone:  aws.String("us-east-1a"),
+				Encrypted:         aws.Bool(true),
+				KmsKeyId:          aws.String("alias/keights"),
+				Size:              aws.Int64(10),
+				TagSpecifications: tags,
+				Throughput:        aws.Int64(250),
+				VolumeType:        aws.String("gp3"),
+			},
+		},
+		{
+			"larger-snapshot",
+			spec,
+			&ec2.Snapshot{SnapshotId: aws.String("snap-1"), VolumeSize: aws.Int64(20)},
+			&ec2.CreateVolumeInput{
+				AvailabilityZone:  aws.String("us-east-1a"),
+				Encrypted:         aws.Bool(true),
+				KmsKeyId:          aws.String("alias/keights"),
+				Size:              aws.Int64(20),
+				SnapshotId:        aws.String("snap-1"),
+				TagSpecifications: tags,
+				Throughput:        aws.Int64(250),
+				VolumeType:        aws.String("gp3"),
+			},
+		},
+		{
+			"unencrypted",
+			unencrypted,
+			nil,
+			&ec2.CreateVolumeInput{
+				AvailabilityZone:  aws.String("us-east-1a"),
+				Size:              aws.Int64(10),
+				TagSpecifications: tags,
+				Throughput:        aws.Int64(250),
+				VolumeType:        aws.String("gp3"),
+			},
+		},
+		{
+			"policy-key",
+			policyKey,
+			nil,
+			&ec2.CreateVolumeInput{
+				AvailabilityZone:  aws.String("us-east-1a"),
+				Encrypted:         aws.Bool(true),
+				KmsKeyId:          aws.String("arn:aws:kms:us-east-1:123456789012:key/abcd"),
+				Size:              aws.Int64(10),
+				TagSpecifications: tags,
+				Throughput:        aws.Int64(250),
+				VolumeType:        aws.String("gp3"),
+			},
+		},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, v.createVolumeInput("legbegbe", &tc.spec, tc.snapshot), tc.name)
+	}
+}
+
+func TestSnapshotsToPrune(t *testing.T) {
+	now := time.Now()
+	snapshots := []*ec2.Snapshot{
+		{SnapshotId: aws.String("snap-3"), StartTime: aws.Time(now.Add(-3 * 24 * time.Hour))},
+		{SnapshotId: aws.String("snap-1"), StartTime: aws.Time(now.Add(-1 * 24 * time.Hour))},
+		{SnapshotId: aws.String("snap-0"), StartTime: aws.Time(now)},
+		{SnapshotId: aws.String("snap-2"), StartTime: aws.Time(now.Add(-2 * 24 * time.Hour))},
+	}
+	ids := func(snapshots []*ec2.Snapshot) []string {
+		snapshotIDs := []string{}
+		for _, snapshot := range snapshots {
+			snapshotIDs = append(snapshotIDs, *snapshot.SnapshotId)
+		}
+		return snapshotIDs
+	}
+	var testCases = []struct {
+		name      string
+		retention Retention
+		pruned    []string
+	}{
+		{"keep-all", Retention{}, []string{}},
+		{"keep-two", Retention{Keep: 2}, []string{"snap-2", "snap-3"}},
+		{"keep-more", Retention{Keep: 10}, []string{}},
+		{"max-age", Retention{MaxAge: 36 * time.Hour}, []string{"snap-2", "snap-3"}},
+		{"both", Retention{Keep: 3, MaxAge: 36 * time.Hour}, []string{"snap-2", "snap-3"}},
+		{"keep-one", Retention{Keep: 1, MaxAge: 72 * time.Hour}, []string{"snap-1", "snap-2", "snap-3"}},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.pruned, ids(snapshotsToPrune(snapshots, tc.retention, now)), tc.name)
+	}
+}
+
+func TestMigrationSpec(t *testing.T) {
+	old := &ec2.Volume{
+		Size:       aws.Int64(20),
+		VolumeType: aws.String("gp3"),
+		Iops:       aws.Int64(3000),
+		Throughput: aws.Int64(125),
+		KmsKeyId:   aws.String("arn:aws:kms:us-east-1:123456789012:key/abc"),
+	}
+	var testCases = []struct {
+		name     string
+		spec     VolumeSpec
+		expected VolumeSpec
+	}{
+		{
+			"from-old",
+			VolumeSpec{Tag: "etcd:instance", Member: "1"},
+			VolumeSpec{
+				Tag:        "etcd:instance",
+				Member:     "1",
+				Size:       20,
+				VolumeType: "gp3",
+				Iops:       3000,
+				Throughput: 125,
+				KMSKeyID:   "arn:aws:kms:us-east-1:123456789012:key/abc",
+			},
+		},
+		{
+			"explicit",
+			VolumeSpec{Size: 30, VolumeType: "gp2", KMSKeyID: "alias/keights"},
+			VolumeSpec{Size: 30, VolumeType: "gp2", KMSKeyID: "alias/keights"},
+		},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, &tc.expected, migrationSpec(&tc.spec, old), tc.name)
+	}
+}
+
+func TestFilesystemSizeParsing(t *testing.T) {
+	dumpe2fs := `dumpe2fs 1.46.2 (28-Feb-2021)
+Filesystem volume name:   <none>
+Block count:              2621440
+Reserved block count:     131072
+Free blocks:              2554432
+Block size:               4096
+`
+	size, err := parseDumpe2fs(dumpe2fs)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10737418240), size)
+
+	_, err = parseDumpe2fs("Filesystem volume name:   <none>\n")
+	assert.EqualError(t, err, "Block count and size not found in dumpe2fs output")
+
+	xfsInfo := `meta-data=/dev/nvme1n1           isize=512    agcount=4, agsize=655360 blks
+         =                       sectsz=512   attr=2, projid32bit=1
+         =                       crc=1        finobt=1, sparse=1, rmapbt=0
+data     =                       bsize=4096   blocks=2621440, imaxpct=25
+         =                       sunit=0      swidth=0 blks
+naming   =version 2              bsize=4096   ascii-ci=0, ftype=1
+log      =internal log           bsize=4096   blocks=2560, version=2
+`
+	size, err = parseXfsInfo(xfsInfo)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10737418240), size)
+
+	_, err = parseXfsInfo("naming   =version 2              bsize=4096   ascii-ci=0, ftype=1\n")
+	assert.EqualError(t, err, "Data section not found in xfs_info output")
+}
+
+func TestDeviceSize(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "keights")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	block := SysBlock
+	t.Cleanup(func() { SysBlock = block })
+	SysBlock = filepath.Join(tempDir, "block")
+	if err = os.MkdirAll(filepath.Join(SysBlock, "nvme1n1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(SysBlock, "nvme1n1", "size"), []byte("41943040\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := filepath.Join(tempDir, "nvme1n1")
+	if err = ioutil.WriteFile(device, []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	size, err := DeviceSize(device)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(21474836480), size)
+}
+
+func TestReconcileFstab(t *testing.T) {
+	entry := "UUID=new /var/lib/etcd ext4 noatime,errors=remount-ro 0 0"
+	var testCases = []struct {
+		name     string
+		contents string
+		entry    string
+		expected string
+	}{
+		{
+			"empty",
+			"",
+			entry,
+			entry + "\n",
+		},
+		{
+			"append",
+			"# /etc/fstab\nUUID=root / ext4 defaults 0 1\n",
+			entry,
+			"# /etc/fstab\nUUID=root / ext4 defaults 0 1\n" + entry + "\n",
+		},
+		{
+			"unchanged",
+			"UUID=root / ext4 defaults 0 1\n" + entry + "\n",
+			entry,
+			"UUID=root / ext4 defaults 0 1\n" + entry + "\n",
+		},
+		{
+			"replace-stale",
+			"UUID=old1 /var/lib/etcd ext4 noatime 0 0\nUUID=root / ext4 defaults 0 1\nUUID=old2 /var/lib/etcd/ ext4 noatime 0 0",
+			entry,
+			entry + "\nUUID=root / ext4 defaults 0 1\n",
+		},
+		{
+			"remove",
+			"UUID=root / ext4 defaults 0 1\nUUID=old /var/lib/etcd ext4 noatime 0 0\n",
+			"",
+			"UUID=root / ext4 defaults 0 1\n",
+		},
+	}
+	for _, tc := range testCases {
+		reconciled, err := reconcileFstab(tc.contents, "/var/lib/etcd", tc.entry)
+		assert.NoError(t, err, tc.name)
+		assert.Equal(t, tc.expected, reconciled, tc.name)
+	}
+	_, err := reconcileFstab("UUID=bad /var/lib/etcd\n", "/var/lib/etcd", entry)
+	assert.EqualError(t, err, "too few fields (2), at least 4 are expected")
+}
+
+func TestMountUnitName(t *testing.T) {
+	var testCases = []struct {
+		mountPoint string
+		unitName   string
+	}{
+		{"/", "-.mount"},
+		{"/var/lib/etcd", "var-lib-etcd.mount"},
+		{"/var/lib/etcd/", "var-lib-etcd.mount"},
+		{"/var/lib/etcd-wal", `var-lib-etcd\x2dwal.mount`},
+		{"/srv/.hidden", "srv-.hidden.mount"},
+		{"/.hidden", `\x2ehidden.mount`},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.unitName, MountUnitName(tc.mountPoint))
+	}
+}
+
+func TestMountUnit(t *testing.T) {
+	expected := `[Unit]
+Description=keights volume mounted on /var/lib/etcd
+
+[Mount]
+What=/dev/disk/by-uuid/1234
+Where=/var/lib/etcd
+Type=ext4
+Options=noatime,nofail,x-systemd.device-timeout=30s
+
+[Install]
+WantedBy=local-fs.target
+`
+	unit := mountUnit("1234", "ext4", "/var/lib/etcd", []string{"noatime"}, 30*time.Second)
+	assert.Equal(t, expected, string(unit))
+}
+
+func TestMkfsOptions(t *testing.T) {
+	zero := 0
+	var testCases = []struct {
+		name    string
+		spec    VolumeSpec
+		options []string
+		errMsg  string
+	}{
+		{
+			"none",
+			VolumeSpec{FsType: "ext4"},
+			[]string{},
+			"",
+		},
+		{
+			"ext4",
+			VolumeSpec{FsType: "ext4", Label: "etcd", ReservedBlocksPercent: &zero, MkfsOptions: []string{"-E", "nodiscard"}},
+			[]string{"-L", "etcd", "-m", "0", "-E", "nodiscard"},
+			"",
+		},
+		{
+			"xfs-reserved",
+			VolumeSpec{FsType: "xfs", ReservedBlocksPercent: &zero},
+			nil,
+			"reserved blocks percentage is not supported for xfs",
+		},
+		{
+			"xfs-label",
+			VolumeSpec{FsType: "xfs", Label: "containerd-data"},
+			nil,
+			"label containerd-data is longer than 12 characters allowed for xfs",
+		},
+	}
+	for _, tc := range testCases {
+		err := tc.spec.validateFilesystem()
+		if tc.errMsg == "" {
+			assert.NoError(t, err, tc.name)
+			assert.Equal(t, tc.options, tc.spec.mkfsOptions(), tc.name)
+		} else {
+			assert.EqualError(t, err, tc.errMsg, tc.name)
+		}
+	}
+}
+
+func TestMountOptions(t *testing.T) {
+	assert.Equal(t, []string{"noatime", "errors=remount-ro"}, (&VolumeSpec{FsType: "ext4"}).mountOptions())
+	assert.Equal(t, []string{"noatime"}, (&VolumeSpec{FsType: "xfs"}).mountOptions())
+	assert.Equal(t, []string{"ro"}, (&VolumeSpec{FsType: "xfs", MountOptions: []string{"ro"}}).mountOptions())
+
+	flags, data := mountFlags([]string{"defaults", "noatime", "nofail", "x-systemd.device-timeout=30s", "errors=remount-ro", "discard"})
+	assert.Equal(t, mountFlagOptions["noatime"], flags)
+	assert.Equal(t, "errors=remount-ro,discard", data)
+}
+
+func TestPolicyCheck(t *testing.T) {
+	keyARN := "arn:aws:kms:us-east-1:123456789012:key/1234abcd"
+	volume := &ec2.Volume{
+		VolumeId:   aws.String("vol-1"),
+		Encrypted:  aws.Bool(true),
+		KmsKeyId:   aws.String(keyARN),
+		Size:       aws.Int64(10),
+		VolumeType: aws.String("gp3"),
+		Tags: []*ec2.Tag{
+			{Key: aws.String("Name"), Value: aws.String("legbegbe")},
+			{Key: aws.String("etcd:instance"), Value: aws.String("1")},
+		},
+	}
+	unencrypted := &ec2.Volume{VolumeId: aws.String("vol-2"), Encrypted: aws.Bool(false)}
+	spec := &VolumeSpec{Tag: "etcd:instance", Member: "1"}
+	var testCases = []struct {
+		name   string
+		policy Policy
+		volume *ec2.Volume
+		spec   *VolumeSpec
+		errMsg string
+	}{
+		{"empty", Policy{}, unencrypted, spec, ""},
+		{
+			"all-pass",
+			Policy{RequireEncryption: true, KMSKeyID: "1234abcd", RequireTags: true, MinSize: 10, VolumeTypes: []string{"gp2", "gp3"}},
+			volume,
+			spec,
+			"",
+		},
+		{"key-arn", Policy{KMSKeyID: keyARN}, volume, spec, ""},
+		{
+			"unencrypted",
+			Policy{RequireEncryption: true},
+			unencrypted,
+			spec,
+			"Volume vol-2 violates policy: encryption is required but volume is not encrypted",
+		},
+		{
+			"wrong-key",
+			Policy{KMSKeyID: "5678efgh"},
+			volume,
+			spec,
+			"Volume vol-1 violates policy: KMS key 5678efgh is required but volume is encrypted with " + keyARN,
+		},
+		{
+			"wrong-member",
+			Policy{RequireTags: true},
+			volume,
+			&VolumeSpec{Tag: "etcd:instance", Member: "2"},
+			`Volume vol-1 violates policy: tag etcd:instance must be 2 but is "1"`,
+		},
+		{
+			"several",
+			Policy{RequireTags: true, MinSize: 20, VolumeTypes: []string{"io2"}},
+			volume,
+			&VolumeSpec{Tag: "etcd:instance"},
+			"Volume vol-1 violates policy: member tag is required but no member was given; " +
+				"size must be at least 20 GiB but is 10 GiB; type must be one of io2 but is gp3",
+		},
+	}
+	for _, tc := range testCases {
+		err := tc.policy.Check(tc.volume, "legbegbe", tc.spec)
+		if tc.errMsg == "" {
+			assert.NoError(t, err, tc.name)
+		} else {
+			assert.EqualError(t, err, tc.errMsg, tc.name)
+		}
+	}
+}
+
+func TestInstanceStoreDevices(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "keights")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	block := SysBlock
+	t.Cleanup(func() { SysBlock = block })
+	SysBlock = filepath.Join(tempDir, "block")
+	for name, model := range map[string]string{
+		"nvme0n1": "Amazon Elastic Block Store              \n",
+		"nvme2n1": "Amazon EC2 NVMe Instance Storage        \n",
+		"nvme1n1": "Amazon EC2 NVMe Instance Storage        \n",
+	} {
+		deviceDir := filepath.Join(SysBlock, name, "device")
+		if err = os.MkdirAll(deviceDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(filepath.Join(deviceDir, "model"), []byte(model), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	devices, err := InstanceStoreDevices()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/dev/nvme1n1", "/dev/nvme2n1"}, devices)
+}
+
+func TestBindSource(t *testing.T) {
+	assert.Equal(t, filepath.Join(InstanceStoreMount, "var-lib-containerd"),
+		bindSource("/var/lib/containerd/"))
+	assert.Equal(t, filepath.Join(InstanceStoreMount, "var-lib-kubelet"),
+		bindSource("/var/lib/kubelet"))
+}
+
+func TestFilesystemCommands(t *testing.T) {
+	ctx := context.Background()
+	defer func(r runner.Runner) { Runner = r }(Runner)
+	fake := runner.NewFake(map[string]*runner.Result{
+		"blkid -s TYPE -o value /dev/nvme1n1": {Stdout: "ext4\n"},
+		"blkid -s TYPE -o value /dev/nvme2n1": {ExitStatus: 2},
+		"blkid -s TYPE -o value /dev/nvme3n1": {Stdout: "xfs\n"},
+		"blkid -s UUID -o value /dev/nvme1n1": {Stdout: "0f6c7e4a\n"},
+		"mkfs -t ext4 -L data /dev/nvme2n1":   {},
+	})
+	Runner = fake
+
+	hasFs, err := HasFilesystem(ctx, "/dev/nvme1n1", "ext4")
+	assert.NoError(t, err)
+	assert.True(t, hasFs)
+
+	hasFs, err = HasFilesystem(ctx, "/dev/nvme2n1", "ext4")
+	assert.NoError(t, err)
+	assert.False(t, hasFs)
+
+	_, err = HasFilesystem(ctx, "/dev/nvme3n1", "ext4")
+	assert.EqualError(t, err, "Expected filesystem type ext4, got xfs")
+
+	_, err = HasFilesystem(ctx, "/dev/nvme4n1", "ext4")
+	assert.Error(t, err)
+
+	assert.NoError(t, MakeFilesystem(ctx, "/dev/nvme2n1", "ext4", "-L", "data"))
+
+	uuid, err := GetUUID(ctx, "/dev/nvme1n1")
+	assert.NoError(t, err)
+	assert.Equal(t, "0f6c7e4a", uuid)
+
+	// A canceled context, as on SIGTERM, stops the command.
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	err = MakeFilesystem(canceled, "/dev/nvme2n1", "ext4", "-L", "data")
+	assert.True(t, errors.Is(err, context.Canceled))
+}
+
+func TestEnsureArray(t *testing.T) {
+	ctx := context.Background()
+	defer func(r runner.Runner, array string) {
+		Runner = r
+		InstanceStoreArray = array
+	}(Runner, InstanceStoreArray)
+	tempDir, err := ioutil.TempDir("", "keights")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	InstanceStoreArray = filepath.Join(tempDir, "keights")
+
+	scan := "mdadm --detail --scan"
+	assemble := "mdadm --assemble " + InstanceStoreArray + " /dev/nvme1n1 /dev/nvme2n1"
+	create := "mdadm --create " + InstanceStoreArray +
+		" --run --level=0 --raid-devices=2 --name=keights /dev/nvme1n1 /dev/nvme2n1"
+	fake := runner.NewFake(map[string]*runner.Result{
+		scan:     {},
+		assemble: {ExitStatus: 1, Stderr: "no superblock\n"},
+		create:   {},
+	})
+	Runner = fake
+
+	device, err := EnsureArray(ctx, []string{"/dev/nvme1n1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/nvme1n1", device)
+	assert.Empty(t, fake.Calls)
+
+	device, err = EnsureArray(ctx, []string{"/dev/nvme1n1", "/dev/nvme2n1"})
+	assert.NoError(t, err)
+	assert.Equal(t, InstanceStoreArray, device)
+	assert.Equal(t, []string{scan, assemble, create}, fake.Calls)
+
+	// After a reboot, udev has assembled the array under another name.
+	fake = runner.NewFake(map[string]*runner.Result{
+		scan: {Stdout: "ARRAY /dev/md127 metadata=1.2 name=ip-10-0-0-1:keights UUID=3aaa0122:29827cfa:5331ad66:ca767371\n"},
+	})
+	Runner = fake
+	device, err = EnsureArray(ctx, []string{"/dev/nvme1n1", "/dev/nvme2n1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/md127", device)
+	assert.Equal(t, []string{scan}, fake.Calls)
+
+	_, err = EnsureArray(ctx, []string{})
+	assert.Error(t, err)
+}
+
+func TestParseMdadmScan(t *testing.T) {
+	var testCases = []struct {
+		output   string
+		expected string
+	}{
+		{
+			"",
+			"",
+		},
+		{
+			"ARRAY /dev/md/keights metadata=1.2 name=keights UUID=3aaa0122:29827cfa:5331ad66:ca767371\n",
+			"/dev/md/keights",
+		},
+		{
+			"ARRAY /dev/md127 metadata=1.2 name=ip-10-0-0-1:keights UUID=3aaa0122:29827cfa:5331ad66:ca767371\n",
+			"/dev/md127",
+		},
+		{
+			"ARRAY /dev/md/data metadata=1.2 name=ip-10-0-0-1:data UUID=0f6c7e4a:29827cfa:5331ad66:ca767371\n" +
+				"ARRAY /dev/md126 metadata=1.2 name=ip-10-0-0-2:keights UUID=3aaa0122:29827cfa:5331ad66:ca767371\n",
+			"/dev/md126",
+		},
+		{
+			"ARRAY /dev/md/notkeights metadata=1.2 name=ip-10-0-0-1:notkeights UUID=0f6c7e4a:29827cfa:5331ad66:ca767371\n",
+			"",
+		},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, parseMdadmScan(tc.output, "keights"))
+	}
+}
@@ -26,6 +26,7 @@ import (
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/cloudboss/keights/pkg/helpers"
+	"github.com/cloudboss/keights/pkg/logging"
 )
 
 type DetailDetails struct {
@@ -62,7 +63,8 @@ func ValidateEvent(actualEvent string, validEvents []string) error {
 }
 
 func Handle(event events.CloudWatchEvent, validEvents, requiredEnvironment []string, doit RealHandler) error {
-	fmt.Printf("event: %#v\n", event)
+	logging.Info("Received event", "id", event.ID, "detailType", event.DetailType,
+		"source", event.Source, "resources", event.Resources)
 
 	err := ValidateEvent(event.DetailType, validEvents)
 	if err != nil {
@@ -79,7 +81,10 @@ func Handle(event events.CloudWatchEvent, validEvents, requiredEnvironment []str
 	if err != nil {
 		return err
 	}
-	fmt.Printf("event.detail: %#v\n", detail)
+	logger := logging.With("asg", detail.AutoScalingGroupName, "instance", detail.EC2InstanceID)
+	logger.Info("Received detail", "statusCode", detail.StatusCode, "activityId", detail.ActivityID,
+		"cause", detail.Cause, "availabilityZone", detail.Details.AvailabilityZone,
+		"subnetId", detail.Details.SubnetID)
 
 	return doit(detail, env)
 }
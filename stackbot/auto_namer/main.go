@@ -33,6 +33,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"github.com/aws/aws-sdk-go/service/route53"
 	"github.com/aws/aws-sdk-go/service/route53/route53iface"
+	"github.com/cloudboss/keights/pkg/logging"
 	"github.com/cloudboss/keights/stackbot/asgevent"
 )
 
@@ -149,6 +150,7 @@ func realHandler(detail asgevent.AutoScalingDetail, env map[string]string) error
 }
 
 func main() {
+	logging.ConfigureFromEnv()
 	lambda.Start(func(ctx context.Context, event events.CloudWatchEvent) error {
 		return asgevent.Handle(event, validEvents, requiredEnvironment, realHandler)
 	})
@@ -28,6 +28,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/cloudboss/keights/pkg/logging"
 	"github.com/cloudboss/keights/stackbot/asgevent"
 )
 
@@ -60,6 +61,7 @@ func realHandler(detail asgevent.AutoScalingDetail, env map[string]string) error
 }
 
 func main() {
+	logging.ConfigureFromEnv()
 	lambda.Start(func(ctx context.Context, event events.CloudWatchEvent) error {
 		return asgevent.Handle(event, validEvents, requiredEnvironment, realHandler)
 	})
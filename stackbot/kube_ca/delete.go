@@ -0,0 +1,156 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/cloudboss/keights/pkg/logging"
+	"github.com/cloudboss/keights/stackbot/whisperer"
+)
+
+// The ParameterDeletionPolicy property decides what happens to the
+// parameters kube_ca created when the resource is deleted. Retain, the
+// default, leaves them. Delete removes them, so the cluster name can be
+// reused with new PKI. Archive copies them under /<cluster>/archive/<time>
+// before removing them.
+const (
+	DeletionPolicyRetain  = "Retain"
+	DeletionPolicyDelete  = "Delete"
+	DeletionPolicyArchive = "Archive"
+
+	archiveTimeFormat = "20060102T150405Z"
+)
+
+var now = time.Now
+
+// logStreamID matches the physical resource IDs of older versions, which
+// returned no ID, so that cfn.LambdaWrap used the Lambda's log stream name.
+var logStreamID = regexp.MustCompile(`^\d{4}/\d{2}/\d{2}/\[[^\]]+\][0-9a-f]+$`)
+
+// stackDeleting returns whether the stack is being deleted. It is a
+// variable so tests can replace it.
+var stackDeleting = func(stackID string) (bool, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return false, err
+	}
+	output, err := cloudformation.New(sess).DescribeStacks(&cloudformation.DescribeStacksInput{
+		StackName: aws.String(stackID),
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, stack := range output.Stacks {
+		return aws.StringValue(stack.StackStatus) == cloudformation.StackStatusDeleteInProgress, nil
+	}
+	return false, fmt.Errorf("stack %s not found", stackID)
+}
+
+func validateDeletionPolicy(policy string) error {
+	switch policy {
+	case "", DeletionPolicyRetain, DeletionPolicyDelete, DeletionPolicyArchive:
+		return nil
+	}
+	return fmt.Errorf("unknown ParameterDeletionPolicy %s, expected one of %s, %s, %s", policy,
+		DeletionPolicyRetain, DeletionPolicyDelete, DeletionPolicyArchive)
+}
+
+// resourceID is the physical resource ID. It must not change on update,
+// or CloudFormation would delete the resource with the old ID afterward.
+func resourceID(clusterName string) string {
+	return fmt.Sprintf("%s-kube-ca", clusterName)
+}
+
+// deleteWanted returns whether a delete event should apply the deletion
+// policy. Older versions returned a new log stream ID on every update, and
+// CloudFormation deletes the resource with the previous ID after an update,
+// so a delete of any other ID is ignored. The exception is a stack created
+// by an older version and not updated since, whose log stream ID is still
+// current when the stack itself is deleted.
+func deleteWanted(event cfn.Event, physicalResourceID string) bool {
+	if event.PhysicalResourceID == physicalResourceID {
+		return true
+	}
+	logger := logging.With("physicalResourceId", event.PhysicalResourceID)
+	if !logStreamID.MatchString(event.PhysicalResourceID) {
+		logger.Info("Ignoring delete of previous resource ID")
+		return false
+	}
+	deleting, err := stackDeleting(event.StackID)
+	if err != nil {
+		logger.Warn("Unable to get stack status, retaining parameters", "error", err)
+		return false
+	}
+	if !deleting {
+		logger.Info("Ignoring delete of previous resource ID")
+	}
+	return deleting
+}
+
+func archivePath(clusterName, timestamp string, path *string) *string {
+	relative := strings.TrimPrefix(*path, fmt.Sprintf("/%s", clusterName))
+	archived := fmt.Sprintf("/%s/archive/%s%s", clusterName, timestamp, relative)
+	return &archived
+}
+
+func handleDelete(props resourceProperties, whisp whisperer.Whisperer) error {
+	if err := validateDeletionPolicy(props.ParameterDeletionPolicy); err != nil {
+		return err
+	}
+	if props.ParameterDeletionPolicy == "" || props.ParameterDeletionPolicy == DeletionPolicyRetain {
+		logging.Info("Retaining parameters")
+		return nil
+	}
+	timestamp := now().UTC().Format(archiveTimeFormat)
+	for _, path := range newArtifactPaths(props.ClusterName).All() {
+		hasParameter, err := whisp.HasParameters(path)
+		if err != nil {
+			return err
+		}
+		if !hasParameter {
+			continue
+		}
+		if props.ParameterDeletionPolicy == DeletionPolicyArchive {
+			value, err := whisp.GetParameter(path)
+			if err != nil {
+				return err
+			}
+			archived := archivePath(props.ClusterName, timestamp, path)
+			logging.Info("Archiving parameter", "path", *path, "archivePath", *archived)
+			if err = whisp.ForceStoreParameter(archived, &props.KMSKeyID, value); err != nil {
+				return err
+			}
+		}
+		logging.Info("Deleting parameter", "path", *path)
+		if err = whisp.DeleteParameter(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchivePath(t *testing.T) {
+	assert.Equal(t, "/cb/archive/20221019T130000Z/controller/ca.key",
+		*archivePath("cb", "20221019T130000Z", caKeyPath))
+	assert.Equal(t, "/cb/archive/20221019T130000Z/cluster/ca.crt",
+		*archivePath("cb", "20221019T130000Z", caCertPath))
+}
+
+func TestHandleDelete(t *testing.T) {
+	now = func() time.Time { return time.Date(2022, 10, 19, 13, 0, 0, 0, time.UTC) }
+	defer func() { now = time.Now }()
+
+	testCases := []struct {
+		policy    string
+		remaining []string
+		archived  bool
+		err       string
+	}{
+		{policy: "", remaining: []string{*caCertPath, *bootstrapTokenPath}},
+		{policy: DeletionPolicyRetain, remaining: []string{*caCertPath, *bootstrapTokenPath}},
+		{policy: DeletionPolicyDelete, remaining: []string{"/cb-other/cluster/ca.crt"}},
+		{policy: DeletionPolicyArchive, remaining: []string{"/cb-other/cluster/ca.crt"}, archived: true},
+		{
+			policy: "Snapshot",
+			err:    "unknown ParameterDeletionPolicy Snapshot, expected one of Retain, Delete, Archive",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.policy, func(t *testing.T) {
+			whisp := newMemWhisperer()
+			props := resourceProperties{
+				ClusterName: clusterName,
+				RotateCA:    map[string]string{CATypeEtcd: RotateStage},
+			}
+			assert.NoError(t, handleCreateOrUpdate(props, whisp))
+			whisp.parameters["/cb-other/cluster/ca.crt"] = "other"
+			original := map[string]string{}
+			for path, value := range whisp.parameters {
+				original[path] = value
+			}
+
+			props.ParameterDeletionPolicy = tc.policy
+			err := handleDelete(props, whisp)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			for _, path := range tc.remaining {
+				assert.Contains(t, whisp.parameters, path)
+			}
+			if tc.policy == DeletionPolicyDelete || tc.policy == DeletionPolicyArchive {
+				for _, path := range newArtifactPaths(clusterName).All() {
+					assert.NotContains(t, whisp.parameters, *path)
+				}
+			}
+			if tc.archived {
+				// Every original parameter of the cluster, including the
+				// staged etcd CA, is archived.
+				assert.Len(t, whisp.parameters, len(original))
+				for path, value := range original {
+					if path == "/cb-other/cluster/ca.crt" {
+						continue
+					}
+					archived := *archivePath(clusterName, "20221019T130000Z", &path)
+					assert.Equal(t, value, whisp.parameters[archived])
+				}
+			}
+		})
+	}
+}
+
+func TestDeleteWanted(t *testing.T) {
+	defer func(f func(string) (bool, error)) { stackDeleting = f }(stackDeleting)
+	logStream := "2022/10/19/[$LATEST]0123456789abcdef"
+	testCases := []struct {
+		name       string
+		physicalID string
+		deleting   bool
+		err        error
+		expected   bool
+	}{
+		{"current-id", resourceID(clusterName), false, nil, true},
+		{"other-id", "cb-old-kube-ca", true, nil, false},
+		{"log-stream-after-update", logStream, false, nil, false},
+		{"log-stream-stack-deleted", logStream, true, nil, true},
+		{"log-stream-unknown-status", logStream, true, errors.New("AccessDenied"), false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stackDeleting = func(stackID string) (bool, error) {
+				assert.Equal(t, "arn:aws:cloudformation:us-east-1:123456789012:stack/cb/1", stackID)
+				return tc.deleting, tc.err
+			}
+			event := cfn.Event{
+				RequestType:        cfn.RequestDelete,
+				StackID:            "arn:aws:cloudformation:us-east-1:123456789012:stack/cb/1",
+				PhysicalResourceID: tc.physicalID,
+			}
+			assert.Equal(t, tc.expected, deleteWanted(event, resourceID(clusterName)))
+		})
+	}
+}
+
+func TestHandleIgnoresPreviousResourceID(t *testing.T) {
+	defer func(f func(string) (bool, error)) { stackDeleting = f }(stackDeleting)
+	stackDeleting = func(stackID string) (bool, error) { return false, nil }
+	event := cfn.Event{
+		RequestType:        cfn.RequestDelete,
+		PhysicalResourceID: "2022/10/19/[$LATEST]0123456789abcdef",
+		ResourceProperties: map[string]interface{}{
+			"ClusterName":             clusterName,
+			"ParameterDeletionPolicy": DeletionPolicyDelete,
+		},
+	}
+	id, data, err := Handle(context.Background(), event)
+	assert.NoError(t, err)
+	assert.Equal(t, event.PhysicalResourceID, id)
+	assert.Empty(t, data)
+}
@@ -32,6 +32,7 @@ import (
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/cloudboss/keights/pkg/helpers"
+	"github.com/cloudboss/keights/pkg/logging"
 	"github.com/cloudboss/keights/stackbot/whisperer"
 	"github.com/mitchellh/mapstructure"
 	certutil "k8s.io/client-go/util/cert"
@@ -59,6 +60,10 @@ type resourceProperties struct {
 	ClusterName    string
 	KMSKeyID       string `mapstructure:"KmsKeyId"`
 	KeightsVersion string
+	// RotateCA maps a CA type to a step of rotation, see rotateCA.
+	RotateCA map[string]string `mapstructure:"RotateCA"`
+	// ParameterDeletionPolicy is one of Retain, Delete, or Archive.
+	ParameterDeletionPolicy string
 }
 
 func pathFormatter(template, prefix string) func(string) *string {
@@ -69,7 +74,7 @@ func pathFormatter(template, prefix string) func(string) *string {
 }
 
 func retrieveCA(whisp whisperer.Whisperer, certPath, keyPath *string) (*x509.Certificate, crypto.Signer, error) {
-	fmt.Printf("Retrieving CA via SSM parameters %s and %s\n", *certPath, *keyPath)
+	logging.Info("Retrieving CA", "certPath", *certPath, "keyPath", *keyPath)
 
 	var caCert *x509.Certificate
 	var caKey crypto.Signer
@@ -102,7 +107,7 @@ func retrieveCA(whisp whisperer.Whisperer, certPath, keyPath *string) (*x509.Cer
 }
 
 func genCA(whisp whisperer.Whisperer, certPath, keyPath, kmsKeyID *string) (*x509.Certificate, crypto.Signer, error) {
-	fmt.Printf("Generating CA: %s and %s\n", *certPath, *keyPath)
+	logging.Info("Generating CA", "certPath", *certPath, "keyPath", *keyPath)
 
 	caCert, caKey, err := pkiutil.NewCertificateAuthority(&pkiutil.CertConfig{
 		// Config defined in func KubeadmCertRootCA() from
@@ -111,11 +116,14 @@ func genCA(whisp whisperer.Whisperer, certPath, keyPath, kmsKeyID *string) (*x50
 			CommonName: "kubernetes",
 		},
 	})
+	if err != nil {
+		return nil, nil, err
+	}
 	caCertPEMBytes, err := certutil.EncodeCertificates(caCert)
 	if err != nil {
 		return nil, nil, err
 	}
-	fmt.Printf("Storing %s\n", *certPath)
+	logging.Info("Storing parameter", "path", *certPath)
 	caCertPEM := string(caCertPEMBytes)
 	err = whisp.ForceStoreParameter(certPath, kmsKeyID, &caCertPEM)
 	if err != nil {
@@ -126,7 +134,7 @@ func genCA(whisp whisperer.Whisperer, certPath, keyPath, kmsKeyID *string) (*x50
 		return nil, nil, err
 	}
 	caKeyPEM := string(caKeyPEMBytes)
-	fmt.Printf("Storing %s\n", *keyPath)
+	logging.Info("Storing parameter", "path", *keyPath)
 	err = whisp.ForceStoreParameter(keyPath, kmsKeyID, &caKeyPEM)
 	if err != nil {
 		return nil, nil, err
@@ -135,7 +143,8 @@ func genCA(whisp whisperer.Whisperer, certPath, keyPath, kmsKeyID *string) (*x50
 }
 
 func genServiceAccountArtifacts(whisp whisperer.Whisperer, keyPath, pubKeyPath, kmsKeyID *string) error {
-	fmt.Printf("Generating service account artifacts: %s and %s\n", *keyPath, *pubKeyPath)
+	logging.Info("Generating service account artifacts", "keyPath", *keyPath,
+		"pubKeyPath", *pubKeyPath)
 
 	saSigningKey, err := pkiutil.NewPrivateKey(x509.RSA)
 	if err != nil {
@@ -146,7 +155,7 @@ func genServiceAccountArtifacts(whisp whisperer.Whisperer, keyPath, pubKeyPath,
 		return err
 	}
 	saSigningKeyPEM := string(saSigningKeyPEMBytes)
-	fmt.Printf("Storing %s\n", *keyPath)
+	logging.Info("Storing parameter", "path", *keyPath)
 	err = whisp.ForceStoreParameter(keyPath, kmsKeyID, &saSigningKeyPEM)
 	if err != nil {
 		return err
@@ -156,24 +165,24 @@ func genServiceAccountArtifacts(whisp whisperer.Whisperer, keyPath, pubKeyPath,
 		return err
 	}
 	saSigningPubKeyPEM := string(saSigningPubKeyPEMBytes)
-	fmt.Printf("Storing %s\n", *pubKeyPath)
+	logging.Info("Storing parameter", "path", *pubKeyPath)
 	return whisp.ForceStoreParameter(pubKeyPath, kmsKeyID, &saSigningPubKeyPEM)
 }
 
 func genBootstrapToken(whisp whisperer.Whisperer, path, kmsKeyID *string) error {
-	fmt.Printf("Generating bootstrap token\n")
+	logging.Info("Generating bootstrap token")
 
 	token, err := tokenutil.GenerateBootstrapToken()
 	if err != nil {
 		return err
 	}
-	fmt.Printf("Storing %s\n", *path)
+	logging.Info("Storing parameter", "path", *path)
 	return whisp.StoreParameter(path, kmsKeyID, &token)
 }
 
 func genAPIClientCert(whisp whisperer.Whisperer, caCert *x509.Certificate, caKey crypto.Signer,
 	certPath, keyPath, kmsKeyID *string) error {
-	fmt.Printf("Generating API client certificate\n")
+	logging.Info("Generating API client certificate")
 
 	config := &pkiutil.CertConfig{
 		// Config defined in func KubeadmCertKubeletClient() from
@@ -193,7 +202,7 @@ func genAPIClientCert(whisp whisperer.Whisperer, caCert *x509.Certificate, caKey
 		return err
 	}
 	apiClientCertPEM := string(apiClientCertPEMBytes)
-	fmt.Printf("Storing %s\n", *certPath)
+	logging.Info("Storing parameter", "path", *certPath)
 	err = whisp.ForceStoreParameter(certPath, kmsKeyID, &apiClientCertPEM)
 	if err != nil {
 		return err
@@ -203,10 +212,19 @@ func genAPIClientCert(whisp whisperer.Whisperer, caCert *x509.Certificate, caKey
 		return err
 	}
 	apiClientKeyPEM := string(apiClientKeyPEMBytes)
-	fmt.Printf("Storing %s\n", *keyPath)
+	logging.Info("Storing parameter", "path", *keyPath)
 	return whisp.ForceStoreParameter(keyPath, kmsKeyID, &apiClientKeyPEM)
 }
 
+// signedBy returns true if the certificate at certPath was signed by caCert.
+func signedBy(whisp whisperer.Whisperer, certPath *string, caCert *x509.Certificate) (bool, error) {
+	certs, err := retrieveBundle(whisp, certPath)
+	if err != nil {
+		return false, err
+	}
+	return len(certs) > 0 && certs[0].CheckSignatureFrom(caCert) == nil, nil
+}
+
 func concatErrors(errs []error) error {
 	if len(errs) == 0 {
 		return nil
@@ -227,20 +245,25 @@ func handleCreateOrUpdate(props resourceProperties, whisp whisperer.Whisperer) e
 	var caKey crypto.Signer
 	var err error
 
-	clusterScopedPath := pathFormatter(clusterPathTemplate, props.ClusterName)
-	controllerScopedPath := pathFormatter(controllerPathTemplate, props.ClusterName)
-
-	bootstrapTokenPath := clusterScopedPath(bootstrapTokenName)
-	caCertPath := clusterScopedPath(kubeadmconstants.CACertName)
-	caKeyPath := controllerScopedPath(kubeadmconstants.CAKeyName)
-	etcdCACertPath := controllerScopedPath(etcdCACertName)
-	etcdCAKeyPath := controllerScopedPath(etcdCAKeyName)
-	frontProxyCACertPath := controllerScopedPath(kubeadmconstants.FrontProxyCACertName)
-	frontProxyCAKeyPath := controllerScopedPath(kubeadmconstants.FrontProxyCAKeyName)
-	apiClientCertPath := controllerScopedPath(kubeadmconstants.APIServerKubeletClientCertName)
-	apiClientKeyPath := controllerScopedPath(kubeadmconstants.APIServerKubeletClientKeyName)
-	saSigningKeyPath := controllerScopedPath(kubeadmconstants.ServiceAccountPrivateKeyName)
-	saSigningPubKeyPath := controllerScopedPath(kubeadmconstants.ServiceAccountPublicKeyName)
+	if err = validateRotation(props.RotateCA); err != nil {
+		return err
+	}
+	if err = validateDeletionPolicy(props.ParameterDeletionPolicy); err != nil {
+		return err
+	}
+
+	paths := newArtifactPaths(props.ClusterName)
+	bootstrapTokenPath := paths.BootstrapToken
+	caCertPath := paths.CACert
+	caKeyPath := paths.CAKey
+	etcdCACertPath := paths.EtcdCACert
+	etcdCAKeyPath := paths.EtcdCAKey
+	frontProxyCACertPath := paths.FrontProxyCACert
+	frontProxyCAKeyPath := paths.FrontProxyCAKey
+	apiClientCertPath := paths.APIClientCert
+	apiClientKeyPath := paths.APIClientKey
+	saSigningKeyPath := paths.SASigningKey
+	saSigningPubKeyPath := paths.SASigningPubKey
 
 	err = helpers.IdempotentDo(
 		func() (bool, error) {
@@ -292,9 +315,30 @@ func handleCreateOrUpdate(props resourceProperties, whisp whisperer.Whisperer) e
 		return err
 	}
 
+	for _, caType := range []string{CATypeCluster, CATypeEtcd, CATypeFrontProxy} {
+		step := props.RotateCA[caType]
+		if step == "" {
+			continue
+		}
+		newCert, newKey, err := rotateCA(whisp, caType, step, paths.CAs[caType], &props.KMSKeyID)
+		if err != nil {
+			return err
+		}
+		if caType == CATypeCluster && newCert != nil {
+			caCert, caKey = newCert, newKey
+		}
+	}
+
+	// The API client certificate is re-issued whenever it was not signed by
+	// the signing CA, as after a promotion, including one interrupted before
+	// the certificate was re-issued.
 	err = helpers.IdempotentDo(
 		func() (bool, error) {
-			return whisp.HasParameters(apiClientCertPath, apiClientKeyPath)
+			hasParameters, err := whisp.HasParameters(apiClientCertPath, apiClientKeyPath)
+			if err != nil || !hasParameters {
+				return false, err
+			}
+			return signedBy(whisp, apiClientCertPath, caCert)
 		},
 		func() error {
 			return genAPIClientCert(whisp, caCert, caKey, apiClientCertPath, apiClientKeyPath, &props.KMSKeyID)
@@ -327,37 +371,62 @@ func handleCreateOrUpdate(props resourceProperties, whisp whisperer.Whisperer) e
 }
 
 func Handle(_ctx context.Context, event cfn.Event) (string, map[string]interface{}, error) {
-	fmt.Printf("Event: %+v\n", event)
+	logging.Info("Received event", "requestType", event.RequestType, "requestId", event.RequestID,
+		"stackId", event.StackID, "logicalResourceId", event.LogicalResourceID,
+		"properties", event.ResourceProperties)
 
-	emptyResourceID := ""
 	emptyResponse := make(map[string]interface{})
 
-	if event.RequestType != cfn.RequestCreate && event.RequestType != cfn.RequestUpdate {
-		fmt.Printf("Doing nothing for %s request type\n", event.RequestType)
-		return emptyResourceID, emptyResponse, nil
-	}
-
 	var props resourceProperties
 	err := mapstructure.Decode(event.ResourceProperties, &props)
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
-		return emptyResourceID, emptyResponse, err
+		logging.Error("Invalid resource properties", "error", err)
+		if event.RequestType == cfn.RequestDelete {
+			// Failing would leave the stack unable to be deleted.
+			return event.PhysicalResourceID, emptyResponse, nil
+		}
+		return event.PhysicalResourceID, emptyResponse, err
+	}
+	logger := logging.With("cluster", props.ClusterName)
+	physicalResourceID := resourceID(props.ClusterName)
+
+	if event.RequestType == cfn.RequestDelete {
+		if !deleteWanted(event, physicalResourceID) {
+			return event.PhysicalResourceID, emptyResponse, nil
+		}
+		physicalResourceID = event.PhysicalResourceID
 	}
 
 	sess, err := session.NewSession()
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
-		return emptyResourceID, emptyResponse, err
+		logger.Error("Failed to create session", "error", err)
+		return physicalResourceID, emptyResponse, err
 	}
 	whisp := whisperer.NewSSMWhisperer(sess)
 
+	if event.RequestType == cfn.RequestDelete {
+		err = handleDelete(props, whisp)
+		if err != nil {
+			logger.Error("Failed to delete artifacts", "error", err)
+		}
+		return physicalResourceID, emptyResponse, err
+	}
+
 	err = handleCreateOrUpdate(props, whisp)
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
+		logger.Error("Failed to create artifacts", "error", err)
+		return physicalResourceID, emptyResponse, err
+	}
+
+	data, err := responseData(newArtifactPaths(props.ClusterName), whisp)
+	if err != nil {
+		logger.Error("Failed to read artifacts", "error", err)
+		return physicalResourceID, emptyResponse, err
 	}
-	return emptyResourceID, emptyResponse, err
+	return physicalResourceID, data, nil
 }
 
 func main() {
+	logging.ConfigureFromEnv()
 	lambda.Start(cfn.LambdaWrap(Handle))
 }
@@ -97,7 +97,23 @@ d/7GD2s85mcbJCAGYBT8XBawWfObWOPvZ3VQLalBfa92GQlmcgg=
 	invalidCAMaterial = "xyz"
 )
 
+// signedClientCert returns an API client certificate signed by the CA in
+// caCertMaterial and caKeyMaterial.
+func signedClientCert(t *testing.T) *string {
+	whisp := newMemWhisperer()
+	whisp.parameters[*caCertPath] = caCertMaterial
+	whisp.parameters[*caKeyPath] = caKeyMaterial
+	caCert, caKey, err := retrieveCA(whisp, caCertPath, caKeyPath)
+	assert.NoError(t, err)
+	kmsKeyID := ""
+	err = genAPIClientCert(whisp, caCert, caKey, apiClientCertPath, apiClientKeyPath, &kmsKeyID)
+	assert.NoError(t, err)
+	clientCert := whisp.parameters[*apiClientCertPath]
+	return &clientCert
+}
+
 func TestHandleCreateOrUpdate(t *testing.T) {
+	clientCert := signedClientCert(t)
 	var tests = []struct {
 		setupMock func(s *mocks.Whisperer)
 		err       error
@@ -122,6 +138,7 @@ func TestHandleCreateOrUpdate(t *testing.T) {
 				w.On("HasParameters", mock.Anything, mock.Anything).Return(true, nil)
 				w.On("GetParameter", caCertPath).Return(&caCertMaterial, nil)
 				w.On("GetParameter", caKeyPath).Return(&caKeyMaterial, nil)
+				w.On("GetParameter", apiClientCertPath).Return(clientCert, nil)
 			},
 			nil,
 		},
@@ -131,6 +148,9 @@ func TestHandleCreateOrUpdate(t *testing.T) {
 				w.On("HasParameters", mock.Anything, mock.Anything).Return(true, nil)
 				w.On("ForceStoreParameter", caCertPath, mock.Anything, mock.Anything).Return(nil)
 				w.On("ForceStoreParameter", caKeyPath, mock.Anything, mock.Anything).Return(nil)
+				w.On("GetParameter", apiClientCertPath).Return(clientCert, nil)
+				w.On("ForceStoreParameter", apiClientCertPath, mock.Anything, mock.Anything).Return(nil)
+				w.On("ForceStoreParameter", apiClientKeyPath, mock.Anything, mock.Anything).Return(nil)
 			},
 			nil,
 		},
@@ -141,6 +161,9 @@ func TestHandleCreateOrUpdate(t *testing.T) {
 				w.On("HasParameters", mock.Anything, mock.Anything).Return(true, nil)
 				w.On("ForceStoreParameter", caCertPath, mock.Anything, mock.Anything).Return(nil)
 				w.On("ForceStoreParameter", caKeyPath, mock.Anything, mock.Anything).Return(nil)
+				w.On("GetParameter", apiClientCertPath).Return(clientCert, nil)
+				w.On("ForceStoreParameter", apiClientCertPath, mock.Anything, mock.Anything).Return(nil)
+				w.On("ForceStoreParameter", apiClientKeyPath, mock.Anything, mock.Anything).Return(nil)
 			},
 			nil,
 		},
@@ -152,6 +175,7 @@ func TestHandleCreateOrUpdate(t *testing.T) {
 				w.On("HasParameters", mock.Anything, mock.Anything).Return(true, nil)
 				w.On("GetParameter", caCertPath).Return(&caCertMaterial, nil)
 				w.On("GetParameter", caKeyPath).Return(&caKeyMaterial, nil)
+				w.On("GetParameter", apiClientCertPath).Return(clientCert, nil)
 				w.On("ForceStoreParameter", etcdCACertPath, mock.Anything, mock.Anything).Return(nil)
 				w.On("ForceStoreParameter", etcdCAKeyPath, mock.Anything, mock.Anything).Return(nil)
 			},
@@ -163,6 +187,7 @@ func TestHandleCreateOrUpdate(t *testing.T) {
 				w.On("HasParameters", mock.Anything, mock.Anything).Return(true, nil)
 				w.On("GetParameter", caCertPath).Return(&caCertMaterial, nil)
 				w.On("GetParameter", caKeyPath).Return(&caKeyMaterial, nil)
+				w.On("GetParameter", apiClientCertPath).Return(clientCert, nil)
 				w.On("StoreParameter", bootstrapTokenPath, mock.Anything, mock.Anything).Return(nil)
 			},
 			nil,
@@ -173,6 +198,7 @@ func TestHandleCreateOrUpdate(t *testing.T) {
 				w.On("HasParameters", mock.Anything, mock.Anything).Return(true, nil)
 				w.On("GetParameter", caCertPath).Return(&caCertMaterial, nil)
 				w.On("GetParameter", caKeyPath).Return(&caKeyMaterial, nil)
+				w.On("GetParameter", apiClientCertPath).Return(clientCert, nil)
 				w.On("ForceStoreParameter", frontProxyCACertPath, mock.Anything, mock.Anything).Return(nil)
 				w.On("ForceStoreParameter", frontProxyCAKeyPath, mock.Anything, mock.Anything).Return(nil)
 			},
@@ -195,6 +221,7 @@ func TestHandleCreateOrUpdate(t *testing.T) {
 				w.On("HasParameters", mock.Anything, mock.Anything).Return(true, nil)
 				w.On("GetParameter", caCertPath).Return(&caCertMaterial, nil)
 				w.On("GetParameter", caKeyPath).Return(&caKeyMaterial, nil)
+				w.On("GetParameter", apiClientCertPath).Return(clientCert, nil)
 				w.On("ForceStoreParameter", saSigningKeyPath, mock.Anything, mock.Anything).Return(nil)
 				w.On("ForceStoreParameter", saSigningPubKeyPath, mock.Anything, mock.Anything).Return(nil)
 			},
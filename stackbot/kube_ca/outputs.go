@@ -0,0 +1,74 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"time"
+
+	"github.com/cloudboss/keights/stackbot/whisperer"
+	certutil "k8s.io/client-go/util/cert"
+	"k8s.io/kubernetes/cmd/kubeadm/app/util/pkiutil"
+	"k8s.io/kubernetes/cmd/kubeadm/app/util/pubkeypin"
+)
+
+// responseData returns the attributes templates can read from the resource
+// with Fn::GetAtt: the signing cluster CA certificate, the kubeadm discovery
+// hash of the signing CA, the expiry of each CA, and the path of every
+// artifact. The whole CA bundle is left to CACertPath, as during rotation it
+// could exceed the 4096 byte limit of a custom resource response.
+func responseData(paths *artifactPaths, whisp whisperer.Whisperer) (map[string]interface{}, error) {
+	caCert, err := whisp.GetParameter(paths.CACert)
+	if err != nil {
+		return nil, err
+	}
+	caCerts, err := certutil.ParseCertsPEM([]byte(*caCert))
+	if err != nil {
+		return nil, err
+	}
+	etcdCACerts, err := retrieveBundle(whisp, paths.EtcdCACert)
+	if err != nil {
+		return nil, err
+	}
+	frontProxyCACerts, err := retrieveBundle(whisp, paths.FrontProxyCACert)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		// The first certificate in a bundle is the one that signs.
+		"CACert":             string(pkiutil.EncodeCertPEM(caCerts[0])),
+		"DiscoveryHash":      pubkeypin.Hash(caCerts[0]),
+		"CAExpiry":           caCerts[0].NotAfter.UTC().Format(time.RFC3339),
+		"EtcdCAExpiry":       etcdCACerts[0].NotAfter.UTC().Format(time.RFC3339),
+		"FrontProxyCAExpiry": frontProxyCACerts[0].NotAfter.UTC().Format(time.RFC3339),
+
+		"BootstrapTokenPath":   *paths.BootstrapToken,
+		"CACertPath":           *paths.CACert,
+		"CAKeyPath":            *paths.CAKey,
+		"EtcdCACertPath":       *paths.EtcdCACert,
+		"EtcdCAKeyPath":        *paths.EtcdCAKey,
+		"FrontProxyCACertPath": *paths.FrontProxyCACert,
+		"FrontProxyCAKeyPath":  *paths.FrontProxyCAKey,
+		"APIClientCertPath":    *paths.APIClientCert,
+		"APIClientKeyPath":     *paths.APIClientKey,
+		"SASigningKeyPath":     *paths.SASigningKey,
+		"SASigningPubKeyPath":  *paths.SASigningPubKey,
+	}, nil
+}
@@ -0,0 +1,71 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/cmd/kubeadm/app/util/pkiutil"
+)
+
+func TestResponseData(t *testing.T) {
+	whisp := newMemWhisperer()
+	props := resourceProperties{ClusterName: clusterName}
+	assert.NoError(t, handleCreateOrUpdate(props, whisp))
+	paths := newArtifactPaths(clusterName)
+
+	data, err := responseData(paths, whisp)
+	assert.NoError(t, err)
+	caCert := bundle(t, whisp, caCertPath)[0]
+	sum := sha256.Sum256(caCert.RawSubjectPublicKeyInfo)
+	assert.Equal(t, "sha256:"+hex.EncodeToString(sum[:]), data["DiscoveryHash"])
+	assert.Equal(t, string(pkiutil.EncodeCertPEM(caCert)), data["CACert"])
+	assert.Equal(t, caCert.NotAfter.UTC().Format(time.RFC3339), data["CAExpiry"])
+	assert.Equal(t, bundle(t, whisp, etcdCACertPath)[0].NotAfter.UTC().Format(time.RFC3339),
+		data["EtcdCAExpiry"])
+	assert.Equal(t, "/cb/cluster/ca.crt", data["CACertPath"])
+	assert.Equal(t, "/cb/controller/sa.pub", data["SASigningPubKeyPath"])
+
+	// During rotation the hash follows the CA that signs.
+	props.RotateCA = map[string]string{CATypeCluster: RotateStage}
+	assert.NoError(t, handleCreateOrUpdate(props, whisp))
+	data, err = responseData(paths, whisp)
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:"+hex.EncodeToString(sum[:]), data["DiscoveryHash"])
+	// Only the signing certificate is returned, not the whole bundle.
+	assert.Len(t, bundle(t, whisp, caCertPath), 2)
+	assert.Equal(t, string(pkiutil.EncodeCertPEM(caCert)), data["CACert"])
+
+	props.RotateCA = map[string]string{CATypeCluster: RotatePromote}
+	assert.NoError(t, handleCreateOrUpdate(props, whisp))
+	data, err = responseData(paths, whisp)
+	assert.NoError(t, err)
+	newCert := bundle(t, whisp, caCertPath)[0]
+	newSum := sha256.Sum256(newCert.RawSubjectPublicKeyInfo)
+	assert.Equal(t, "sha256:"+hex.EncodeToString(newSum[:]), data["DiscoveryHash"])
+
+	_, err = responseData(newArtifactPaths("missing"), whisp)
+	assert.Error(t, err)
+}
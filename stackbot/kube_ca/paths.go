@@ -0,0 +1,90 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	kubeadmconstants "k8s.io/kubernetes/cmd/kubeadm/app/constants"
+)
+
+// artifactPaths are the SSM paths of everything kube_ca creates for a
+// cluster.
+type artifactPaths struct {
+	BootstrapToken   *string
+	CACert           *string
+	CAKey            *string
+	EtcdCACert       *string
+	EtcdCAKey        *string
+	FrontProxyCACert *string
+	FrontProxyCAKey  *string
+	APIClientCert    *string
+	APIClientKey     *string
+	SASigningKey     *string
+	SASigningPubKey  *string
+	// CAs maps each CA type to its paths, including those of a CA staged
+	// during rotation.
+	CAs map[string]*caPaths
+}
+
+func newArtifactPaths(clusterName string) *artifactPaths {
+	clusterScopedPath := pathFormatter(clusterPathTemplate, clusterName)
+	controllerScopedPath := pathFormatter(controllerPathTemplate, clusterName)
+	paths := &artifactPaths{
+		BootstrapToken:   clusterScopedPath(bootstrapTokenName),
+		CACert:           clusterScopedPath(kubeadmconstants.CACertName),
+		CAKey:            controllerScopedPath(kubeadmconstants.CAKeyName),
+		EtcdCACert:       controllerScopedPath(etcdCACertName),
+		EtcdCAKey:        controllerScopedPath(etcdCAKeyName),
+		FrontProxyCACert: controllerScopedPath(kubeadmconstants.FrontProxyCACertName),
+		FrontProxyCAKey:  controllerScopedPath(kubeadmconstants.FrontProxyCAKeyName),
+		APIClientCert:    controllerScopedPath(kubeadmconstants.APIServerKubeletClientCertName),
+		APIClientKey:     controllerScopedPath(kubeadmconstants.APIServerKubeletClientKeyName),
+		SASigningKey:     controllerScopedPath(kubeadmconstants.ServiceAccountPrivateKeyName),
+		SASigningPubKey:  controllerScopedPath(kubeadmconstants.ServiceAccountPublicKeyName),
+	}
+	paths.CAs = map[string]*caPaths{
+		CATypeCluster: newCAPaths(paths.CACert, paths.CAKey, controllerScopedPath, "ca"),
+		CATypeEtcd:    newCAPaths(paths.EtcdCACert, paths.EtcdCAKey, controllerScopedPath, "etcd-ca"),
+		CATypeFrontProxy: newCAPaths(paths.FrontProxyCACert, paths.FrontProxyCAKey,
+			controllerScopedPath, "front-proxy-ca"),
+	}
+	return paths
+}
+
+// All returns every path, including those of CAs staged for rotation.
+func (p *artifactPaths) All() []*string {
+	all := []*string{
+		p.BootstrapToken,
+		p.CACert,
+		p.CAKey,
+		p.EtcdCACert,
+		p.EtcdCAKey,
+		p.FrontProxyCACert,
+		p.FrontProxyCAKey,
+		p.APIClientCert,
+		p.APIClientKey,
+		p.SASigningKey,
+		p.SASigningPubKey,
+	}
+	for _, caType := range []string{CATypeCluster, CATypeEtcd, CATypeFrontProxy} {
+		all = append(all, p.CAs[caType].NextCert, p.CAs[caType].NextKey)
+	}
+	return all
+}
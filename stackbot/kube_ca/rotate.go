@@ -0,0 +1,239 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"strings"
+
+	"github.com/cloudboss/keights/pkg/logging"
+	"github.com/cloudboss/keights/stackbot/whisperer"
+	certutil "k8s.io/client-go/util/cert"
+	"k8s.io/client-go/util/keyutil"
+)
+
+// Rotation of a CA is requested with the RotateCA property, which maps a CA
+// type to a step, advanced one stack update at a time:
+//
+//   - Stage generates a new CA, stored alongside the current one, and adds
+//     its certificate to the trusted bundle after the current certificate.
+//     Instances replaced after this trust certificates signed by either CA.
+//   - Promote, once all instances trust the new CA, makes it the signing
+//     CA, keeping the old certificate in the bundle so that certificates it
+//     signed remain valid, and re-issues certificates kube_ca signs.
+//   - Complete, once all instances have certificates signed by the new CA,
+//     removes the old certificate from the bundle.
+//
+// The signing certificate is always first in the bundle, so kubeadm, which
+// uses the first certificate with the CA key, signs with the right one.
+const (
+	RotateStage    = "Stage"
+	RotatePromote  = "Promote"
+	RotateComplete = "Complete"
+
+	CATypeCluster    = "Cluster"
+	CATypeEtcd       = "Etcd"
+	CATypeFrontProxy = "FrontProxy"
+
+	nextSuffix = "-next"
+)
+
+// caPaths are the SSM paths of a CA, and of the CA staged to replace it.
+type caPaths struct {
+	Cert     *string
+	Key      *string
+	NextCert *string
+	NextKey  *string
+}
+
+func newCAPaths(certPath, keyPath *string, controllerScopedPath func(string) *string,
+	name string) *caPaths {
+	return &caPaths{
+		Cert:     certPath,
+		Key:      keyPath,
+		NextCert: controllerScopedPath(name + nextSuffix + ".crt"),
+		NextKey:  controllerScopedPath(name + nextSuffix + ".key"),
+	}
+}
+
+func validateRotation(rotateCA map[string]string) error {
+	for caType, step := range rotateCA {
+		switch caType {
+		case CATypeCluster, CATypeEtcd, CATypeFrontProxy:
+		default:
+			return fmt.Errorf("unknown CA type %s in RotateCA, expected one of %s, %s, %s",
+				caType, CATypeCluster, CATypeEtcd, CATypeFrontProxy)
+		}
+		switch step {
+		case "", RotateStage, RotatePromote, RotateComplete:
+		default:
+			return fmt.Errorf("unknown step %s for CA type %s in RotateCA, expected one of %s, %s, %s",
+				step, caType, RotateStage, RotatePromote, RotateComplete)
+		}
+	}
+	return nil
+}
+
+func retrieveBundle(whisp whisperer.Whisperer, path *string) ([]*x509.Certificate, error) {
+	bundle, err := whisp.GetParameter(path)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := certutil.ParseCertsPEM([]byte(*bundle))
+	if err != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+
+// appendUnique appends to certs each cert not already there.
+func appendUnique(certs []*x509.Certificate, more ...*x509.Certificate) []*x509.Certificate {
+	for _, cert := range more {
+		found := false
+		for _, existing := range certs {
+			if bytes.Equal(existing.Raw, cert.Raw) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			certs = append(certs, cert)
+		}
+	}
+	return certs
+}
+
+func storeBundle(whisp whisperer.Whisperer, path, kmsKeyID *string, certs []*x509.Certificate) error {
+	bundlePEMBytes, err := certutil.EncodeCertificates(certs...)
+	if err != nil {
+		return err
+	}
+	bundlePEM := string(bundlePEMBytes)
+	logging.Info("Storing parameter", "path", *path, "certificates", len(certs))
+	return whisp.ForceStoreParameter(path, kmsKeyID, &bundlePEM)
+}
+
+func stageCA(whisp whisperer.Whisperer, paths *caPaths, kmsKeyID *string) error {
+	var nextCert *x509.Certificate
+	hasNext, err := whisp.HasParameters(paths.NextCert, paths.NextKey)
+	if err != nil {
+		return err
+	}
+	if hasNext {
+		nextCert, _, err = retrieveCA(whisp, paths.NextCert, paths.NextKey)
+	} else {
+		nextCert, _, err = genCA(whisp, paths.NextCert, paths.NextKey, kmsKeyID)
+	}
+	if err != nil {
+		return err
+	}
+	certs, err := retrieveBundle(whisp, paths.Cert)
+	if err != nil {
+		return err
+	}
+	bundle := appendUnique(certs, nextCert)
+	if len(bundle) == len(certs) {
+		logging.Info("CA is already staged", "path", *paths.NextCert)
+		return nil
+	}
+	return storeBundle(whisp, paths.Cert, kmsKeyID, bundle)
+}
+
+// promoteCA returns the new CA, or nil if no CA is staged, as when it has
+// already been promoted.
+func promoteCA(whisp whisperer.Whisperer, paths *caPaths, kmsKeyID *string) (*x509.Certificate, crypto.Signer, error) {
+	hasNext, err := whisp.HasParameters(paths.NextCert, paths.NextKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !hasNext {
+		logging.Info("No staged CA to promote", "path", *paths.NextCert)
+		return nil, nil, nil
+	}
+	nextCert, nextKey, err := retrieveCA(whisp, paths.NextCert, paths.NextKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	certs, err := retrieveBundle(whisp, paths.Cert)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = storeBundle(whisp, paths.Cert, kmsKeyID, appendUnique([]*x509.Certificate{nextCert}, certs...)); err != nil {
+		return nil, nil, err
+	}
+	nextKeyPEMBytes, err := keyutil.MarshalPrivateKeyToPEM(nextKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	nextKeyPEM := string(nextKeyPEMBytes)
+	logging.Info("Storing parameter", "path", *paths.Key)
+	if err = whisp.ForceStoreParameter(paths.Key, kmsKeyID, &nextKeyPEM); err != nil {
+		return nil, nil, err
+	}
+	// The staged CA is removed last, so that promotion is retried in full
+	// if anything before fails. The key is removed first, so that it is not
+	// left behind if removing the certificate fails.
+	for _, path := range []*string{paths.NextKey, paths.NextCert} {
+		logging.Info("Deleting parameter", "path", *path)
+		if err = whisp.DeleteParameter(path); err != nil {
+			return nil, nil, err
+		}
+	}
+	return nextCert, nextKey, nil
+}
+
+func completeCA(whisp whisperer.Whisperer, paths *caPaths, kmsKeyID *string) error {
+	hasNext, err := whisp.HasParameters(paths.NextCert, paths.NextKey)
+	if err != nil {
+		return err
+	}
+	if hasNext {
+		return fmt.Errorf("CA %s is staged but not promoted", *paths.NextCert)
+	}
+	certs, err := retrieveBundle(whisp, paths.Cert)
+	if err != nil {
+		return err
+	}
+	if len(certs) == 1 {
+		logging.Info("CA rotation is already complete", "path", *paths.Cert)
+		return nil
+	}
+	return storeBundle(whisp, paths.Cert, kmsKeyID, certs[:1])
+}
+
+// rotateCA runs a step of rotation for a CA, returning the new CA if
+// it was promoted.
+func rotateCA(whisp whisperer.Whisperer, caType, step string, paths *caPaths,
+	kmsKeyID *string) (*x509.Certificate, crypto.Signer, error) {
+	logging.Info("Rotating CA", "caType", caType, "step", strings.ToLower(step))
+	switch step {
+	case RotateStage:
+		return nil, nil, stageCA(whisp, paths, kmsKeyID)
+	case RotatePromote:
+		return promoteCA(whisp, paths, kmsKeyID)
+	case RotateComplete:
+		return nil, nil, completeCA(whisp, paths, kmsKeyID)
+	}
+	return nil, nil, nil
+}
@@ -0,0 +1,165 @@
+// Copyright © 2022 Joseph Wright <joseph@cloudboss.co>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	certutil "k8s.io/client-go/util/cert"
+)
+
+// memWhisperer keeps parameters in memory, to follow rotation through
+// several updates.
+type memWhisperer struct {
+	parameters map[string]string
+	deleted    []string
+}
+
+func newMemWhisperer() *memWhisperer {
+	return &memWhisperer{parameters: map[string]string{}}
+}
+
+func (m *memWhisperer) ForceStoreParameter(path, kmsKeyID, content *string) error {
+	m.parameters[*path] = *content
+	return nil
+}
+
+func (m *memWhisperer) StoreParameter(path, kmsKeyID, content *string) error {
+	if _, ok := m.parameters[*path]; ok {
+		return fmt.Errorf("parameter %s already exists", *path)
+	}
+	m.parameters[*path] = *content
+	return nil
+}
+
+func (m *memWhisperer) DeleteParameter(path *string) error {
+	delete(m.parameters, *path)
+	m.deleted = append(m.deleted, *path)
+	return nil
+}
+
+func (m *memWhisperer) HasParameters(paths ...*string) (bool, error) {
+	for _, path := range paths {
+		if _, ok := m.parameters[*path]; !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (m *memWhisperer) GetParameter(path *string) (*string, error) {
+	value, ok := m.parameters[*path]
+	if !ok {
+		return nil, fmt.Errorf("secret %s not found", *path)
+	}
+	return &value, nil
+}
+
+func bundle(t *testing.T, whisp *memWhisperer, path *string) []*x509.Certificate {
+	certs, err := certutil.ParseCertsPEM([]byte(whisp.parameters[*path]))
+	assert.NoError(t, err)
+	return certs
+}
+
+func TestValidateRotation(t *testing.T) {
+	assert.NoError(t, validateRotation(nil))
+	assert.NoError(t, validateRotation(map[string]string{"Cluster": "Stage", "Etcd": ""}))
+	assert.EqualError(t, validateRotation(map[string]string{"Kubelet": "Stage"}),
+		"unknown CA type Kubelet in RotateCA, expected one of Cluster, Etcd, FrontProxy")
+	assert.EqualError(t, validateRotation(map[string]string{"Etcd": "Now"}),
+		"unknown step Now for CA type Etcd in RotateCA, expected one of Stage, Promote, Complete")
+}
+
+func TestRotateCA(t *testing.T) {
+	whisp := newMemWhisperer()
+	props := resourceProperties{ClusterName: clusterName}
+	assert.NoError(t, handleCreateOrUpdate(props, whisp))
+	oldCert := bundle(t, whisp, caCertPath)[0]
+	oldKey := whisp.parameters[*caKeyPath]
+	oldClientCert := whisp.parameters[*apiClientCertPath]
+	etcdCA := whisp.parameters[*etcdCACertPath]
+	nextCertPath := controllerScopedPath("ca-next.crt")
+	nextKeyPath := controllerScopedPath("ca-next.key")
+
+	props.RotateCA = map[string]string{CATypeCluster: RotateStage}
+	assert.NoError(t, handleCreateOrUpdate(props, whisp))
+	staged := bundle(t, whisp, caCertPath)
+	assert.Len(t, staged, 2)
+	assert.Equal(t, oldCert.Raw, staged[0].Raw)
+	assert.Equal(t, oldKey, whisp.parameters[*caKeyPath])
+	assert.Equal(t, oldClientCert, whisp.parameters[*apiClientCertPath])
+	newCert := bundle(t, whisp, nextCertPath)[0]
+	assert.Equal(t, newCert.Raw, staged[1].Raw)
+	newKey := whisp.parameters[*nextKeyPath]
+
+	// Staging again, as on an unrelated update, changes nothing.
+	assert.NoError(t, handleCreateOrUpdate(props, whisp))
+	assert.Equal(t, staged, bundle(t, whisp, caCertPath))
+	assert.Equal(t, newKey, whisp.parameters[*nextKeyPath])
+
+	props.RotateCA = map[string]string{CATypeCluster: RotatePromote}
+	assert.NoError(t, handleCreateOrUpdate(props, whisp))
+	promoted := bundle(t, whisp, caCertPath)
+	assert.Len(t, promoted, 2)
+	assert.Equal(t, newCert.Raw, promoted[0].Raw)
+	assert.Equal(t, oldCert.Raw, promoted[1].Raw)
+	assert.Equal(t, newKey, whisp.parameters[*caKeyPath])
+	assert.NotContains(t, whisp.parameters, *nextCertPath)
+	assert.NotContains(t, whisp.parameters, *nextKeyPath)
+	assert.Equal(t, []string{*nextKeyPath, *nextCertPath}, whisp.deleted)
+	clientCert := bundle(t, whisp, apiClientCertPath)[0]
+	assert.NoError(t, clientCert.CheckSignatureFrom(newCert))
+	assert.Equal(t, etcdCA, whisp.parameters[*etcdCACertPath])
+
+	// Promoting again does not re-issue the client certificate.
+	reissued := whisp.parameters[*apiClientCertPath]
+	assert.NoError(t, handleCreateOrUpdate(props, whisp))
+	assert.Equal(t, reissued, whisp.parameters[*apiClientCertPath])
+
+	// A promotion interrupted before the client certificate was re-issued
+	// re-issues it on the next update, though no CA is promoted then.
+	whisp.parameters[*apiClientCertPath] = oldClientCert
+	assert.NoError(t, handleCreateOrUpdate(props, whisp))
+	assert.NoError(t, bundle(t, whisp, apiClientCertPath)[0].CheckSignatureFrom(newCert))
+
+	props.RotateCA = map[string]string{CATypeCluster: RotateComplete}
+	assert.NoError(t, handleCreateOrUpdate(props, whisp))
+	completed := bundle(t, whisp, caCertPath)
+	assert.Len(t, completed, 1)
+	assert.Equal(t, newCert.Raw, completed[0].Raw)
+}
+
+func TestCompleteBeforePromote(t *testing.T) {
+	whisp := newMemWhisperer()
+	props := resourceProperties{
+		ClusterName: clusterName,
+		RotateCA:    map[string]string{CATypeEtcd: RotateStage},
+	}
+	assert.NoError(t, handleCreateOrUpdate(props, whisp))
+	assert.Len(t, bundle(t, whisp, etcdCACertPath), 2)
+
+	props.RotateCA = map[string]string{CATypeEtcd: RotateComplete}
+	assert.EqualError(t, handleCreateOrUpdate(props, whisp),
+		"CA /cb/controller/etcd-ca-next.crt is staged but not promoted")
+}
@@ -29,24 +29,30 @@ import (
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/cloudboss/keights/pkg/logging"
 	"github.com/mitchellh/mapstructure"
 )
 
 func Handle(_ctx context.Context, event cfn.Event) (string, map[string]interface{}, error) {
-	fmt.Printf("Event: %v\n", event)
+	logging.Info("Received event", "requestType", event.RequestType, "requestId", event.RequestID,
+		"stackId", event.StackID, "logicalResourceId", event.LogicalResourceID,
+		"properties", event.ResourceProperties)
 
-	physicalResourceID := ""
 	data := make(map[string]interface{})
 
-	if event.RequestType == "Delete" {
-		return physicalResourceID, data, nil
+	if event.RequestType == cfn.RequestDelete {
+		return event.PhysicalResourceID, data, nil
 	}
 
 	var props resourceProperties
 	err := mapstructure.Decode(event.ResourceProperties, &props)
 	if err != nil {
-		return physicalResourceID, data, err
+		return event.PhysicalResourceID, data, err
+	}
+	if props.ClusterName == "" {
+		return event.PhysicalResourceID, data, fmt.Errorf("ClusterName is required")
 	}
+	physicalResourceID := resourceID(props.ClusterName)
 
 	sess, err := session.NewSession()
 	if err != nil {
@@ -61,16 +67,23 @@ func Handle(_ctx context.Context, event cfn.Event) (string, map[string]interface
 
 	data["AvailabilityZones"] = azs
 
-	fmt.Printf("Data: %v\n", data)
+	logging.Info("Resolved availability zones", "availabilityZones", azs)
 
 	return physicalResourceID, data, err
 }
 
 type resourceProperties struct {
 	ServiceToken *string
+	ClusterName  string
 	SubnetIDs    []*string `mapstructure:"SubnetIds"`
 }
 
+// resourceID is the physical resource ID. It must not change on update,
+// or CloudFormation would delete the resource with the old ID afterward.
+func resourceID(clusterName string) string {
+	return fmt.Sprintf("%s-subnet-to-az", clusterName)
+}
+
 func subnetsToAZs(client *ec2.EC2, subnetIDs []*string) (string, error) {
 	azs := make([]string, len(subnetIDs))
 	for i, subnetID := range subnetIDs {
@@ -93,5 +106,6 @@ func subnetsToAZs(client *ec2.EC2, subnetIDs []*string) (string, error) {
 }
 
 func main() {
+	logging.ConfigureFromEnv()
 	lambda.Start(cfn.LambdaWrap(Handle))
 }
@@ -22,11 +22,13 @@ package whisperer
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/cloudboss/keights/pkg/logging"
 )
 
 type Whisperer interface {
@@ -91,7 +93,11 @@ func (w *whisperer) HasParameters(paths ...*string) (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	fmt.Printf("Parameters: %+v\n", parameters)
+	found := make([]string, 0, len(parameters))
+	for _, parameter := range parameters {
+		found = append(found, aws.StringValue(parameter.Name))
+	}
+	logging.Debug("Found parameters", "parameters", strings.Join(found, ","))
 	return len(parameters) == len(paths), nil
 }
 